@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/utils"
+	"net/http"
+)
+
+// HandleRetention reports the retention policy and the last purge on GET, and purges right away on POST
+func (h *Handlers) HandleRetention(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		utils.RespondWithJSON(w, http.StatusOK, h.janitor.Status(r.Context()))
+	case http.MethodPost:
+		if h.janitor == nil {
+			utils.RespondWithJSON(w, http.StatusConflict, map[string]string{"message": "No retention policy is configured"})
+			return
+		}
+		utils.RespondWithJSON(w, http.StatusOK, h.janitor.Purge(r.Context()))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// workerPoolStatus is the response of /admin/workers
+type workerPoolStatus struct {
+	Size          int                       `json:"size"`
+	Active        int                       `json:"active"`
+	Queued        int                       `json:"queued"`
+	QueueCapacity int                       `json:"queue_capacity"`
+	Queues        []internal.QueueStatus    `json:"queues"`
+	Autoscale     *internal.AutoscaleStatus `json:"autoscale,omitempty"`
+}
+
+// workerPoolOverride is the body of a POST to /admin/workers
+type workerPoolOverride struct {
+	Size      int   `json:"size"`      // Resizes the pool, pausing autoscaling
+	Autoscale *bool `json:"autoscale"` // Resumes or pauses autoscaling
+}
+
+// HandleWorkers reports the worker pool size and autoscaling on GET, and overrides them on POST
+func (h *Handlers) HandleWorkers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var override workerPoolOverride
+		if err := json.NewDecoder(r.Body).Decode(&override); err != nil {
+			utils.RespondWithJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid request body: " + err.Error()})
+			return
+		}
+		if override.Size < 0 || (override.Size == 0 && override.Autoscale == nil) {
+			utils.RespondWithJSON(w, http.StatusBadRequest, map[string]string{"message": "Expected a positive size or autoscale"})
+			return
+		}
+		if override.Autoscale != nil && h.autoscaler == nil {
+			utils.RespondWithJSON(w, http.StatusConflict, map[string]string{"message": "Autoscaling is not configured"})
+			return
+		}
+		if override.Size > 0 {
+			if h.autoscaler != nil {
+				if err := h.autoscaler.Override(override.Size); err != nil {
+					utils.RespondWithJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+					return
+				}
+			} else if override.Size > internal.MaxPoolSize {
+				utils.RespondWithJSON(w, http.StatusBadRequest, map[string]string{"message": fmt.Sprintf("Worker pool size must be at most %d", internal.MaxPoolSize)})
+				return
+			} else {
+				h.wp.Resize(override.Size)
+			}
+		}
+		if override.Autoscale != nil {
+			if *override.Autoscale {
+				h.autoscaler.Resume()
+			} else {
+				h.autoscaler.Pause()
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := workerPoolStatus{
+		Size:          h.wp.Size(),
+		Active:        h.wp.ActiveWorkers(),
+		Queued:        h.wp.QueuedTasks(),
+		QueueCapacity: h.wp.QueueCapacity(),
+		Queues:        h.wp.Queues(),
+	}
+	if h.autoscaler != nil {
+		autoscale := h.autoscaler.Status()
+		status.Autoscale = &autoscale
+	}
+	utils.RespondWithJSON(w, http.StatusOK, status)
+}
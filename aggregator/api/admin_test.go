@@ -0,0 +1,99 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"log-aggregator/aggregator/api"
+	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHandleRetention tests purging on demand and reporting the last purge.
+func TestHandleRetention(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	wp := internal.NewWorkerPool(1, nil, store, nil, nil)
+	t.Cleanup(wp.Stop)
+	janitor := internal.NewJanitor(store, storage.RetentionPolicy{MaxAge: time.Hour}, time.Hour, nil)
+	handlers := api.NewHandlers(wp, internal.NewNamedCircuitBreaker(internal.BreakerInsert, 3, 10*time.Second), internal.NewNamedCircuitBreaker(internal.BreakerQuery, 3, 10*time.Second), nil, nil, janitor, nil)
+
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: time.Now().Add(-2 * time.Hour), Level: "INFO", Message: "old"},
+		{Timestamp: time.Now(), Level: "INFO", Message: "new"},
+	})
+
+	rec := httptest.NewRecorder()
+	handlers.HandleRetention(rec, httptest.NewRequest(http.MethodPost, "/admin/retention", nil))
+	var report internal.PurgeReport
+	json.NewDecoder(rec.Body).Decode(&report)
+	if rec.Code != http.StatusOK || report.Expired != 1 {
+		t.Fatalf("Expected the purge to delete 1 log, got %d: %+v", rec.Code, report)
+	}
+
+	rec = httptest.NewRecorder()
+	handlers.HandleRetention(rec, httptest.NewRequest(http.MethodGet, "/admin/retention", nil))
+	var status internal.RetentionStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	if !status.Enabled || status.MaxAge != "1h0m0s" || status.LastPurge == nil || status.LastPurge.Expired != 1 {
+		t.Errorf("Expected the status to report the policy and last purge, got %+v", status)
+	}
+
+	// Without a policy there is nothing to purge
+	handlers, _ = newTestHandlers(t)
+	rec = httptest.NewRecorder()
+	handlers.HandleRetention(rec, httptest.NewRequest(http.MethodPost, "/admin/retention", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected status Conflict without a retention policy, got %d", rec.Code)
+	}
+}
+
+// TestHandleWorkers tests resizing the worker pool and pausing autoscaling on demand.
+func TestHandleWorkers(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	wp := internal.NewWorkerPool(1, nil, store, nil, nil)
+	t.Cleanup(wp.Stop)
+	autoscaler := internal.NewAutoscaler(wp, internal.AutoscalePolicy{MinWorkers: 1, MaxWorkers: 8, Interval: time.Hour, TargetWait: time.Second})
+	handlers := api.NewHandlers(wp, internal.NewNamedCircuitBreaker(internal.BreakerInsert, 3, 10*time.Second), internal.NewNamedCircuitBreaker(internal.BreakerQuery, 3, 10*time.Second), nil, nil, nil, autoscaler)
+
+	rec := httptest.NewRecorder()
+	handlers.HandleWorkers(rec, httptest.NewRequest(http.MethodPost, "/admin/workers", strings.NewReader(`{"size": 4}`)))
+	var status struct {
+		Size      int                      `json:"size"`
+		Autoscale internal.AutoscaleStatus `json:"autoscale"`
+	}
+	json.NewDecoder(rec.Body).Decode(&status)
+	if rec.Code != http.StatusOK || status.Size != 4 || wp.Size() != 4 || !status.Autoscale.Paused {
+		t.Fatalf("Expected 4 workers with autoscaling paused, got %d: %+v", rec.Code, status)
+	}
+
+	rec = httptest.NewRecorder()
+	handlers.HandleWorkers(rec, httptest.NewRequest(http.MethodPost, "/admin/workers", strings.NewReader(`{"autoscale": true}`)))
+	json.NewDecoder(rec.Body).Decode(&status)
+	if status.Autoscale.Paused || status.Autoscale.MaxWorkers != 8 {
+		t.Errorf("Expected autoscaling to resume, got %+v", status)
+	}
+
+	for _, body := range []string{`{"size": -1}`, `{"size": 10000000}`} {
+		rec = httptest.NewRecorder()
+		handlers.HandleWorkers(rec, httptest.NewRequest(http.MethodPost, "/admin/workers", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request for %s, got %d", body, rec.Code)
+		}
+	}
+	if wp.Size() != 4 {
+		t.Errorf("Expected the rejected sizes to leave 4 workers, got %d", wp.Size())
+	}
+
+	// Without autoscaling the size is capped all the same
+	fixed := api.NewHandlers(wp, internal.NewNamedCircuitBreaker(internal.BreakerInsert, 3, 10*time.Second), internal.NewNamedCircuitBreaker(internal.BreakerQuery, 3, 10*time.Second), nil, nil, nil, nil)
+	rec = httptest.NewRecorder()
+	fixed.HandleWorkers(rec, httptest.NewRequest(http.MethodPost, "/admin/workers", strings.NewReader(`{"size": 10000000}`)))
+	if rec.Code != http.StatusBadRequest || wp.Size() != 4 {
+		t.Errorf("Expected status Bad Request over the max pool size, got %d with %d workers", rec.Code, wp.Size())
+	}
+}
@@ -1,45 +1,149 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/metrics"
 	"log-aggregator/aggregator/utils"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
 	"time"
 )
 
+const (
+	// ndjsonChunkSize is the number of streamed logs submitted to the worker pool at once
+	ndjsonChunkSize = 500
+	// overloadedRetryAfter is when clients turned away for lack of room in the worker pool are told to retry
+	overloadedRetryAfter = time.Second
+)
+
 // Handlers struct
 type Handlers struct {
-	wp             *internal.WorkerPool
-	circuitBreaker *internal.CircuitBreaker // Add circuit breaker field
+	wp            *internal.WorkerPool
+	insertBreaker *internal.CircuitBreaker // Guards the inserts of the workers, batches are turned away while open
+	queryBreaker  *internal.CircuitBreaker // Guards the queries of the workers, queries fail fast while open
+	wal           *internal.WAL            // Accepted batches are logged here before responding
+	hub           *internal.TailHub        // Stored logs are streamed to live tails from here
+	janitor       *internal.Janitor        // Enforces the retention policy, nil when logs are kept forever
+	autoscaler    *internal.Autoscaler     // Resizes the worker pool, nil when its size is fixed
+	queryTimeout  time.Duration            // Deadline of the queries whose route isn't in routeTimeouts
+	routeTimeouts map[string]time.Duration // Deadline of the queries per route path
+	tailOrigins   []string                 // Origins allowed to open WebSocket tails besides the request's host
 }
 
-// NewHandlers initializes the Handlers with a WorkerPool and CircuitBreaker
-func NewHandlers(wp *internal.WorkerPool, cb *internal.CircuitBreaker) *Handlers {
+// NewHandlers initializes the Handlers with a WorkerPool, the insert and query CircuitBreakers guarding its storage,
+// WAL (which may be nil), TailHub, retention Janitor (which may be nil) and Autoscaler (which may be nil)
+func NewHandlers(wp *internal.WorkerPool, insertBreaker, queryBreaker *internal.CircuitBreaker, wal *internal.WAL, hub *internal.TailHub, janitor *internal.Janitor, autoscaler *internal.Autoscaler) *Handlers {
 	return &Handlers{
-		wp:             wp,
-		circuitBreaker: cb, // Initialize circuit breaker
+		wp:            wp,
+		insertBreaker: insertBreaker,
+		queryBreaker:  queryBreaker,
+		wal:           wal,
+		hub:           hub,
+		janitor:       janitor,
+		autoscaler:    autoscaler,
+		queryTimeout:  defaultQueryTimeout,
 	}
 }
 
-// HandleHealthCheck handles health check requests
-func (h *Handlers) HandleHealthCheck(w http.ResponseWriter, r *http.Request) {
-	activeWorkers := h.wp.ActiveWorkers()
-	queuedTasks := h.wp.QueuedTasks()
+// queryContext returns the context of a query job, done when the client goes away or the deadline of the route passes
+func (h *Handlers) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout, ok := h.routeTimeouts[r.URL.Path]
+	if !ok {
+		timeout = h.queryTimeout
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
 
-	// Basic health check logic
-	if activeWorkers == 0 {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte("No active workers"))
-		return
-	} else if queuedTasks > 100 {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte(fmt.Sprintf("Too many queued tasks: %d", queuedTasks)))
+// respondQueryDone answers a query whose context is done before its result came in, unless the client is gone
+func respondQueryDone(w http.ResponseWriter, ctx context.Context, message string) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		utils.RespondWithJSON(w, http.StatusGatewayTimeout, map[string]string{"message": message})
+	}
+}
+
+// respondJobError answers a query job that failed, telling invalid queries and storage failures apart
+func (h *Handlers) respondJobError(w http.ResponseWriter, ctx context.Context, result utils.JobResult, action string) {
+	switch result.Kind {
+	case utils.ErrorCanceled:
+		respondQueryDone(w, ctx, "Timeout while "+action)
+	case utils.ErrorInvalid:
+		utils.RespondWithJSON(w, http.StatusBadRequest, map[string]string{"message": result.Err.Error()})
+	case utils.ErrorUnavailable:
+		respondUnavailable(w, h.queryBreaker.RetryAfter())
+	default:
+		utils.RespondWithJSON(w, http.StatusServiceUnavailable, map[string]string{"message": "Storage failed while " + action, "error": result.Err.Error()})
+	}
+}
+
+// respondSubmitError answers a query whose job couldn't be queued
+func respondSubmitError(w http.ResponseWriter, ctx context.Context, err error) {
+	switch {
+	case ctx.Err() != nil:
+		respondQueryDone(w, ctx, "Timeout while waiting for a worker")
+	case internal.IsOverloaded(err):
+		setRetryAfter(w, overloadedRetryAfter)
+		utils.RespondWithJSON(w, http.StatusTooManyRequests, map[string]string{"message": "Too many queued jobs, retry later", "error": err.Error()})
+	default:
+		http.Error(w, "Service unavailable: "+err.Error(), http.StatusServiceUnavailable)
+	}
+}
+
+// respondUnavailable turns a request away while a circuit breaker is open, telling the client when to retry
+func respondUnavailable(w http.ResponseWriter, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+	utils.RespondWithJSON(w, http.StatusServiceUnavailable, map[string]string{"message": "Storage is unavailable, retry later"})
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, at least one
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+}
+
+// setServerTiming reports how long the job waited for a worker and how long it took, in milliseconds
+func setServerTiming(w http.ResponseWriter, result utils.JobResult) {
+	w.Header().Set("Server-Timing", fmt.Sprintf("queue;dur=%.3f, job;dur=%.3f",
+		float64(result.Wait)/float64(time.Millisecond), float64(result.Duration)/float64(time.Millisecond)))
+}
+
+// HandleMetrics exposes the metrics of the aggregator in the Prometheus text format
+func (h *Handlers) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if err := utils.ValidateRequest(w, r, http.MethodGet); err != nil {
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf("OK - Active workers: %d, Queued tasks: %d", activeWorkers, queuedTasks)))
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.Default.Write(w); err != nil {
+		return
+	}
+	// Gauges are sampled at scrape time
+	breakerStates := map[internal.BreakerState]float64{internal.StateClosed: 0, internal.StateOpen: 1, internal.StateHalfOpen: 2}
+	breakers := make(map[string]float64)
+	failureRates := make(map[string]float64)
+	for _, cb := range []*internal.CircuitBreaker{h.insertBreaker, h.queryBreaker} {
+		counts := cb.Counts()
+		breakers[cb.Name()] = breakerStates[counts.State]
+		failureRates[cb.Name()] = 0
+		if counts.Calls > 0 {
+			failureRates[cb.Name()] = float64(counts.Failures) / float64(counts.Calls)
+		}
+	}
+	depths := make(map[string]float64)
+	for _, q := range h.wp.Queues() {
+		depths[q.Type] = float64(q.Queued)
+	}
+	metrics.WriteGaugeVec(w, "log_aggregator_queue_depth", "Jobs waiting for a worker by job type.", "type", depths)
+	metrics.WriteGauge(w, "log_aggregator_active_workers", "Workers running in the pool.", float64(h.wp.ActiveWorkers()))
+	metrics.WriteGauge(w, "log_aggregator_worker_pool_size", "Workers the pool is sized to.", float64(h.wp.Size()))
+	metrics.WriteGauge(w, "log_aggregator_queued_bytes", "Bytes of logs held by the queued and running store jobs.", float64(h.wp.QueuedBytes()))
+	metrics.WriteGaugeVec(w, "log_aggregator_circuit_breaker_state", "Circuit breaker state by breaker, 0 closed, 1 open and 2 half-open.", "breaker", breakers)
+	metrics.WriteGaugeVec(w, "log_aggregator_circuit_breaker_failure_rate", "Share of failed calls in the window of a closed circuit breaker by breaker.", "breaker", failureRates)
+	metrics.WriteGauge(w, "log_aggregator_tail_subscribers", "Clients live tailing logs.", float64(h.hub.Subscribers()))
 }
 
 func (h *Handlers) HandleLogRetrieval(w http.ResponseWriter, r *http.Request) {
@@ -49,48 +153,136 @@ func (h *Handlers) HandleLogRetrieval(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//parses our query
-	startTime, endTime, logLevel, err := utils.ParseLogQueryParams(r)
+	query, err := utils.ParseLogQueryParams(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		respondQueryError(w, err)
 		return
 	}
+	// Ask for one extra log to know whether there is a next page
+	pageSize := query.Limit
+	query.Limit++
 
-	// Create a channel to receive the result of the log retrieval
-	resultChannel := make(chan []utils.LogMessage)
+	ctx, cancel := h.queryContext(r)
+	defer cancel()
+	// Create a channel to receive the result of the log retrieval, buffered so the worker never waits on it
+	resultChannel := make(chan utils.JobResult, 1)
 
 	// Create the fetch job with the result channel
 	job := utils.Job{
-		Type:      utils.FetchJob, // This job is to fetch logs
-		Result:    resultChannel,
-		StartTime: startTime,
-		EndTime:   endTime,
-		LogLevel:  logLevel,
+		Ctx:   ctx,
+		Type:  utils.FetchJob, // This job is to fetch logs
+		Query: query,
+		Done:  resultChannel,
 	}
 
+	// Fail fast while storage is known to be failing
+	if retryAfter := h.queryBreaker.RetryAfter(); retryAfter > 0 {
+		respondUnavailable(w, retryAfter)
+		return
+	}
 	// Add the job to the worker pool
-	if err := h.circuitBreaker.Call(func() error {
-		h.wp.AddJob(job)
-		return nil
-	}); err != nil {
-		http.Error(w, "Service unavailable: "+err.Error(), http.StatusServiceUnavailable)
+	if err := h.wp.AddJob(job); err != nil {
+		respondSubmitError(w, ctx, err)
 		return
 	}
 
 	// Wait for the result from the worker
 	select {
-	case fetchedLogs := <-resultChannel:
-		fmt.Println(fetchedLogs)
-		if len(fetchedLogs) == 0 {
+	case result := <-resultChannel:
+		setServerTiming(w, result)
+		if result.Err != nil {
+			h.respondJobError(w, ctx, result, "fetching logs")
+			return
+		}
+		fetchedLogs := result.Logs
+		// An empty first page means nothing matched, an empty later page just ends the iteration
+		if len(fetchedLogs) == 0 && query.After == nil {
 			utils.RespondWithJSON(w, http.StatusNotFound, map[string]string{"message": "No logs found"})
-		} else {
-			utils.RespondWithJSON(w, http.StatusOK, fetchedLogs)
+			return
+		}
+		page := utils.LogPage{Logs: fetchedLogs}
+		if len(fetchedLogs) > pageSize {
+			page.Logs = fetchedLogs[:pageSize]
+			page.NextCursor = utils.EncodeCursor(page.Logs[pageSize-1])
+			// Ranked results have no stable key to resume from, so they continue at an offset
+			if query.Order == utils.OrderRelevance {
+				offset := 0
+				if query.After != nil {
+					offset = query.After.Offset
+				}
+				page.NextCursor = utils.EncodeOffsetCursor(offset + pageSize)
+			}
+		}
+		if page.Logs == nil {
+			page.Logs = []utils.LogMessage{}
 		}
-	case <-time.After(10 * time.Second): // Timeout to avoid long waits
-		utils.RespondWithJSON(w, http.StatusInternalServerError, map[string]string{"message": "Timeout while fetching logs"})
+		utils.RespondWithJSON(w, http.StatusOK, page)
+	case <-ctx.Done(): // The worker gives up on the job as well
+		respondQueryDone(w, ctx, "Timeout while fetching logs")
 	}
 
 }
 
+// HandleLogStats counts the logs matching the query parameters per time bucket and groupBy field values
+func (h *Handlers) HandleLogStats(w http.ResponseWriter, r *http.Request) {
+	if err := utils.ValidateRequest(w, r, http.MethodGet); err != nil {
+		return
+	}
+
+	query, err := utils.ParseStatsQueryParams(r)
+	if err != nil {
+		respondQueryError(w, err)
+		return
+	}
+
+	ctx, cancel := h.queryContext(r)
+	defer cancel()
+	resultChannel := make(chan utils.JobResult, 1)
+	job := utils.Job{
+		Ctx:   ctx,
+		Type:  utils.StatsJob,
+		Stats: query,
+		Done:  resultChannel,
+	}
+	if retryAfter := h.queryBreaker.RetryAfter(); retryAfter > 0 {
+		respondUnavailable(w, retryAfter)
+		return
+	}
+	if err := h.wp.AddJob(job); err != nil {
+		respondSubmitError(w, ctx, err)
+		return
+	}
+
+	select {
+	case result := <-resultChannel:
+		setServerTiming(w, result)
+		if result.Err != nil {
+			h.respondJobError(w, ctx, result, "computing log stats")
+			return
+		}
+		buckets := result.Buckets
+		if buckets == nil {
+			buckets = []utils.StatsBucket{}
+		}
+		utils.RespondWithJSON(w, http.StatusOK, utils.LogStats{Interval: query.Interval.String(), Buckets: buckets})
+	case <-ctx.Done():
+		respondQueryDone(w, ctx, "Timeout while computing log stats")
+	}
+}
+
+// respondQueryError rejects invalid query parameters, pointing at the problem in a q expression
+func respondQueryError(w http.ResponseWriter, err error) {
+	var parseErr *utils.QueryParseError
+	if errors.As(err, &parseErr) {
+		utils.RespondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message":  err.Error(),
+			"position": parseErr.Position,
+		})
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
 // Stores a batch of log messages
 func (h *Handlers) HandleBatchLog(w http.ResponseWriter, r *http.Request) {
 	// Validate the request method and decode the JSON request body
@@ -98,6 +290,15 @@ func (h *Handlers) HandleBatchLog(w http.ResponseWriter, r *http.Request) {
 	if err := utils.ValidateRequest(w, r, http.MethodPost); err != nil {
 		return
 	}
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = body
+	defer func() { metrics.IngestedBytes.Add(float64(body.n), "http") }()
+
+	// Newline-delimited JSON is streamed instead of decoded in one go
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == utils.NDJSONContentType {
+		h.handleNDJSONBatch(w, r)
+		return
+	}
 
 	var logBatch []utils.LogMessage
 	// Check if valid JSON is passed in the format we need
@@ -106,21 +307,103 @@ func (h *Handlers) HandleBatchLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if status, err := h.submitBatch(logBatch); err != nil {
+		h.setBatchRetryAfter(w, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// Respond with a success message
+	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Log batch accepted"})
+}
+
+// handleNDJSONBatch decodes the body line by line, submitting the logs in bounded chunks
+func (h *Handlers) handleNDJSONBatch(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	accepted, rejected, lineErrors, err := utils.DecodeNDJSON(r.Body, ndjsonChunkSize, func(chunk []utils.LogMessage) error {
+		var submitErr error
+		status, submitErr = h.submitBatch(chunk)
+		return submitErr
+	})
+	if err != nil {
+		if status == http.StatusOK {
+			status = http.StatusBadRequest // The body could not be read
+		}
+		h.setBatchRetryAfter(w, err)
+		utils.RespondWithJSON(w, status, map[string]interface{}{"status": "error", "message": err.Error(), "accepted": accepted})
+		return
+	}
+
+	response := map[string]interface{}{"status": "success", "accepted": accepted, "rejected": rejected}
+	if rejected > 0 {
+		response["status"] = "partial"
+		if accepted == 0 {
+			response["status"] = "error"
+			status = http.StatusBadRequest
+		}
+		response["errors"] = lineErrors
+	}
+	utils.RespondWithJSON(w, status, response)
+}
+
+// setBatchRetryAfter tells the client when to retry a batch turned away by the insert breaker or for lack of room
+func (h *Handlers) setBatchRetryAfter(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, internal.ErrCircuitOpen):
+		setRetryAfter(w, h.insertBreaker.RetryAfter())
+	case internal.IsOverloaded(err):
+		setRetryAfter(w, overloadedRetryAfter)
+	}
+}
+
+// submitBatch logs the batch to the WAL and queues it for storage, returning the HTTP status to respond with on failure.
+// Batches are turned away with ErrCircuitOpen while storing keeps failing, and with 429 while the worker pool
+// has no room for them.
+func (h *Handlers) submitBatch(logBatch []utils.LogMessage) (int, error) {
+	if h.insertBreaker.RetryAfter() > 0 {
+		return http.StatusServiceUnavailable, fmt.Errorf("Service unavailable: %w", internal.ErrCircuitOpen)
+	}
+
+	// Persist the batch before accepting it so it survives a crash
+	seq, err := h.wal.Append(logBatch)
+	if err != nil {
+		fmt.Println(err)
+		return http.StatusInternalServerError, fmt.Errorf("Internal server error")
+	}
+
 	// Create a job for storing logs
 	storeJob := utils.Job{
 		Type:   utils.StoreJob,
 		Logs:   logBatch,
-		Result: nil,
+		WALSeq: seq,
 	}
 
-	if err := h.circuitBreaker.Call(func() error {
-		h.wp.AddJob(storeJob)
-		return nil
-	}); err != nil {
-		http.Error(w, "Service unavailable: "+err.Error(), http.StatusServiceUnavailable)
-		return
+	if err := h.wp.AddJob(storeJob); err != nil {
+		if internal.IsOverloaded(err) {
+			// The client retries the batch, so it mustn't be replayed from the WAL as well
+			if ackErr := h.wal.Ack(seq); ackErr != nil {
+				fmt.Printf("Failed to drop rejected WAL batch %d: %v\n", seq, ackErr)
+			}
+			return http.StatusTooManyRequests, fmt.Errorf("Too many requests: %w", err)
+		}
+		return http.StatusServiceUnavailable, fmt.Errorf("Service unavailable: %v", err)
 	}
 
-	// Respond with a success message
-	utils.RespondWithJSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Log batch accepted"})
+	metrics.BatchSize.Observe(float64(len(logBatch)))
+	for _, log := range logBatch {
+		metrics.IngestedLogs.Inc(metrics.LevelLabel(log.Level))
+	}
+	return http.StatusOK, nil
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
 }
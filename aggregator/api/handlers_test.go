@@ -0,0 +1,401 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log-aggregator/aggregator/api"
+	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/metrics"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestHandlers creates handlers backed by an in-memory store
+func newTestHandlers(t *testing.T) (*api.Handlers, *storage.MemoryStorage) {
+	handlers, store, _ := newTestHandlersWithHub(t)
+	return handlers, store
+}
+
+// newTestHandlersWithHub creates handlers backed by an in-memory store, also returning their tail hub
+func newTestHandlersWithHub(t *testing.T) (*api.Handlers, *storage.MemoryStorage, *internal.TailHub) {
+	store := storage.NewMemoryStorage()
+	hub := internal.NewTailHub()
+	wp := internal.NewWorkerPool(1, nil, store, nil, hub)
+	t.Cleanup(wp.Stop)
+	return api.NewHandlers(wp, internal.NewNamedCircuitBreaker(internal.BreakerInsert, 3, 10*time.Second), internal.NewNamedCircuitBreaker(internal.BreakerQuery, 3, 10*time.Second), nil, hub, nil, nil), store, hub
+}
+
+// waitForLogs polls the store until it holds n logs or a second passes
+func waitForLogs(store storage.LogStore, n int) []utils.LogMessage {
+	deadline := time.Now().Add(time.Second)
+	for {
+		logs, _ := store.GetLogMessages(context.Background(), utils.LogQuery{})
+		if len(logs) >= n || time.Now().After(deadline) {
+			return logs
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestHandleBatchLog_NDJSON tests that NDJSON bodies are stored line by line with per-line errors.
+func TestHandleBatchLog_NDJSON(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+
+	body := strings.Join([]string{
+		`{"timestamp":"2024-10-08T00:00:00Z","level":"ERROR","message":"Database connection failed."}`,
+		`{"timestamp":"not a time","level":"INFO","message":"broken"}`,
+		``,
+		`{"timestamp":"2024-10-08T02:00:00Z","level":"WARNING","message":"High memory usage detected."}`,
+	}, "\n")
+	req := httptest.NewRequest(http.MethodPost, "/logs/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+
+	handlers.HandleBatchLog(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var response struct {
+		Status   string            `json:"status"`
+		Accepted int               `json:"accepted"`
+		Rejected int               `json:"rejected"`
+		Errors   []utils.LineError `json:"errors"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response.Status != "partial" || response.Accepted != 2 || response.Rejected != 1 {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+	if len(response.Errors) != 1 || response.Errors[0].Line != 2 {
+		t.Errorf("Expected an error on line 2, got %+v", response.Errors)
+	}
+
+	if logs := waitForLogs(store, 2); len(logs) != 2 {
+		t.Errorf("Expected 2 stored logs, got %d", len(logs))
+	}
+}
+
+// TestHandleBatchLog_NDJSONAllInvalid tests that a body without any valid line is rejected, reporting a bounded number of line errors.
+func TestHandleBatchLog_NDJSONAllInvalid(t *testing.T) {
+	handlers, _ := newTestHandlers(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/logs/batch", strings.NewReader(strings.Repeat("nope\n[1,2]\n", 500)))
+	req.Header.Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	rec := httptest.NewRecorder()
+
+	handlers.HandleBatchLog(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request, got %d", rec.Code)
+	}
+	// Every line is counted but only the first are reported
+	var response struct {
+		Rejected int               `json:"rejected"`
+		Errors   []utils.LineError `json:"errors"`
+	}
+	json.NewDecoder(rec.Body).Decode(&response)
+	if response.Rejected != 1000 || len(response.Errors) != utils.MaxReportedLineErrors {
+		t.Errorf("Expected 1000 rejected lines with %d reported, got %d with %d reported", utils.MaxReportedLineErrors, response.Rejected, len(response.Errors))
+	}
+}
+
+// TestHandleBatchLog_BreakerOpen tests that batches are turned away with Retry-After while the insert breaker is open,
+// without affecting queries.
+func TestHandleBatchLog_BreakerOpen(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	wp := internal.NewWorkerPool(1, nil, store, nil, nil)
+	t.Cleanup(wp.Stop)
+	insertBreaker := internal.NewNamedCircuitBreaker(internal.BreakerInsert, 1, time.Minute)
+	queryBreaker := internal.NewNamedCircuitBreaker(internal.BreakerQuery, 1, time.Minute)
+	handlers := api.NewHandlers(wp, insertBreaker, queryBreaker, nil, nil, nil, nil)
+	insertBreaker.Call(func() error { return errors.New("storage down") })
+
+	body := `[{"timestamp":"2024-10-08T00:00:00Z","level":"ERROR","message":"Database connection failed."}]`
+	rec := httptest.NewRecorder()
+	handlers.HandleBatchLog(rec, httptest.NewRequest(http.MethodPost, "/logs/batch", strings.NewReader(body)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status Service Unavailable, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+
+	rec = httptest.NewRecorder()
+	handlers.HandleLogRetrieval(rec, httptest.NewRequest(http.MethodGet, "/logs/retrieve", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected queries to go through, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// TestHandleBatchLog_Overloaded tests that batches are turned away with 429 and Retry-After once the queue stays full.
+func TestHandleBatchLog_Overloaded(t *testing.T) {
+	// Without workers nothing leaves the queue
+	wp := internal.NewWorkerPool(0, map[utils.JobType]internal.QueueConfig{utils.StoreJob: {Capacity: 1}}, storage.NewMemoryStorage(), nil, nil)
+	t.Cleanup(wp.Stop)
+	wp.SetSubmitLimits(10*time.Millisecond, 0)
+	handlers := api.NewHandlers(wp, internal.NewNamedCircuitBreaker(internal.BreakerInsert, 3, 10*time.Second), internal.NewNamedCircuitBreaker(internal.BreakerQuery, 3, 10*time.Second), nil, nil, nil, nil)
+
+	body := `[{"timestamp":"2024-10-08T00:00:00Z","level":"ERROR","message":"Database connection failed."}]`
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		handlers.HandleBatchLog(rec, httptest.NewRequest(http.MethodPost, "/logs/batch", strings.NewReader(body)))
+		if rec.Code != want {
+			t.Fatalf("Expected status %d for batch %d, got %d: %s", want, i+1, rec.Code, rec.Body.String())
+		}
+		if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("Expected to be told to retry in a second, got %q", rec.Header().Get("Retry-After"))
+		}
+	}
+}
+
+// TestHandleLogRetrieval_FieldFilter tests retrieving logs filtered on service and structured fields.
+func TestHandleLogRetrieval_FieldFilter(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: time.Now(), Level: "ERROR", Message: "charge failed", Service: "billing", Fields: map[string]interface{}{"env": "prod"}},
+		{Timestamp: time.Now(), Level: "ERROR", Message: "charge failed", Service: "billing", Fields: map[string]interface{}{"env": "staging"}},
+	})
+
+	rec := httptest.NewRecorder()
+	handlers.HandleLogRetrieval(rec, httptest.NewRequest(http.MethodGet, "/logs/retrieve?service=billing&field.env=prod", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var page utils.LogPage
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(page.Logs) != 1 || page.Logs[0].Fields["env"] != "prod" {
+		t.Errorf("Expected only the prod log, got %v", page.Logs)
+	}
+
+	rec = httptest.NewRecorder()
+	handlers.HandleLogRetrieval(rec, httptest.NewRequest(http.MethodGet, "/logs/retrieve?field.$where=1", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request for an invalid field name, got %d", rec.Code)
+	}
+}
+
+// brokenStore fails every query as if the database were down
+type brokenStore struct {
+	storage.LogStore
+}
+
+func (s brokenStore) GetLogMessages(ctx context.Context, query utils.LogQuery) ([]utils.LogMessage, error) {
+	return nil, errors.New("server selection timeout")
+}
+
+// TestHandleLogRetrieval_Errors tests that no matches respond 404 while storage failures respond 503.
+func TestHandleLogRetrieval_Errors(t *testing.T) {
+	handlers, _ := newTestHandlers(t)
+	rec := httptest.NewRecorder()
+	handlers.HandleLogRetrieval(rec, httptest.NewRequest(http.MethodGet, "/logs/retrieve?service=billing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status Not Found without matches, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	wp := internal.NewWorkerPool(1, nil, brokenStore{storage.NewMemoryStorage()}, nil, nil)
+	t.Cleanup(wp.Stop)
+	handlers = api.NewHandlers(wp, internal.NewNamedCircuitBreaker(internal.BreakerInsert, 3, 10*time.Second), internal.NewNamedCircuitBreaker(internal.BreakerQuery, 3, 10*time.Second), nil, internal.NewTailHub(), nil, nil)
+	rec = httptest.NewRecorder()
+	handlers.HandleLogRetrieval(rec, httptest.NewRequest(http.MethodGet, "/logs/retrieve?service=billing", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "server selection timeout") {
+		t.Errorf("Expected status Service Unavailable with the storage error, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Server-Timing") == "" {
+		t.Error("Expected a Server-Timing header")
+	}
+}
+
+// TestHandleLogRetrieval_Pagination tests walking through all logs with limit, order and cursor.
+func TestHandleLogRetrieval_Pagination(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	base := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+	var batch []utils.LogMessage
+	for i := 0; i < 5; i++ {
+		batch = append(batch, utils.LogMessage{Timestamp: base.Add(time.Duration(i) * time.Minute), Level: "INFO", Message: fmt.Sprint(i)})
+	}
+	store.InsertLogMessages(context.Background(), batch)
+
+	var messages []string
+	url := "/logs/retrieve?limit=2&order=desc"
+	for pages := 0; pages < 5; pages++ {
+		rec := httptest.NewRecorder()
+		handlers.HandleLogRetrieval(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var page utils.LogPage
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		for _, log := range page.Logs {
+			messages = append(messages, log.Message)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		url = "/logs/retrieve?limit=2&order=desc&cursor=" + page.NextCursor
+	}
+
+	if strings.Join(messages, ",") != "4,3,2,1,0" {
+		t.Errorf("Expected logs 4 to 0 in three pages, got %v", messages)
+	}
+
+	rec := httptest.NewRecorder()
+	handlers.HandleLogRetrieval(rec, httptest.NewRequest(http.MethodGet, "/logs/retrieve?cursor=garbage", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request for an invalid cursor, got %d", rec.Code)
+	}
+}
+
+// TestHandleLogRetrieval_Query tests filtering with the query language and reporting parse errors.
+func TestHandleLogRetrieval_Query(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: time.Now(), Level: "ERROR", Message: "upstream timeout", Service: "billing", Source: "prod-1"},
+		{Timestamp: time.Now(), Level: "WARN", Message: "slow timeout", Service: "billing", Source: "canary-1"},
+		{Timestamp: time.Now(), Level: "INFO", Message: "timeout resolved", Service: "billing", Source: "prod-2"},
+		{Timestamp: time.Now(), Level: "ERROR", Message: "disk full", Service: "billing", Source: "prod-3"},
+	})
+
+	q := url.QueryEscape(`level:(ERROR OR WARN) AND service:billing AND message:"timeout" AND NOT host:canary-*`)
+	rec := httptest.NewRecorder()
+	handlers.HandleLogRetrieval(rec, httptest.NewRequest(http.MethodGet, "/logs/retrieve?q="+q, nil))
+
+	var page utils.LogPage
+	json.NewDecoder(rec.Body).Decode(&page)
+	if len(page.Logs) != 1 || page.Logs[0].Source != "prod-1" {
+		t.Errorf("Expected only the log from prod-1, got %v", page.Logs)
+	}
+
+	rec = httptest.NewRecorder()
+	handlers.HandleLogRetrieval(rec, httptest.NewRequest(http.MethodGet, "/logs/retrieve?q="+url.QueryEscape("level:(ERROR OR"), nil))
+	var parseErr struct {
+		Position int `json:"position"`
+	}
+	json.NewDecoder(rec.Body).Decode(&parseErr)
+	if rec.Code != http.StatusBadRequest || parseErr.Position != 16 {
+		t.Errorf("Expected a 400 pointing at position 16, got %d with position %d", rec.Code, parseErr.Position)
+	}
+}
+
+// TestHandleLogRetrieval_Relevance tests ranked text search paging by offset and rejecting invalid regexes.
+func TestHandleLogRetrieval_Relevance(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: time.Now(), Level: "ERROR", Message: "timeout calling payments"},
+		{Timestamp: time.Now(), Level: "ERROR", Message: "timeout, timeout"},
+		{Timestamp: time.Now(), Level: "INFO", Message: "all good"},
+	})
+
+	var messages []string
+	target := "/logs/retrieve?text=timeout&order=relevance&limit=1"
+	for pages := 0; pages < 3; pages++ {
+		rec := httptest.NewRecorder()
+		handlers.HandleLogRetrieval(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var page utils.LogPage
+		json.NewDecoder(rec.Body).Decode(&page)
+		for _, log := range page.Logs {
+			messages = append(messages, log.Message)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		target = "/logs/retrieve?text=timeout&order=relevance&limit=1&cursor=" + page.NextCursor
+	}
+	if strings.Join(messages, "|") != "timeout, timeout|timeout calling payments" {
+		t.Errorf("Expected both timeout logs ranked by relevance, got %v", messages)
+	}
+
+	for _, query := range []string{"regex=" + url.QueryEscape("("), "order=relevance"} {
+		rec := httptest.NewRecorder()
+		handlers.HandleLogRetrieval(rec, httptest.NewRequest(http.MethodGet, "/logs/retrieve?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request for %s, got %d", query, rec.Code)
+		}
+	}
+}
+
+// TestHandleLogStats tests counting logs per bucket through the worker pool and rejecting invalid parameters.
+func TestHandleLogStats(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	base := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: base, Level: "ERROR", Message: "a", Service: "billing"},
+		{Timestamp: base.Add(time.Minute), Level: "WARN", Message: "b", Service: "billing"},
+		{Timestamp: base.Add(6 * time.Minute), Level: "ERROR", Message: "c", Service: "billing"},
+		{Timestamp: base, Level: "ERROR", Message: "d", Service: "auth"},
+	})
+
+	rec := httptest.NewRecorder()
+	handlers.HandleLogStats(rec, httptest.NewRequest(http.MethodGet, "/logs/stats?service=billing&interval=5m&groupBy=level", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var stats utils.LogStats
+	json.NewDecoder(rec.Body).Decode(&stats)
+	if stats.Interval != "5m0s" || len(stats.Buckets) != 3 {
+		t.Fatalf("Expected 3 five-minute buckets, got %+v", stats)
+	}
+	if stats.Buckets[2].Group["level"] != "ERROR" || !stats.Buckets[2].Time.Equal(base.Add(5*time.Minute)) {
+		t.Errorf("Expected the last bucket to hold the ERROR at 00:05, got %+v", stats.Buckets[2])
+	}
+
+	for _, query := range []string{"interval=10ms", "interval=soon", "groupBy=message", "groupBy=bad%20name"} {
+		rec := httptest.NewRecorder()
+		handlers.HandleLogStats(rec, httptest.NewRequest(http.MethodGet, "/logs/stats?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request for %s, got %d", query, rec.Code)
+		}
+	}
+}
+
+// TestHandleMetrics tests that ingested logs and worker pool gauges show up on /metrics.
+func TestHandleMetrics(t *testing.T) {
+	handlers, store := newTestHandlers(t)
+	before, beforeOther := metrics.IngestedLogs.Value("FATAL"), metrics.IngestedLogs.Value("other")
+
+	body := `[{"timestamp":"2024-10-08T00:00:00Z","level":"fatal","message":"out of memory"},{"timestamp":"2024-10-08T00:00:01Z","level":"made-up-1234","message":"odd level"}]`
+	handlers.HandleBatchLog(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/logs/batch", strings.NewReader(body)))
+	waitForLogs(store, 2)
+	// The job is only timed once the worker is done with it
+	for deadline := time.Now().Add(time.Second); metrics.JobDuration.Count("store") == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := metrics.IngestedLogs.Value("FATAL") - before; got != 1 {
+		t.Errorf("Expected 1 more FATAL log to be counted, got %v", got)
+	}
+	if got := metrics.IngestedLogs.Value("other") - beforeOther; got != 1 || metrics.IngestedLogs.Value("made-up-1234") != 0 {
+		t.Errorf("Expected the unknown level to be counted as other, got %v", got)
+	}
+
+	rec := httptest.NewRecorder()
+	handlers.HandleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`log_aggregator_ingested_logs_total{level="FATAL"}`,
+		`log_aggregator_ingested_bytes_total{transport="http"}`,
+		`log_aggregator_job_duration_seconds_count{type="store"}`,
+		`log_aggregator_storage_duration_seconds_count{operation="insert"}`,
+		"log_aggregator_active_workers 1",
+		`log_aggregator_queue_depth{type="fetch"} 0`,
+		`log_aggregator_circuit_breaker_state{breaker="insert"} 0`,
+		`log_aggregator_circuit_breaker_state{breaker="query"} 0`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("Expected %s in the metrics, got:\n%s", want, rec.Body.String())
+		}
+	}
+}
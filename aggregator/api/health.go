@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/utils"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// storagePingTimeout bounds how long readiness waits for the storage to answer
+	storagePingTimeout = 2 * time.Second
+	// queueDegradedRatio and queueFailedRatio are the saturations of the fullest queue at which the pool is degraded, then not ready
+	queueDegradedRatio = 0.5
+	queueFailedRatio   = 0.9
+	// walBacklogLimit is the number of unstored batches beyond which the WAL is degraded
+	walBacklogLimit = 1000
+)
+
+// Statuses of a health check, a single failed check fails the whole report
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthFailed   = "fail"
+)
+
+// healthCheck is the result of checking a single component
+type healthCheck struct {
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// healthReport is the response of /livez and /readyz
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// HandleLiveness reports whether the process is working at all, restarting it is the only fix when it isn't
+func (h *Handlers) HandleLiveness(w http.ResponseWriter, r *http.Request) {
+	if err := utils.ValidateRequest(w, r, http.MethodGet); err != nil {
+		return
+	}
+	respondHealth(w, map[string]healthCheck{"workers": h.checkWorkers()})
+}
+
+// HandleReadiness reports whether the aggregator can take traffic, checking storage, the worker pool,
+// the circuit breaker and the WAL
+func (h *Handlers) HandleReadiness(w http.ResponseWriter, r *http.Request) {
+	if err := utils.ValidateRequest(w, r, http.MethodGet); err != nil {
+		return
+	}
+	respondHealth(w, map[string]healthCheck{
+		"storage":         h.checkStorage(r.Context()),
+		"worker_pool":     h.checkWorkerPool(),
+		"circuit_breaker": h.checkCircuitBreaker(),
+		"wal":             h.checkWAL(),
+	})
+}
+
+// respondHealth responds 503 when a check failed, the report is the worst status of the checks
+func respondHealth(w http.ResponseWriter, checks map[string]healthCheck) {
+	report := healthReport{Status: healthOK, Checks: checks}
+	for _, check := range checks {
+		if check.Status == healthFailed {
+			report.Status = healthFailed
+		} else if check.Status == healthDegraded && report.Status == healthOK {
+			report.Status = healthDegraded
+		}
+	}
+
+	status := http.StatusOK
+	if report.Status == healthFailed {
+		status = http.StatusServiceUnavailable
+	}
+	utils.RespondWithJSON(w, status, report)
+}
+
+func (h *Handlers) checkWorkers() healthCheck {
+	active := h.wp.ActiveWorkers()
+	if active == 0 {
+		return healthCheck{Status: healthFailed, Message: "no active workers"}
+	}
+	return healthCheck{Status: healthOK, Message: fmt.Sprintf("%d active workers", active)}
+}
+
+func (h *Handlers) checkStorage(ctx context.Context) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, storagePingTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := h.wp.Ping(ctx)
+	check := healthCheck{Status: healthOK, Duration: time.Since(start).String()}
+	if err != nil {
+		check.Status, check.Message = healthFailed, err.Error()
+	}
+	return check
+}
+
+func (h *Handlers) checkWorkerPool() healthCheck {
+	if check := h.checkWorkers(); check.Status != healthOK {
+		return check
+	}
+
+	// Judge the queues relative to their capacity, a full queue blocks its job type
+	var queues []string
+	for _, q := range h.wp.Queues() {
+		queues = append(queues, fmt.Sprintf("%s %d/%d", q.Type, q.Queued, q.Capacity))
+	}
+	check := healthCheck{Status: healthOK, Message: fmt.Sprintf("%s queued, %d active workers", strings.Join(queues, ", "), h.wp.ActiveWorkers())}
+	saturation := h.wp.Saturation()
+	if saturation >= queueFailedRatio {
+		check.Status = healthFailed
+	} else if saturation >= queueDegradedRatio {
+		check.Status = healthDegraded
+	}
+	return check
+}
+
+func (h *Handlers) checkCircuitBreaker() healthCheck {
+	// The check is as bad as the worst of the insert and query breakers
+	check := healthCheck{Status: healthOK}
+	var states []string
+	for _, cb := range []*internal.CircuitBreaker{h.insertBreaker, h.queryBreaker} {
+		counts := cb.Counts()
+		switch counts.State {
+		case internal.StateClosed:
+			states = append(states, fmt.Sprintf("%s closed (%d of %d calls failed)", cb.Name(), counts.Failures, counts.Calls))
+		default:
+			states = append(states, fmt.Sprintf("%s %s", cb.Name(), counts.State))
+		}
+		if counts.State == internal.StateOpen {
+			check.Status = healthFailed
+		} else if counts.State == internal.StateHalfOpen && check.Status == healthOK {
+			check.Status = healthDegraded
+		}
+	}
+	check.Message = "circuit breakers are " + strings.Join(states, ", ")
+	return check
+}
+
+func (h *Handlers) checkWAL() healthCheck {
+	if h.wal == nil {
+		return healthCheck{Status: healthOK, Message: "disabled"}
+	}
+	// Batches stay pending while storage can't keep up or keeps failing
+	batches, size := h.wal.Backlog()
+	check := healthCheck{Status: healthOK, Message: fmt.Sprintf("%d unstored batches, %d bytes", batches, size)}
+	if batches > walBacklogLimit {
+		check.Status = healthDegraded
+	}
+	return check
+}
@@ -0,0 +1,73 @@
+package api_test
+
+import (
+	"encoding/json"
+	"errors"
+	"log-aggregator/aggregator/api"
+	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/storage"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type healthResponse struct {
+	Status string `json:"status"`
+	Checks map[string]struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	} `json:"checks"`
+}
+
+// getHealth calls the handler and decodes its report
+func getHealth(t *testing.T, handler http.HandlerFunc, path string) (int, healthResponse) {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+	var response healthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return rec.Code, response
+}
+
+// TestHandleReadiness tests that readiness reports every component and fails while the circuit breaker is open.
+func TestHandleReadiness(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	wp := internal.NewWorkerPool(1, nil, store, nil, nil)
+	t.Cleanup(wp.Stop)
+	insertBreaker := internal.NewNamedCircuitBreaker(internal.BreakerInsert, 1, time.Minute)
+	queryBreaker := internal.NewNamedCircuitBreaker(internal.BreakerQuery, 1, time.Minute)
+	handlers := api.NewHandlers(wp, insertBreaker, queryBreaker, nil, nil, nil, nil)
+
+	code, response := getHealth(t, handlers.HandleReadiness, "/readyz")
+	if code != http.StatusOK || response.Status != "ok" {
+		t.Fatalf("Expected a ready aggregator, got %d: %+v", code, response)
+	}
+	for _, name := range []string{"storage", "worker_pool", "circuit_breaker", "wal"} {
+		if response.Checks[name].Status != "ok" {
+			t.Errorf("Expected check %s to be ok, got %+v", name, response.Checks[name])
+		}
+	}
+
+	// A single open breaker is enough to fail readiness
+	queryBreaker.Call(func() error { return errors.New("storage down") })
+	code, response = getHealth(t, handlers.HandleReadiness, "/readyz")
+	if code != http.StatusServiceUnavailable || response.Status != "fail" {
+		t.Errorf("Expected an unready aggregator, got %d: %+v", code, response)
+	}
+	if response.Checks["circuit_breaker"].Status != "fail" {
+		t.Errorf("Expected the circuit breaker check to fail, got %+v", response.Checks["circuit_breaker"])
+	}
+	if message := response.Checks["circuit_breaker"].Message; !strings.Contains(message, "insert closed") || !strings.Contains(message, "query open") {
+		t.Errorf("Expected the state of both breakers, got %q", message)
+	}
+
+	// Liveness doesn't depend on the breaker
+	code, response = getHealth(t, handlers.HandleLiveness, "/livez")
+	if code != http.StatusOK || response.Status != "ok" {
+		t.Errorf("Expected a live aggregator, got %d: %+v", code, response)
+	}
+}
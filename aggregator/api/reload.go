@@ -0,0 +1,105 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// reloadable lists the settings, by their YAML name, Reload applies without a restart
+var reloadable = map[string]bool{
+	"workers":            true,
+	"autoscale":          true,
+	"submit_timeout":     true,
+	"memory_budget":      true,
+	"breaker_threshold":  true,
+	"breaker_timeout":    true,
+	"breaker":            true,
+	"retention":          true,
+	"retention_interval": true,
+	"shutdown_timeout":   true,
+}
+
+// Reload applies the settings of cfg that can change while running, logging what changed, and ignores
+// the others which need a restart. cfg is expected to be valid, the settings left empty take their defaults.
+func (s *Server) Reload(cfg Config) {
+	cfg = cfg.withDefaults()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := changedSettings(s.Config, cfg)
+	if len(changed) == 0 {
+		fmt.Println("Configuration reloaded, nothing changed")
+		return
+	}
+
+	var restart []string
+	for _, name := range changed {
+		if !reloadable[name] {
+			restart = append(restart, name)
+		}
+	}
+	// Retention is enforced by a janitor which is only started when retention is enabled
+	retentionChanged := !reflect.DeepEqual(s.Retention, cfg.Retention) || s.RetentionInterval != cfg.RetentionInterval
+	if retentionChanged && s.janitor == nil {
+		fmt.Println("Retention was off at startup and can't be turned on by a reload, restart to enforce it")
+		cfg.Retention, cfg.RetentionInterval = s.Retention, s.RetentionInterval
+		retentionChanged = false
+	}
+	// Likewise the autoscaler only runs when enabled at startup
+	if cfg.Autoscale != s.Autoscale && s.autoscaler == nil {
+		restart = append(restart, "autoscale")
+		cfg.Autoscale = s.Autoscale
+	}
+	if len(restart) > 0 {
+		fmt.Printf("Configuration changes to %s need a restart and were ignored\n", strings.Join(restart, ", "))
+	}
+
+	if cfg.Workers != s.Workers {
+		fmt.Printf("Configuration reloaded: workers %d -> %d\n", s.Workers, cfg.Workers)
+		s.Wp.Resize(cfg.Workers)
+		s.Workers = cfg.Workers
+	}
+	if cfg.Autoscale != s.Autoscale {
+		fmt.Printf("Configuration reloaded: autoscale %+v -> %+v\n", s.Autoscale, cfg.Autoscale)
+		s.autoscaler.SetPolicy(cfg.Autoscale)
+		s.Autoscale = cfg.Autoscale
+	}
+	if cfg.SubmitTimeout != s.SubmitTimeout || cfg.MemoryBudget != s.MemoryBudget {
+		fmt.Printf("Configuration reloaded: submit timeout %v -> %v, memory budget %d -> %d bytes\n",
+			s.SubmitTimeout, cfg.SubmitTimeout, s.MemoryBudget, cfg.MemoryBudget)
+		s.Wp.SetSubmitLimits(cfg.SubmitTimeout, cfg.MemoryBudget)
+		s.SubmitTimeout, s.MemoryBudget = cfg.SubmitTimeout, cfg.MemoryBudget
+	}
+	if cfg.breakerPolicy() != s.breakerPolicy() {
+		fmt.Printf("Configuration reloaded: circuit breaker threshold %d -> %d, timeout %v -> %v, policy %+v -> %+v\n",
+			s.BreakerThreshold, cfg.BreakerThreshold, s.BreakerTimeout, cfg.BreakerTimeout, s.Breaker, cfg.Breaker)
+		s.insertBreaker.Configure(cfg.breakerPolicy())
+		s.queryBreaker.Configure(cfg.breakerPolicy())
+		s.BreakerThreshold, s.BreakerTimeout, s.Breaker = cfg.BreakerThreshold, cfg.BreakerTimeout, cfg.Breaker
+	}
+	if cfg.ShutdownTimeout != s.ShutdownTimeout {
+		fmt.Printf("Configuration reloaded: shutdown timeout %v -> %v\n", s.ShutdownTimeout, cfg.ShutdownTimeout)
+		s.ShutdownTimeout = cfg.ShutdownTimeout
+	}
+	if retentionChanged {
+		fmt.Printf("Configuration reloaded: retention %+v every %v -> %+v every %v\n",
+			s.Retention, s.RetentionInterval, cfg.Retention, cfg.RetentionInterval)
+		s.janitor.SetPolicy(cfg.Retention, cfg.RetentionInterval)
+		setRetentionTTL(s.store, cfg.Retention, s.archiver != nil)
+		s.Retention, s.RetentionInterval = cfg.Retention, cfg.RetentionInterval
+	}
+}
+
+// changedSettings returns the YAML names of the settings that differ between old and new
+func changedSettings(old, new Config) []string {
+	var changed []string
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < oldValue.NumField(); i++ {
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			name, _, _ := strings.Cut(oldValue.Type().Field(i).Tag.Get("yaml"), ",")
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
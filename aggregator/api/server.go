@@ -1,66 +1,369 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log-aggregator/aggregator/archive"
 	"log-aggregator/aggregator/internal"
 	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/syslog"
+	"log-aggregator/aggregator/utils"
 	"net/http"
+	"sync"
+	"time"
 )
 
-const defaultListenAddr = ":8005"
+// Defaults of the settings left empty in the Config
+const (
+	defaultListenAddr          = ":8005"
+	defaultWorkers             = 5
+	defaultQueueSize           = 100
+	defaultSubmitTimeout       = time.Second
+	defaultBreakerThreshold    = 3
+	defaultBreakerTimeout      = 10 * time.Second
+	defaultDatabase            = "logdb"
+	defaultCollection          = "logs"
+	defaultShutdownTimeout     = 30 * time.Second
+	defaultQueryTimeout        = 10 * time.Second
+	defaultAutoscaleInterval   = 5 * time.Second
+	defaultAutoscaleTargetWait = 100 * time.Millisecond
+	// defaultRetentionInterval is how often the janitor purges when RetentionInterval is not set
+	defaultRetentionInterval = time.Minute
+)
+
+// httpShutdownShare is the share of the shutdown deadline in-flight requests get to finish, the job queue is
+// drained in the rest
+const httpShutdownShare = 0.5
+
+// QueryRoutes lists the routes whose deadline can be set in Config.RouteTimeouts
+var QueryRoutes = []string{"/logs/retrieve", "/logs/stats"}
 
 // Config holds the configuration for the server.
 type Config struct {
-	ListenAddr string
-	DSN        string
+	ListenAddr string `yaml:"listen_addr"`
+	DSN        string `yaml:"dsn"`
+	Database   string `yaml:"database"`   // MongoDB database holding the logs
+	Collection string `yaml:"collection"` // MongoDB collection holding the logs
+	Backend    string `yaml:"backend"`    // storage backend, "mongo" (default), "memory" or "disk"
+	DataDir    string `yaml:"data_dir"`   // directory holding the segment files of the disk backend
+	WALDir     string `yaml:"wal_dir"`    // directory of the write-ahead log for accepted batches, disabled when empty
+
+	Workers   int                             `yaml:"workers"`    // number of workers storing and fetching logs, the initial number when autoscaling
+	QueueSize int                             `yaml:"queue_size"` // number of jobs of each type queued before submitting waits, unless set in Queues
+	Queues    map[string]internal.QueueConfig `yaml:"queues"`     // capacity and scheduling weight of the queue of a job type, "fetch", "store" or "stats"
+	Autoscale internal.AutoscalePolicy        `yaml:"autoscale"`  // bounds the number of workers is scaled within, disabled when empty
+
+	SubmitTimeout time.Duration `yaml:"submit_timeout"` // how long a job waits for room in a full queue before it is turned away with 429
+	MemoryBudget  int64         `yaml:"memory_budget"`  // bytes of logs queued for storage before batches are turned away with 429, unlimited when 0
+
+	BreakerThreshold int                    `yaml:"breaker_threshold"` // calls in the window of a circuit breaker before it can open, consecutive failures by default
+	BreakerTimeout   time.Duration          `yaml:"breaker_timeout"`   // how long the circuit breaker stays open
+	Breaker          internal.BreakerPolicy `yaml:"breaker"`           // window, failure and slow call rates and half-open probes of the circuit breakers
+
+	SyslogUDPAddr string `yaml:"syslog_udp_addr"` // address of the syslog UDP listener, disabled when empty
+	SyslogTCPAddr string `yaml:"syslog_tcp_addr"` // address of the syslog TCP listener, disabled when empty
+
+	Retention         storage.RetentionPolicy `yaml:"retention"`          // how long logs are kept, forever when empty
+	RetentionInterval time.Duration           `yaml:"retention_interval"` // how often the retention policy is enforced
+
+	ArchiveDir         string `yaml:"archive_dir"`         // directory expired logs are archived to before deletion, disabled when empty
+	ArchiveCompression string `yaml:"archive_compression"` // compression of the archives, "gzip" (default) or "zstd"
+
+	QueryTimeout  time.Duration            `yaml:"query_timeout"`  // how long a query may take before it is abandoned
+	RouteTimeouts map[string]time.Duration `yaml:"route_timeouts"` // overrides QueryTimeout per route, one of QueryRoutes
+
+	TailOrigins []string `yaml:"tail_origins"` // origins allowed to open WebSocket tails besides the aggregator's own host, "*" for any
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // how long Stop waits for requests and queued jobs to finish
+}
+
+// withDefaults fills the settings left empty with their defaults
+func (cfg Config) withDefaults() Config {
+	if len(cfg.ListenAddr) == 0 {
+		cfg.ListenAddr = defaultListenAddr
+	}
+	if cfg.Database == "" {
+		cfg.Database = defaultDatabase
+	}
+	if cfg.Collection == "" {
+		cfg.Collection = defaultCollection
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = defaultWorkers
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
+	if cfg.SubmitTimeout <= 0 {
+		cfg.SubmitTimeout = defaultSubmitTimeout
+	}
+	if cfg.BreakerThreshold <= 0 {
+		cfg.BreakerThreshold = defaultBreakerThreshold
+	}
+	if cfg.BreakerTimeout <= 0 {
+		cfg.BreakerTimeout = defaultBreakerTimeout
+	}
+	if cfg.RetentionInterval <= 0 {
+		cfg.RetentionInterval = defaultRetentionInterval
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if cfg.QueryTimeout <= 0 {
+		cfg.QueryTimeout = defaultQueryTimeout
+	}
+	if cfg.Autoscale.Enabled() {
+		if cfg.Autoscale.MinWorkers <= 0 {
+			cfg.Autoscale.MinWorkers = 1
+		}
+		if cfg.Autoscale.Interval <= 0 {
+			cfg.Autoscale.Interval = defaultAutoscaleInterval
+		}
+		if cfg.Autoscale.TargetWait <= 0 {
+			cfg.Autoscale.TargetWait = defaultAutoscaleTargetWait
+		}
+	}
+	return cfg
 }
 
 // Server struct holds the server's configuration, worker pool, and handlers.
 type Server struct {
 	Config
-	Wp             *internal.WorkerPool
-	handlers       *Handlers
-	circuitBreaker *internal.CircuitBreaker // Add circuit breaker field
+	mu            sync.Mutex // Serializes reloads of the Config
+	srv           *http.Server
+	store         storage.LogStore
+	archiver      *archive.Archiver
+	hub           *internal.TailHub
+	Wp            *internal.WorkerPool
+	handlers      *Handlers
+	insertBreaker *internal.CircuitBreaker
+	queryBreaker  *internal.CircuitBreaker
+	wal           *internal.WAL
+	syslog        *syslog.Server
+	janitor       *internal.Janitor
+	autoscaler    *internal.Autoscaler
 }
 
 // NewServer initializes a new server with the given configuration, worker pool and database.
 func NewServer(cfg Config) *Server {
-	if len(cfg.ListenAddr) == 0 {
-		cfg.ListenAddr = defaultListenAddr
-	}
+	cfg = cfg.withDefaults()
 
-	db, err := storage.NewStorage(cfg.DSN, "logdb", "logs")
+	db, err := NewLogStore(cfg)
 	if err != nil {
-		log.Fatalf("Error connecting to MongoDB: %v", err)
+		log.Fatalf("Error setting up storage: %v", err)
+	}
+
+	var wal *internal.WAL
+	if cfg.WALDir != "" {
+		if wal, err = internal.OpenWAL(cfg.WALDir); err != nil {
+			log.Fatalf("Error opening WAL: %v", err)
+		}
+	}
+
+	var archiver *archive.Archiver
+	if cfg.ArchiveDir != "" {
+		bucket, err := archive.NewDirBucket(cfg.ArchiveDir)
+		if err != nil {
+			log.Fatalf("Error setting up archive: %v", err)
+		}
+		if archiver, err = archive.NewArchiver(db, bucket, cfg.ArchiveCompression); err != nil {
+			log.Fatalf("Error setting up archive: %v", err)
+		}
+	}
+
+	var janitor *internal.Janitor
+	if cfg.Retention.Enabled() {
+		janitor = internal.NewJanitor(db, cfg.Retention, cfg.RetentionInterval, archiver)
 	}
+	setRetentionTTL(db, cfg.Retention, archiver != nil)
 
-	wp := internal.NewWorkerPool(5, db)
-	cb := internal.NewCircuitBreaker(3, 10) // Create a new circuit breaker                      // Ensure MongoDB connection is closed on shutdown
-	handlers := NewHandlers(wp, cb)         // Pass the circuit breaker to handlers
-	return &Server{Config: cfg, Wp: wp, handlers: handlers, circuitBreaker: cb}
+	hub := internal.NewTailHub()
+	// Inserts and queries trip their own circuit breaker, so failing queries don't turn away ingestion
+	insertBreaker := internal.NewCircuitBreakerWithPolicy(internal.BreakerInsert, cfg.breakerPolicy())
+	queryBreaker := internal.NewCircuitBreakerWithPolicy(internal.BreakerQuery, cfg.breakerPolicy())
+	for _, cb := range []*internal.CircuitBreaker{insertBreaker, queryBreaker} {
+		cb.OnStateChange(func(name string, from, to internal.BreakerState) {
+			fmt.Printf("Circuit breaker %s moved from %s to %s\n", name, from, to)
+		})
+	}
+	wp := internal.NewWorkerPool(cfg.Workers, cfg.jobQueues(), internal.NewGuardedStore(db, insertBreaker, queryBreaker), wal, hub)
+	var autoscaler *internal.Autoscaler
+	if cfg.Autoscale.Enabled() {
+		autoscaler = internal.NewAutoscaler(wp, cfg.Autoscale)
+	}
+	handlers := NewHandlers(wp, insertBreaker, queryBreaker, wal, hub, janitor, autoscaler)
+	handlers.queryTimeout, handlers.routeTimeouts = cfg.QueryTimeout, cfg.RouteTimeouts
+	handlers.tailOrigins = cfg.TailOrigins
+
+	// Replay the batches that were accepted but not stored before the last shutdown
+	pending := wal.Pending()
+	for _, entry := range pending {
+		wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: entry.Logs, WALSeq: entry.Seq})
+	}
+	if len(pending) > 0 {
+		fmt.Printf("Replayed %d batches from the WAL\n", len(pending))
+	}
+	// Only limited once replayed, the replay waits for room in the queue however long it takes
+	wp.SetSubmitLimits(cfg.SubmitTimeout, cfg.MemoryBudget)
+
+	janitor.Start()
+	autoscaler.Start()
+
+	srv := &http.Server{Addr: cfg.ListenAddr, Handler: routes(handlers)}
+	// Live tail streams never finish by themselves, so they are ended for the server to shut down
+	srv.RegisterOnShutdown(hub.Close)
+
+	server := &Server{Config: cfg, srv: srv, store: db, archiver: archiver, hub: hub, Wp: wp, handlers: handlers, insertBreaker: insertBreaker, queryBreaker: queryBreaker, wal: wal, janitor: janitor, autoscaler: autoscaler}
+	if cfg.SyslogUDPAddr != "" || cfg.SyslogTCPAddr != "" {
+		// Syslog messages take the same path as batches posted to /logs/batch
+		server.syslog = syslog.NewServer(cfg.SyslogUDPAddr, cfg.SyslogTCPAddr, func(logs []utils.LogMessage) error {
+			_, err := handlers.submitBatch(logs)
+			return err
+		})
+	}
+	return server
+}
+
+// jobQueues returns the configuration of the queue of every job type
+func (cfg Config) jobQueues() map[utils.JobType]internal.QueueConfig {
+	queues := make(map[utils.JobType]internal.QueueConfig, len(utils.JobTypes))
+	for _, jobType := range utils.JobTypes {
+		queue := cfg.Queues[jobType.String()]
+		if queue.Capacity <= 0 {
+			queue.Capacity = cfg.QueueSize
+		}
+		queues[jobType] = queue
+	}
+	return queues
+}
+
+// breakerPolicy returns the policy of the circuit breakers guarding the storage
+func (cfg Config) breakerPolicy() internal.BreakerPolicy {
+	policy := cfg.Breaker
+	policy.Threshold, policy.Timeout = cfg.BreakerThreshold, cfg.BreakerTimeout
+	return policy
+}
+
+// setRetentionTTL lets MongoDB expire logs by itself as long as every level is kept equally long and nothing is archived
+func setRetentionTTL(db storage.LogStore, policy storage.RetentionPolicy, archiving bool) {
+	if mongoStore, ok := db.(*storage.Storage); ok {
+		ttl := policy.MaxAge
+		if len(policy.LevelMaxAge) > 0 || archiving {
+			ttl = 0
+		}
+		if err := mongoStore.SetRetentionTTL(context.Background(), ttl); err != nil {
+			fmt.Printf("Failed to set up the retention TTL index: %v\n", err)
+		}
+	}
+}
+
+// NewLogStore creates the storage backend selected in the configuration
+func NewLogStore(cfg Config) (storage.LogStore, error) {
+	cfg = cfg.withDefaults()
+	switch cfg.Backend {
+	case "", storage.BackendMongo:
+		return storage.NewStorage(cfg.DSN, cfg.Database, cfg.Collection)
+	case storage.BackendMemory:
+		return storage.NewMemoryStorage(), nil
+	case storage.BackendDisk:
+		return storage.NewDiskStorage(cfg.DataDir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %q", cfg.Backend)
+	}
+}
+
+// routes sets up the HTTP routes of the handlers on a mux of their own
+func routes(h *Handlers) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/logs/batch", h.HandleBatchLog)
+	mux.HandleFunc("/livez", h.HandleLiveness)
+	mux.HandleFunc("/readyz", h.HandleReadiness)
+	mux.HandleFunc("/health", h.HandleReadiness) // Kept for existing probes
+	mux.HandleFunc("/logs/retrieve", h.HandleLogRetrieval)
+	mux.HandleFunc("/logs/tail", h.HandleLogTail)
+	mux.HandleFunc("/logs/stats", h.HandleLogStats)
+	mux.HandleFunc("/admin/retention", h.HandleRetention)
+	mux.HandleFunc("/admin/workers", h.HandleWorkers)
+	mux.HandleFunc("/metrics", h.HandleMetrics)
+	return mux
 }
 
 // Start starts the server and listens for incoming requests and signals.
 func (s *Server) Start() error {
-	// Setup HTTP server and routes
-	srv := &http.Server{Addr: s.ListenAddr}
-	http.HandleFunc("/logs/batch", s.handlers.HandleBatchLog)
-	http.HandleFunc("/health", s.handlers.HandleHealthCheck)
-	http.HandleFunc("/logs/retrieve", s.handlers.HandleLogRetrieval)
+	if s.syslog != nil {
+		if err := s.syslog.Start(); err != nil {
+			return err
+		}
+	}
 
 	fmt.Printf("Starting server on %s\n", s.ListenAddr)
 	// If the server fails to start, return the error
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err := s.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("server failed to start: %v", err)
 	}
 
 	return nil
 }
 
-// Stop gracefully stops the worker pool
+// Shutdown stops the server gracefully: it stops accepting connections and lets in-flight requests finish,
+// then drains the job queue, closes the WAL and closes storage. The requests get httpShutdownShare of the time
+// left until the deadline of ctx, the drain the rest. Jobs still queued once ctx is done are left unprocessed,
+// their logs being replayed from the WAL on the next start when it is enabled.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+	// Stop receiving syslog messages before the workers go away
+	if s.syslog != nil {
+		s.syslog.Stop()
+	}
+	httpCtx, cancel := withShare(ctx, httpShutdownShare)
+	if err := s.srv.Shutdown(httpCtx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to shut down the HTTP server: %v", err))
+	}
+	cancel()
+	s.janitor.Stop()
+	s.autoscaler.Stop()
+
+	report := s.Wp.Shutdown(ctx)
+	if report.TimedOut {
+		fmt.Printf("Shutdown deadline passed before the job queue was drained, %d store jobs and %d queries were never started\n",
+			report.Unstarted, report.Abandoned)
+	}
+	fmt.Printf("Flushed %d logs to storage, %d left in the WAL for replay, %d dropped, %d queries abandoned\n",
+		report.Flushed, report.Spilled, report.Dropped, report.Abandoned)
+
+	// Unstored batches stay in the WAL and are replayed on the next start
+	if err := s.wal.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close WAL: %v", err))
+	}
+	if err := s.store.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close storage: %v", err))
+	}
+	return errors.Join(errs...)
+}
+
+// withShare returns a context ending once share of the time left until the deadline of ctx has passed,
+// or with ctx when it has no deadline
+func withShare(ctx context.Context, share float64) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, time.Now().Add(time.Duration(float64(time.Until(deadline))*share)))
+}
+
+// Stop gracefully stops the server, waiting up to the ShutdownTimeout
 func (s *Server) Stop() {
-	//close the worker pool and close threads
-	s.Wp.Stop()
+	s.mu.Lock()
+	timeout := s.ShutdownTimeout
+	s.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		fmt.Printf("Server stopped with errors: %v\n", err)
+		return
+	}
 	fmt.Println("Server stopped gracefully")
 }
@@ -2,12 +2,17 @@ package api_test
 
 import (
 	"log-aggregator/aggregator/api"
+	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/storage"
 	"net/http"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 func TestServerStart(t *testing.T) {
-	cfg := api.Config{ListenAddr: ":8080"}
+	cfg := api.Config{ListenAddr: ":8080", Backend: storage.BackendMemory}
 	server := api.NewServer(cfg)
 
 	// Create a goroutine to run the server
@@ -18,8 +23,8 @@ func TestServerStart(t *testing.T) {
 	}()
 
 	// Allow some time for the server to start
+	time.Sleep(100 * time.Millisecond)
 	defer func() {
-		http.DefaultServeMux = http.NewServeMux() // Reset the default mux
 		server.Stop()
 	}()
 
@@ -36,7 +41,7 @@ func TestServerStart(t *testing.T) {
 }
 
 func TestServerStop(t *testing.T) {
-	cfg := api.Config{ListenAddr: ":8081"}
+	cfg := api.Config{ListenAddr: ":8081", Backend: storage.BackendMemory}
 	server := api.NewServer(cfg)
 
 	go server.Start()
@@ -48,7 +53,75 @@ func TestServerStop(t *testing.T) {
 	if server.Wp.ActiveWorkers() != 0 {
 		t.Errorf("Expected active workers to be 0 after stopping")
 	}
+}
+
+// TestServerReload tests that reloading applies the settings that can change while running and ignores the others.
+func TestServerReload(t *testing.T) {
+	cfg := api.Config{ListenAddr: ":8082", Backend: storage.BackendMemory, Retention: storage.RetentionPolicy{MaxAge: time.Hour}}
+	server := api.NewServer(cfg)
+	defer server.Stop()
+
+	reloaded := cfg
+	reloaded.ListenAddr = ":9090"
+	reloaded.Workers = 8
+	reloaded.Retention = storage.RetentionPolicy{MaxAge: 2 * time.Hour}
+	server.Reload(reloaded)
+
+	if server.Wp.Size() != 8 || server.Workers != 8 {
+		t.Errorf("Expected 8 workers, got %d", server.Wp.Size())
+	}
+	if server.Retention.MaxAge != 2*time.Hour {
+		t.Errorf("Expected the retention to be reloaded, got %+v", server.Retention)
+	}
+	if server.ListenAddr != ":8082" {
+		t.Errorf("Expected the listen address to need a restart, got %s", server.ListenAddr)
+	}
+
+	// Removed workers finish and exit
+	reloaded.Workers = 2
+	server.Reload(reloaded)
+	deadline := time.Now().Add(time.Second)
+	for server.Wp.ActiveWorkers() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.Wp.ActiveWorkers() != 2 {
+		t.Errorf("Expected 2 active workers, got %d", server.Wp.ActiveWorkers())
+	}
+}
+
+// TestServerReload_DisableAutoscale tests that reloading can turn autoscaling off, and back on, while it runs.
+func TestServerReload_DisableAutoscale(t *testing.T) {
+	cfg := api.Config{ListenAddr: ":8083", Backend: storage.BackendMemory, Autoscale: internal.AutoscalePolicy{MaxWorkers: 4}}
+	server := api.NewServer(cfg)
+	defer server.Stop()
+
+	reloaded := cfg
+	reloaded.Autoscale = internal.AutoscalePolicy{}
+	server.Reload(reloaded)
+	if server.Autoscale.Enabled() {
+		t.Errorf("Expected autoscaling to be disabled, got %+v", server.Autoscale)
+	}
+
+	server.Reload(cfg)
+	if !server.Autoscale.Enabled() || server.Autoscale.Interval <= 0 {
+		t.Errorf("Expected autoscaling to be enabled again, got %+v", server.Autoscale)
+	}
+}
 
-	// Reset the handlers
-	http.DefaultServeMux = http.NewServeMux()
+// TestServerTailOrigins tests that the configured origins can open WebSocket tails.
+func TestServerTailOrigins(t *testing.T) {
+	cfg := api.Config{ListenAddr: ":8084", Backend: storage.BackendMemory, TailOrigins: []string{"https://dashboard.example.com"}}
+	server := api.NewServer(cfg)
+	go server.Start()
+	defer server.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:8084/logs/tail", http.Header{"Origin": {"https://dashboard.example.com"}})
+	if err != nil {
+		t.Fatalf("Expected the allowed origin to connect, got %v", err)
+	}
+	conn.Close()
+	if _, _, err := websocket.DefaultDialer.Dial("ws://localhost:8084/logs/tail", http.Header{"Origin": {"https://evil.example.com"}}); err == nil {
+		t.Errorf("Expected other origins to be forbidden")
+	}
 }
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// tailBufferSize is the number of logs buffered per tail subscriber before logs are dropped
+	tailBufferSize = 256
+	// tailReportInterval is how often dropped logs are reported and idle connections are kept alive
+	tailReportInterval = time.Second
+	tailKeepAlive      = 15 * time.Second
+	tailWriteTimeout   = 10 * time.Second
+)
+
+// tailMessage is a single message sent to WebSocket tail clients
+type tailMessage struct {
+	Type    string            `json:"type"` // "log" or "dropped"
+	Log     *utils.LogMessage `json:"log,omitempty"`
+	Dropped uint64            `json:"dropped,omitempty"`
+}
+
+// HandleLogTail streams newly stored logs matching the query parameters over SSE, or WebSocket when upgrading
+func (h *Handlers) HandleLogTail(w http.ResponseWriter, r *http.Request) {
+	if err := utils.ValidateRequest(w, r, http.MethodGet); err != nil {
+		return
+	}
+
+	query, err := utils.ParseLogQueryParams(r)
+	if err != nil {
+		respondQueryError(w, err)
+		return
+	}
+	filter := func(log utils.LogMessage) bool { return storage.MatchesQuery(log, query) }
+
+	if websocket.IsWebSocketUpgrade(r) {
+		h.tailWebSocket(w, r, filter)
+		return
+	}
+	h.tailSSE(w, r, filter)
+}
+
+// tailSSE streams logs as Server-Sent Events until the client goes away
+func (h *Handlers) tailSSE(w http.ResponseWriter, r *http.Request, filter func(utils.LogMessage) bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := h.hub.Subscribe(filter, tailBufferSize)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(tailReportInterval)
+	defer ticker.Stop()
+	lastWrite := time.Now()
+
+	for {
+		select {
+		case log, ok := <-sub.Logs():
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(log)
+			if _, err := fmt.Fprintf(w, "event: log\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if dropped := sub.TakeDropped(); dropped > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+			} else if time.Since(lastWrite) < tailKeepAlive {
+				continue
+			} else {
+				// Comments keep proxies from closing idle streams
+				fmt.Fprint(w, ": keep-alive\n\n")
+			}
+		case <-r.Context().Done():
+			return
+		}
+		lastWrite = time.Now()
+		flusher.Flush()
+	}
+}
+
+// checkOrigin lets browsers open WebSocket tails from the aggregator's own host or an allowed origin,
+// clients sending no Origin aren't browsers and are let through
+func (h *Handlers) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range h.tailOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// tailWebSocket streams logs as JSON messages over a WebSocket until either side closes it
+func (h *Handlers) tailWebSocket(w http.ResponseWriter, r *http.Request, filter func(utils.LogMessage) bool) {
+	upgrader := websocket.Upgrader{CheckOrigin: h.checkOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // The upgrader already responded with an error
+	}
+	defer conn.Close()
+
+	sub := h.hub.Subscribe(filter, tailBufferSize)
+	defer sub.Close()
+
+	// Reading is required to process control frames and notice the client closing
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(tailReportInterval)
+	defer ticker.Stop()
+	lastWrite := time.Now()
+
+	for {
+		var err error
+		select {
+		case log, ok := <-sub.Logs():
+			if !ok {
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(tailWriteTimeout))
+			err = conn.WriteJSON(tailMessage{Type: "log", Log: &log})
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(tailWriteTimeout))
+			if dropped := sub.TakeDropped(); dropped > 0 {
+				err = conn.WriteJSON(tailMessage{Type: "dropped", Dropped: dropped})
+			} else if time.Since(lastWrite) < tailKeepAlive {
+				continue
+			} else {
+				err = conn.WriteMessage(websocket.PingMessage, nil)
+			}
+		case <-closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+		lastWrite = time.Now()
+	}
+}
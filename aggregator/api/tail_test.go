@@ -0,0 +1,113 @@
+package api_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// waitForSubscribers polls until the hub has n subscribers
+func waitForSubscribers(t *testing.T, subscribers func() int, n int) {
+	deadline := time.Now().Add(time.Second)
+	for subscribers() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d subscribers", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestHandleLogTail_SSE tests that stored logs matching the filter are streamed as events.
+func TestHandleLogTail_SSE(t *testing.T) {
+	handlers, _, hub := newTestHandlersWithHub(t)
+	server := httptest.NewServer(http.HandlerFunc(handlers.HandleLogTail))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?logLevel=ERROR")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", resp.Header.Get("Content-Type"))
+	}
+	waitForSubscribers(t, hub.Subscribers, 1)
+
+	body := `[{"timestamp":"2024-10-08T00:00:00Z","level":"INFO","message":"skipped"},{"timestamp":"2024-10-08T00:00:01Z","level":"ERROR","message":"streamed"}]`
+	rec := httptest.NewRecorder()
+	handlers.HandleBatchLog(rec, httptest.NewRequest(http.MethodPost, "/logs/batch", strings.NewReader(body)))
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			if !strings.Contains(line, `"message":"streamed"`) {
+				t.Errorf("Expected only the ERROR log, got %s", line)
+			}
+			return
+		}
+	}
+}
+
+// TestHandleLogTail_WebSocket tests that stored logs are streamed as WebSocket messages.
+func TestHandleLogTail_WebSocket(t *testing.T) {
+	handlers, _, hub := newTestHandlersWithHub(t)
+	server := httptest.NewServer(http.HandlerFunc(handlers.HandleLogTail))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?text=TIMEOUT", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	waitForSubscribers(t, hub.Subscribers, 1)
+
+	body := `[{"timestamp":"2024-10-08T00:00:00Z","level":"INFO","message":"ok"},{"timestamp":"2024-10-08T00:00:01Z","level":"WARN","message":"upstream timeout"}]`
+	handlers.HandleBatchLog(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/logs/batch", strings.NewReader(body)))
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	var msg struct {
+		Type string `json:"type"`
+		Log  struct {
+			Message string `json:"message"`
+		} `json:"log"`
+	}
+	json.Unmarshal(data, &msg)
+	if msg.Type != "log" || msg.Log.Message != "upstream timeout" {
+		t.Errorf("Expected the timeout log, got %s", data)
+	}
+}
+
+// TestHandleLogTail_Origin tests that browsers can only open WebSocket tails from the aggregator's own host.
+func TestHandleLogTail_Origin(t *testing.T) {
+	handlers, _, _ := newTestHandlersWithHub(t)
+	server := httptest.NewServer(http.HandlerFunc(handlers.HandleLogTail))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://evil.example.com"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a foreign origin to be forbidden, got %v", err)
+	}
+
+	for _, header := range []http.Header{{"Origin": {server.URL}}, nil} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err != nil {
+			t.Fatalf("Expected origin %q to connect, got %v", header.Get("Origin"), err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,237 @@
+package archive
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression formats of the archives
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// ManifestName is the object listing every archive in a bucket
+const ManifestName = "manifest.json"
+
+// archivePageSize is the number of logs read from storage at once while archiving
+const archivePageSize = 1000
+
+// compressionExts maps compression formats to the extension of their archives
+var compressionExts = map[string]string{
+	CompressionGzip: ".ndjson.gz",
+	CompressionZstd: ".ndjson.zst",
+}
+
+// Entry describes a single archive in the manifest
+type Entry struct {
+	Name        string    `json:"name"`
+	Compression string    `json:"compression"`
+	Query       string    `json:"query,omitempty"` // Filters the archived logs were selected with
+	From        time.Time `json:"from"`            // Timestamp of the oldest archived log
+	To          time.Time `json:"to"`              // Timestamp of the newest archived log
+	Count       int       `json:"count"`
+	Size        int64     `json:"size"`   // Compressed bytes
+	SHA256      string    `json:"sha256"` // Checksum of the compressed archive
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Manifest lists the archives of a bucket, oldest first
+type Manifest struct {
+	Archives []Entry `json:"archives"`
+}
+
+// Archiver exports logs from storage into compressed NDJSON archives
+type Archiver struct {
+	store       storage.LogStore
+	bucket      Bucket
+	compression string
+	mu          sync.Mutex // Serializes manifest updates
+}
+
+// NewArchiver creates an archiver writing logs of store to bucket, compression defaults to gzip
+func NewArchiver(store storage.LogStore, bucket Bucket, compression string) (*Archiver, error) {
+	if compression == "" {
+		compression = CompressionGzip
+	}
+	if _, ok := compressionExts[compression]; !ok {
+		return nil, fmt.Errorf("unknown archive compression: %q", compression)
+	}
+	return &Archiver{store: store, bucket: bucket, compression: compression}, nil
+}
+
+// Archive writes every log matching the query, oldest first, into a new archive listed in the manifest.
+// It returns nil without creating an archive when nothing matches.
+func (a *Archiver) Archive(ctx context.Context, query utils.LogQuery) (*Entry, error) {
+	query.Order, query.Limit, query.After = utils.OrderAsc, archivePageSize, nil
+	logs, err := a.store.GetLogMessages(ctx, query)
+	if err != nil || len(logs) == 0 {
+		return nil, err
+	}
+
+	entry := Entry{Compression: a.compression, Query: describeQuery(query), From: logs[0].Timestamp, CreatedAt: time.Now().UTC()}
+	entry.Name = fmt.Sprintf("logs-%s-%d%s", entry.From.UTC().Format("20060102T150405Z"), entry.CreatedAt.UnixNano(), compressionExts[a.compression])
+
+	object, err := a.bucket.Create(entry.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.write(ctx, object, &entry, logs, query); err != nil {
+		object.Close()
+		a.bucket.Delete(entry.Name)
+		return nil, err
+	}
+	if err := object.Close(); err != nil {
+		a.bucket.Delete(entry.Name)
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	manifest, err := ReadManifest(a.bucket)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Archives = append(manifest.Archives, entry)
+	if err := writeManifest(a.bucket, manifest); err != nil {
+		// An archive missing from the manifest would never be found again
+		a.bucket.Delete(entry.Name)
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// write compresses the logs page by page into object, filling in the entry's count, range, size and checksum
+func (a *Archiver) write(ctx context.Context, object io.Writer, entry *Entry, logs []utils.LogMessage, query utils.LogQuery) error {
+	hash := sha256.New()
+	counter := &countingWriter{}
+	compressor, err := newCompressor(io.MultiWriter(object, hash, counter), a.compression)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(compressor)
+
+	for len(logs) > 0 {
+		for _, log := range logs {
+			if err := encoder.Encode(log); err != nil {
+				return fmt.Errorf("failed to write archive: %v", err)
+			}
+		}
+		entry.Count += len(logs)
+		last := logs[len(logs)-1]
+		entry.To = last.Timestamp
+
+		query.After = &utils.Cursor{Time: last.Timestamp, ID: last.ID}
+		if logs, err = a.store.GetLogMessages(ctx, query); err != nil {
+			return err
+		}
+	}
+
+	if err := compressor.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %v", err)
+	}
+	entry.Size = counter.n
+	entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// ReadManifest returns the manifest of the bucket, which is empty before the first archive
+func ReadManifest(bucket Bucket) (Manifest, error) {
+	var manifest Manifest
+	reader, err := bucket.Open(ManifestName)
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, fmt.Errorf("failed to open manifest: %v", err)
+	}
+	defer reader.Close()
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("failed to decode manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+// writeManifest replaces the manifest of the bucket
+func writeManifest(bucket Bucket, manifest Manifest) error {
+	writer, err := bucket.Create(ManifestName)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return writer.Close()
+}
+
+// describeQuery summarizes the filters an archive was selected with for the manifest
+func describeQuery(query utils.LogQuery) string {
+	var parts []string
+	if query.LogLevel != "" {
+		parts = append(parts, "level:"+query.LogLevel)
+	}
+	if query.Expr != nil {
+		parts = append(parts, query.Expr.String())
+	}
+	if !query.EndTime.IsZero() {
+		parts = append(parts, "before:"+query.EndTime.UTC().Format(time.RFC3339Nano))
+	}
+	return strings.Join(parts, " ")
+}
+
+// newCompressor wraps w with the compression format's writer
+func newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return gzip.NewWriter(w), nil
+	}
+}
+
+// newDecompressor wraps r with the reader of the compression format the archive name implies
+func newDecompressor(r io.Reader, name string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(name, compressionExts[CompressionZstd]):
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read zstd archive: %v", err)
+		}
+		return decoder.IOReadCloser(), nil
+	case strings.HasSuffix(name, compressionExts[CompressionGzip]):
+		reader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip archive: %v", err)
+		}
+		return reader, nil
+	default:
+		return nil, fmt.Errorf("unknown archive format: %s", name)
+	}
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
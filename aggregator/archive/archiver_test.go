@@ -0,0 +1,111 @@
+package archive_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log-aggregator/aggregator/archive"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestArchiver_RoundTrip tests archiving a time range with each compression and restoring it into another store.
+func TestArchiver_RoundTrip(t *testing.T) {
+	for _, compression := range []string{archive.CompressionGzip, archive.CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			source := storage.NewMemoryStorage()
+			base := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+			var logs []utils.LogMessage
+			for i := 0; i < 2500; i++ {
+				logs = append(logs, utils.LogMessage{Timestamp: base.Add(time.Duration(i) * time.Second), Level: "INFO", Message: "tick", Fields: map[string]interface{}{"n": i}})
+			}
+			source.InsertLogMessages(context.Background(), logs)
+
+			bucket, _ := archive.NewDirBucket(t.TempDir())
+			archiver, err := archive.NewArchiver(source, bucket, compression)
+			if err != nil {
+				t.Fatalf("Failed to create archiver: %v", err)
+			}
+			entry, err := archiver.Archive(context.Background(), utils.LogQuery{StartTime: base, EndTime: base.Add(2099 * time.Second)})
+			if err != nil {
+				t.Fatalf("Failed to archive: %v", err)
+			}
+			if entry.Count != 2100 || !entry.From.Equal(base) || !entry.To.Equal(base.Add(2099*time.Second)) {
+				t.Errorf("Expected 2100 logs in the archive, got %+v", entry)
+			}
+
+			manifest, _ := archive.ReadManifest(bucket)
+			if len(manifest.Archives) != 1 || manifest.Archives[0].SHA256 != entry.SHA256 {
+				t.Fatalf("Expected the archive in the manifest, got %+v", manifest)
+			}
+
+			target := storage.NewMemoryStorage()
+			restored, err := archive.Restore(context.Background(), bucket, entry.Name, target)
+			if err != nil || restored != 2100 {
+				t.Fatalf("Expected 2100 restored logs, got %d (%v)", restored, err)
+			}
+			last, _ := target.GetLogMessages(context.Background(), utils.LogQuery{Order: utils.OrderDesc, Limit: 1})
+			if len(last) != 1 || last[0].Fields["n"] != float64(2099) {
+				t.Errorf("Expected the last archived log to be restored with its fields, got %v", last)
+			}
+		})
+	}
+}
+
+// TestRestore_Corrupt tests that a corrupt archive is rejected before anything is restored.
+func TestRestore_Corrupt(t *testing.T) {
+	dir := t.TempDir()
+	source := storage.NewMemoryStorage()
+	source.InsertLogMessages(context.Background(), []utils.LogMessage{{Timestamp: time.Now(), Level: "INFO", Message: "hello"}})
+
+	bucket, _ := archive.NewDirBucket(dir)
+	archiver, _ := archive.NewArchiver(source, bucket, "")
+	entry, _ := archiver.Archive(context.Background(), utils.LogQuery{})
+	if err := os.WriteFile(filepath.Join(dir, entry.Name), []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	target := storage.NewMemoryStorage()
+	if _, err := archive.Restore(context.Background(), bucket, entry.Name, target); err == nil {
+		t.Error("Expected restoring a corrupt archive to fail")
+	}
+	if logs, _ := target.GetLogMessages(context.Background(), utils.LogQuery{}); len(logs) != 0 {
+		t.Errorf("Expected nothing to be restored, got %v", logs)
+	}
+
+	if empty, err := archiver.Archive(context.Background(), utils.LogQuery{LogLevel: "ERROR"}); empty != nil || err != nil {
+		t.Errorf("Expected no archive when nothing matches, got %+v (%v)", empty, err)
+	}
+}
+
+// manifestlessBucket fails to write the manifest
+type manifestlessBucket struct {
+	*archive.DirBucket
+}
+
+func (b manifestlessBucket) Create(name string) (io.WriteCloser, error) {
+	if name == archive.ManifestName {
+		return nil, errors.New("bucket is read-only")
+	}
+	return b.DirBucket.Create(name)
+}
+
+// TestArchiver_ManifestFailure tests that an archive is removed when it can't be listed in the manifest.
+func TestArchiver_ManifestFailure(t *testing.T) {
+	dir := t.TempDir()
+	source := storage.NewMemoryStorage()
+	source.InsertLogMessages(context.Background(), []utils.LogMessage{{Timestamp: time.Now(), Level: "INFO", Message: "hello"}})
+
+	bucket, _ := archive.NewDirBucket(dir)
+	archiver, _ := archive.NewArchiver(source, manifestlessBucket{bucket}, "")
+	if entry, err := archiver.Archive(context.Background(), utils.LogQuery{}); entry != nil || err == nil {
+		t.Fatalf("Expected archiving to fail, got %+v", entry)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected the archive to be removed, found %d files", len(files))
+	}
+}
@@ -0,0 +1,76 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Bucket is where archives and their manifest are kept. Names are flat object keys, so an object store
+// client can implement it as well as a local directory.
+type Bucket interface {
+	// Create returns a writer for the named object, which only becomes visible once the writer is closed
+	Create(name string) (io.WriteCloser, error)
+	// Open returns a reader for the named object, an error wrapping os.ErrNotExist when it doesn't exist
+	Open(name string) (io.ReadCloser, error)
+	// Delete removes the named object
+	Delete(name string) error
+}
+
+// DirBucket is a Bucket storing objects as files in a local directory
+type DirBucket struct {
+	Dir string
+}
+
+// NewDirBucket creates the directory if needed
+func NewDirBucket(dir string) (*DirBucket, error) {
+	if dir == "" {
+		return nil, errors.New("archive requires a directory")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %v", err)
+	}
+	return &DirBucket{Dir: dir}, nil
+}
+
+// Create writes to a temporary file renamed to name when closed, so readers never see a partial object
+func (b *DirBucket) Create(name string) (io.WriteCloser, error) {
+	file, err := os.CreateTemp(b.Dir, filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", name, err)
+	}
+	return &dirObject{File: file, path: filepath.Join(b.Dir, filepath.Base(name))}, nil
+}
+
+// Open opens the file of the named object
+func (b *DirBucket) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(b.Dir, filepath.Base(name)))
+}
+
+// Delete removes the file of the named object
+func (b *DirBucket) Delete(name string) error {
+	return os.Remove(filepath.Join(b.Dir, filepath.Base(name)))
+}
+
+// dirObject is a temporary file moved into place on Close
+type dirObject struct {
+	*os.File
+	path string
+}
+
+func (o *dirObject) Close() error {
+	defer os.Remove(o.Name()) // No-op once renamed
+	if err := o.Sync(); err != nil {
+		o.File.Close()
+		return fmt.Errorf("failed to sync %s: %v", o.path, err)
+	}
+	if err := o.File.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %v", o.path, err)
+	}
+	if err := os.Rename(o.Name(), o.path); err != nil {
+		return fmt.Errorf("failed to move %s into place: %v", o.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package archive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+)
+
+// restoreChunkSize is the number of restored logs inserted at once
+const restoreChunkSize = 500
+
+// Restore re-imports the named archive into store, first verifying its checksum when the manifest lists it.
+// It returns the number of restored logs, which keep their timestamps and so expire again under the retention policy that archived them.
+func Restore(ctx context.Context, bucket Bucket, name string, store storage.LogStore) (int, error) {
+	manifest, err := ReadManifest(bucket)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range manifest.Archives {
+		if entry.Name == name {
+			if err := verify(bucket, entry); err != nil {
+				return 0, err
+			}
+			break
+		}
+	}
+
+	object, err := bucket.Open(name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open archive %s: %v", name, err)
+	}
+	defer object.Close()
+	reader, err := newDecompressor(object, name)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	restored, rejected, lineErrors, err := utils.DecodeNDJSON(reader, restoreChunkSize, func(logs []utils.LogMessage) error {
+		return store.InsertLogMessages(ctx, logs)
+	})
+	if err != nil {
+		return restored, fmt.Errorf("failed to restore archive %s: %v", name, err)
+	}
+	if rejected > 0 {
+		return restored, fmt.Errorf("archive %s has %d invalid lines, first on line %d: %s", name, rejected, lineErrors[0].Line, lineErrors[0].Error)
+	}
+	return restored, nil
+}
+
+// verify checks the archive against the checksum recorded in the manifest
+func verify(bucket Bucket, entry Entry) error {
+	object, err := bucket.Open(entry.Name)
+	if err != nil {
+		return fmt.Errorf("failed to open archive %s: %v", entry.Name, err)
+	}
+	defer object.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, object); err != nil {
+		return fmt.Errorf("failed to read archive %s: %v", entry.Name, err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != entry.SHA256 {
+		return fmt.Errorf("archive %s is corrupt: checksum %s, expected %s", entry.Name, sum, entry.SHA256)
+	}
+	return nil
+}
@@ -1,24 +1,58 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"log"
 	"log-aggregator/aggregator/api"
+	"log-aggregator/aggregator/config"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
-var config = api.Config{
+// defaults is the configuration used unless overridden by the config file, the environment or flags.
+// The WAL, the syslog listeners, retention and archiving stay off unless configured.
+var defaults = api.Config{
 	ListenAddr: ":8005",
 	DSN:        "mongodb://mongodb:27017",
+	Database:   "logdb",
+	Collection: "logs",
+
+	Workers:          5,
+	QueueSize:        100,
+	SubmitTimeout:    time.Second,
+	BreakerThreshold: 3,
+	BreakerTimeout:   10 * time.Second,
+
+	// Stats scan more logs than a page of results
+	QueryTimeout:  10 * time.Second,
+	RouteTimeouts: map[string]time.Duration{"/logs/stats": 30 * time.Second},
+
+	ShutdownTimeout: 30 * time.Second,
 }
 
 func main() {
-	// Notify the channel when an interrupt or terminate signal is received
+	cfg, printConfig, err := config.Load(defaults, os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+	if printConfig {
+		if err := config.Print(os.Stdout, cfg); err != nil {
+			log.Fatalf("Error printing configuration: %v", err)
+		}
+		return
+	}
+
+	// Notify the channel when an interrupt or terminate signal is received, or a hangup asking to reload
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	// Create the server
-	server := api.NewServer(config)
+	server := api.NewServer(cfg)
 	go func() {
 		if err := server.Start(); err != nil {
 			// this closes our application on Fatal error
@@ -26,7 +60,23 @@ func main() {
 		}
 	}()
 	// Block the main thread, waiting for a signal to close our application
-	sig := <-signals
-	log.Printf("Received signal: %v. Shutting down...", sig)
-	server.Stop()
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			reload(server)
+			continue
+		}
+		log.Printf("Received signal: %v. Shutting down...", sig)
+		server.Stop()
+		return
+	}
+}
+
+// reload loads the configuration again and applies it, an invalid configuration leaves the server untouched
+func reload(server *api.Server) {
+	cfg, _, err := config.Load(defaults, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		log.Printf("Rejected reloaded configuration: %v", err)
+		return
+	}
+	server.Reload(cfg)
 }
@@ -0,0 +1,102 @@
+// Command restore re-imports archived logs into storage, e.g.
+//
+//	restore -dir archive -from 2024-10-01T00:00:00Z -to 2024-10-08T00:00:00Z
+//
+// Restored logs keep their original timestamps, so a retention policy they are past deletes them again
+// at its next purge unless it is relaxed first.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"log-aggregator/aggregator/api"
+	"log-aggregator/aggregator/archive"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	dir := flag.String("dir", "archive", "directory holding the archives and their manifest")
+	name := flag.String("name", "", "name of a single archive to restore")
+	from := flag.String("from", "", "restore the archives holding logs at or after this RFC3339 time")
+	to := flag.String("to", "", "restore the archives holding logs at or before this RFC3339 time")
+	list := flag.Bool("list", false, "list the archives instead of restoring them")
+	var cfg api.Config
+	flag.StringVar(&cfg.Backend, "backend", "mongo", `storage backend to restore into, "mongo", "memory" or "disk"`)
+	flag.StringVar(&cfg.DSN, "dsn", "mongodb://mongodb:27017", "MongoDB connection string")
+	flag.StringVar(&cfg.DataDir, "data-dir", "", "data directory of the disk backend")
+	flag.Parse()
+
+	bucket, err := archive.NewDirBucket(*dir)
+	if err != nil {
+		log.Fatalf("Error opening archive: %v", err)
+	}
+	manifest, err := archive.ReadManifest(bucket)
+	if err != nil {
+		log.Fatalf("Error reading manifest: %v", err)
+	}
+
+	// Select the archives overlapping the requested range, or the one named
+	start, end := parseTime(*from), parseTime(*to)
+	var names []string
+	for _, entry := range manifest.Archives {
+		if *name != "" && entry.Name != *name {
+			continue
+		}
+		if (!start.IsZero() && entry.To.Before(start)) || (!end.IsZero() && entry.From.After(end)) {
+			continue
+		}
+		if *list {
+			fmt.Printf("%s\t%s\t%s\t%d logs\t%s\n", entry.Name, entry.From.Format(time.RFC3339), entry.To.Format(time.RFC3339), entry.Count, entry.Query)
+			continue
+		}
+		names = append(names, entry.Name)
+	}
+	if *list {
+		return
+	}
+	// Archives missing from the manifest can still be restored by name, without a checksum
+	if *name != "" && len(names) == 0 {
+		names = append(names, *name)
+	}
+	if len(names) == 0 {
+		log.Fatalf("No archives match")
+	}
+
+	store, err := api.NewLogStore(cfg)
+	if err != nil {
+		log.Fatalf("Error setting up storage: %v", err)
+	}
+	defer store.Close()
+
+	// An interrupt stops the restore between chunks instead of mid-insert
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	total := 0
+	for _, name := range names {
+		restored, err := archive.Restore(ctx, bucket, name, store)
+		total += restored
+		if err != nil {
+			log.Fatalf("Error restoring %s after %d logs: %v", name, total, err)
+		}
+		fmt.Printf("Restored %d logs from %s\n", restored, name)
+	}
+	fmt.Printf("Restored %d logs from %d archives\n", total, len(names))
+}
+
+// parseTime parses an optional RFC3339 flag
+func parseTime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatalf("Invalid time %q. Expected format: RFC3339", value)
+	}
+	return t
+}
@@ -0,0 +1,436 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log-aggregator/aggregator/api"
+	"log-aggregator/aggregator/archive"
+	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variables overriding settings, e.g. LOG_AGGREGATOR_WORKERS
+const EnvPrefix = "LOG_AGGREGATOR_"
+
+// setting is a configuration value that can be set from the environment and the command line
+type setting struct {
+	name  string // Flag name, the environment variable is EnvPrefix followed by its upper-cased form
+	usage string
+	set   func(cfg *api.Config, value string) error
+}
+
+// settings lists every setting of the Config, in the order they are shown in the usage
+var settings = []setting{
+	{"listen-addr", "address of the HTTP server", stringValue(func(c *api.Config) *string { return &c.ListenAddr })},
+	{"backend", `storage backend, "mongo", "memory" or "disk"`, stringValue(func(c *api.Config) *string { return &c.Backend })},
+	{"dsn", "MongoDB connection string", stringValue(func(c *api.Config) *string { return &c.DSN })},
+	{"database", "MongoDB database holding the logs", stringValue(func(c *api.Config) *string { return &c.Database })},
+	{"collection", "MongoDB collection holding the logs", stringValue(func(c *api.Config) *string { return &c.Collection })},
+	{"data-dir", "directory of the disk backend", stringValue(func(c *api.Config) *string { return &c.DataDir })},
+	{"wal-dir", "directory of the write-ahead log, disabled when empty", stringValue(func(c *api.Config) *string { return &c.WALDir })},
+	{"workers", "number of workers", intValue(func(c *api.Config) *int { return &c.Workers })},
+	{"queue-size", "number of jobs of each type queued before submitting waits", intValue(func(c *api.Config) *int { return &c.QueueSize })},
+	{"queue-capacities", "per job type queue capacities, e.g. store=1000,fetch=100", queueValue(func(q *internal.QueueConfig) *int { return &q.Capacity })},
+	{"queue-weights", "per job type scheduling weights, e.g. fetch=3,store=2,stats=1", queueValue(func(q *internal.QueueConfig) *int { return &q.Weight })},
+	{"submit-timeout", "how long a job waits for room in a full queue before it is turned away", durationValue(func(c *api.Config) *time.Duration { return &c.SubmitTimeout })},
+	{"memory-budget", "bytes of logs queued for storage before batches are turned away, 0 for no limit", int64Value(func(c *api.Config) *int64 { return &c.MemoryBudget })},
+	{"autoscale-min-workers", "fewest workers when autoscaling", intValue(func(c *api.Config) *int { return &c.Autoscale.MinWorkers })},
+	{"autoscale-max-workers", "most workers when autoscaling, 0 disables autoscaling", intValue(func(c *api.Config) *int { return &c.Autoscale.MaxWorkers })},
+	{"autoscale-interval", "how often the number of workers is reconsidered", durationValue(func(c *api.Config) *time.Duration { return &c.Autoscale.Interval })},
+	{"autoscale-target-wait", "average time jobs may wait for a worker before more are added", durationValue(func(c *api.Config) *time.Duration { return &c.Autoscale.TargetWait })},
+	{"breaker-threshold", "storage calls in the window before the circuit breaker can open, consecutive failures by default", intValue(func(c *api.Config) *int { return &c.BreakerThreshold })},
+	{"breaker-timeout", "how long the circuit breaker stays open", durationValue(func(c *api.Config) *time.Duration { return &c.BreakerTimeout })},
+	{"breaker-window", "span of the circuit breaker time window, a window of breaker-window-size calls when 0", durationValue(func(c *api.Config) *time.Duration { return &c.Breaker.Window })},
+	{"breaker-window-size", "calls in the circuit breaker count window, at least breaker-threshold", intValue(func(c *api.Config) *int { return &c.Breaker.WindowSize })},
+	{"breaker-failure-rate", "share of failed calls in the window opening the circuit breaker, 1 by default", floatValue(func(c *api.Config) *float64 { return &c.Breaker.FailureRate })},
+	{"breaker-slow-call", "storage calls taking longer are slow, disabled when 0", durationValue(func(c *api.Config) *time.Duration { return &c.Breaker.SlowCall })},
+	{"breaker-slow-call-rate", "share of slow calls in the window opening the circuit breaker, 1 by default", floatValue(func(c *api.Config) *float64 { return &c.Breaker.SlowCallRate })},
+	{"breaker-half-open-probes", "calls let through a half-open circuit breaker, all must succeed to close it", intValue(func(c *api.Config) *int { return &c.Breaker.HalfOpenProbes })},
+	{"syslog-udp-addr", "address of the syslog UDP listener, disabled when empty", stringValue(func(c *api.Config) *string { return &c.SyslogUDPAddr })},
+	{"syslog-tcp-addr", "address of the syslog TCP listener, disabled when empty", stringValue(func(c *api.Config) *string { return &c.SyslogTCPAddr })},
+	{"retention-max-age", "age past which logs are deleted, 0 keeps them forever", durationValue(func(c *api.Config) *time.Duration { return &c.Retention.MaxAge })},
+	{"retention-level-max-age", "per level max ages, e.g. ERROR=2160h,DEBUG=72h", levelDurationsValue(func(c *api.Config) *map[string]time.Duration { return &c.Retention.LevelMaxAge })},
+	{"retention-max-size", "bytes beyond which the oldest logs are deleted, 0 for no limit", int64Value(func(c *api.Config) *int64 { return &c.Retention.MaxSize })},
+	{"retention-interval", "how often the retention policy is enforced", durationValue(func(c *api.Config) *time.Duration { return &c.RetentionInterval })},
+	{"archive-dir", "directory expired logs are archived to, disabled when empty", stringValue(func(c *api.Config) *string { return &c.ArchiveDir })},
+	{"archive-compression", `compression of the archives, "gzip" or "zstd"`, stringValue(func(c *api.Config) *string { return &c.ArchiveCompression })},
+	{"query-timeout", "how long a query may take before it is abandoned", durationValue(func(c *api.Config) *time.Duration { return &c.QueryTimeout })},
+	{"route-timeouts", "per route query timeouts, e.g. /logs/stats=30s", routeDurationsValue(func(c *api.Config) *map[string]time.Duration { return &c.RouteTimeouts })},
+	{"tail-origins", `origins allowed to open WebSocket tails besides the aggregator's own, e.g. https://dashboard.example.com, "*" for any`, listValue(func(c *api.Config) *[]string { return &c.TailOrigins })},
+	{"shutdown-timeout", "how long shutting down waits for requests and queued jobs", durationValue(func(c *api.Config) *time.Duration { return &c.ShutdownTimeout })},
+}
+
+// envName returns the environment variable of a setting
+func envName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Load builds the configuration from defaults, overridden in turn by the YAML file given with -config
+// (or LOG_AGGREGATOR_CONFIG), the environment and the command line flags, and validates it.
+// printConfig reports whether -print-config was given.
+func Load(defaults api.Config, args []string, lookupEnv func(string) (string, bool)) (cfg api.Config, printConfig bool, err error) {
+	fs := flag.NewFlagSet("aggregator", flag.ContinueOnError)
+	path, _ := lookupEnv(envName("config"))
+	fs.StringVar(&path, "config", path, "path of a YAML configuration file ($"+envName("config")+")")
+	fs.BoolVar(&printConfig, "print-config", false, "print the resulting configuration as YAML and exit")
+
+	// Flags are applied once the file and the environment are, in the order they were given
+	type flagValue struct{ setting, value string }
+	var flags []flagValue
+	for _, s := range settings {
+		name := s.name
+		fs.Func(name, s.usage+" ($"+envName(name)+")", func(value string) error {
+			flags = append(flags, flagValue{name, value})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, false, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, false, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	cfg = defaults
+	// The defaults must not be changed through the copy
+	cfg.Retention.LevelMaxAge = maps.Clone(defaults.Retention.LevelMaxAge)
+	cfg.Queues = maps.Clone(defaults.Queues)
+	cfg.RouteTimeouts = maps.Clone(defaults.RouteTimeouts)
+	if path != "" {
+		if err := readFile(path, &cfg); err != nil {
+			return cfg, false, err
+		}
+	}
+	for _, s := range settings {
+		if value, ok := lookupEnv(envName(s.name)); ok {
+			if err := s.set(&cfg, value); err != nil {
+				return cfg, false, fmt.Errorf("invalid value %q for %s: %v", value, envName(s.name), err)
+			}
+		}
+	}
+	for _, f := range flags {
+		if err := lookup(f.setting).set(&cfg, f.value); err != nil {
+			return cfg, false, fmt.Errorf("invalid value %q for flag -%s: %v", f.value, f.setting, err)
+		}
+	}
+
+	return cfg, printConfig, Validate(cfg)
+}
+
+// readFile overrides cfg with the settings of a YAML file, maps such as level max ages are merged with the ones already set
+func readFile(path string, cfg *api.Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	// Misspelled settings would otherwise be silently ignored
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func lookup(name string) setting {
+	for _, s := range settings {
+		if s.name == name {
+			return s
+		}
+	}
+	panic("unknown setting " + name)
+}
+
+// Validate reports every invalid setting of the configuration at once
+func Validate(cfg api.Config) error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch cfg.Backend {
+	case "", storage.BackendMongo:
+		if cfg.DSN == "" {
+			invalid("dsn is required by the mongo backend")
+		}
+	case storage.BackendMemory:
+	case storage.BackendDisk:
+		if cfg.DataDir == "" {
+			invalid("data_dir is required by the disk backend")
+		}
+	default:
+		invalid("backend must be %q, %q or %q, got %q", storage.BackendMongo, storage.BackendMemory, storage.BackendDisk, cfg.Backend)
+	}
+	if cfg.Workers < 1 {
+		invalid("workers must be at least 1, got %d", cfg.Workers)
+	}
+	if cfg.QueueSize < 1 {
+		invalid("queue_size must be at least 1, got %d", cfg.QueueSize)
+	}
+	if cfg.SubmitTimeout <= 0 {
+		invalid("submit_timeout must be positive, got %v", cfg.SubmitTimeout)
+	}
+	if cfg.MemoryBudget < 0 {
+		invalid("memory_budget must not be negative, got %d", cfg.MemoryBudget)
+	}
+	if cfg.Autoscale.MinWorkers < 0 || cfg.Autoscale.MaxWorkers < 0 {
+		invalid("autoscale.min_workers and autoscale.max_workers must not be negative, got %d and %d", cfg.Autoscale.MinWorkers, cfg.Autoscale.MaxWorkers)
+	} else if cfg.Autoscale.MaxWorkers > 0 && cfg.Autoscale.MinWorkers > cfg.Autoscale.MaxWorkers {
+		invalid("autoscale.min_workers must not exceed autoscale.max_workers, got %d and %d", cfg.Autoscale.MinWorkers, cfg.Autoscale.MaxWorkers)
+	}
+	if cfg.Autoscale.Interval < 0 || cfg.Autoscale.TargetWait < 0 {
+		invalid("autoscale.interval and autoscale.target_wait must not be negative, got %v and %v", cfg.Autoscale.Interval, cfg.Autoscale.TargetWait)
+	}
+	for _, name := range sortedKeys(cfg.Queues) {
+		queue := cfg.Queues[name]
+		if _, ok := utils.ParseJobType(name); !ok {
+			invalid("queues has an unknown job type %q, expected %s", name, jobTypeNames())
+		} else if queue.Capacity < 0 || queue.Weight < 0 {
+			invalid("queues.%s capacity and weight must not be negative, got %d and %d", name, queue.Capacity, queue.Weight)
+		}
+	}
+	if cfg.BreakerThreshold < 1 {
+		invalid("breaker_threshold must be at least 1, got %d", cfg.BreakerThreshold)
+	}
+	if cfg.BreakerTimeout <= 0 {
+		invalid("breaker_timeout must be positive, got %v", cfg.BreakerTimeout)
+	}
+	if cfg.Breaker.Window < 0 || cfg.Breaker.SlowCall < 0 {
+		invalid("breaker.window and breaker.slow_call must not be negative, got %v and %v", cfg.Breaker.Window, cfg.Breaker.SlowCall)
+	}
+	if cfg.Breaker.WindowSize < 0 || cfg.Breaker.HalfOpenProbes < 0 {
+		invalid("breaker.window_size and breaker.half_open_probes must not be negative, got %d and %d", cfg.Breaker.WindowSize, cfg.Breaker.HalfOpenProbes)
+	} else if cfg.Breaker.WindowSize > 0 && cfg.Breaker.WindowSize < cfg.BreakerThreshold {
+		invalid("breaker.window_size must be at least breaker_threshold, got %d and %d", cfg.Breaker.WindowSize, cfg.BreakerThreshold)
+	}
+	if cfg.Breaker.FailureRate < 0 || cfg.Breaker.FailureRate > 1 || cfg.Breaker.SlowCallRate < 0 || cfg.Breaker.SlowCallRate > 1 {
+		invalid("breaker.failure_rate and breaker.slow_call_rate must be between 0 and 1, got %v and %v", cfg.Breaker.FailureRate, cfg.Breaker.SlowCallRate)
+	}
+	if cfg.Retention.MaxAge < 0 {
+		invalid("retention.max_age must not be negative, got %v", cfg.Retention.MaxAge)
+	}
+	for _, level := range sortedKeys(cfg.Retention.LevelMaxAge) {
+		if age := cfg.Retention.LevelMaxAge[level]; age < 0 {
+			invalid("retention.level_max_age of %s must not be negative, got %v", level, age)
+		}
+	}
+	if cfg.Retention.MaxSize < 0 {
+		invalid("retention.max_size must not be negative, got %d", cfg.Retention.MaxSize)
+	}
+	if cfg.Retention.Enabled() && cfg.RetentionInterval <= 0 {
+		invalid("retention_interval must be positive, got %v", cfg.RetentionInterval)
+	}
+	switch cfg.ArchiveCompression {
+	case "", archive.CompressionGzip, archive.CompressionZstd:
+	default:
+		invalid("archive_compression must be %q or %q, got %q", archive.CompressionGzip, archive.CompressionZstd, cfg.ArchiveCompression)
+	}
+
+	if cfg.QueryTimeout <= 0 {
+		invalid("query_timeout must be positive, got %v", cfg.QueryTimeout)
+	}
+	for _, route := range sortedKeys(cfg.RouteTimeouts) {
+		if !slices.Contains(api.QueryRoutes, route) {
+			invalid("route_timeouts has an unknown route %q, expected one of %s", route, strings.Join(api.QueryRoutes, ", "))
+		} else if timeout := cfg.RouteTimeouts[route]; timeout <= 0 {
+			invalid("route_timeouts of %s must be positive, got %v", route, timeout)
+		}
+	}
+	for _, origin := range cfg.TailOrigins {
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || u.Scheme == "" || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "") {
+			invalid("tail_origins must hold origins like https://dashboard.example.com or \"*\", got %q", origin)
+		}
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		invalid("shutdown_timeout must be positive, got %v", cfg.ShutdownTimeout)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Print writes the configuration as YAML, hiding the password of the DSN
+func Print(w io.Writer, cfg api.Config) error {
+	if dsn, err := url.Parse(cfg.DSN); err == nil {
+		cfg.DSN = dsn.Redacted()
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(cfg); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func stringValue(field func(*api.Config) *string) func(*api.Config, string) error {
+	return func(cfg *api.Config, value string) error {
+		*field(cfg) = value
+		return nil
+	}
+}
+
+func intValue(field func(*api.Config) *int) func(*api.Config, string) error {
+	return func(cfg *api.Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		*field(cfg) = n
+		return nil
+	}
+}
+
+func int64Value(field func(*api.Config) *int64) func(*api.Config, string) error {
+	return func(cfg *api.Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		*field(cfg) = n
+		return nil
+	}
+}
+
+func floatValue(field func(*api.Config) *float64) func(*api.Config, string) error {
+	return func(cfg *api.Config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("not a number")
+		}
+		*field(cfg) = f
+		return nil
+	}
+}
+
+func durationValue(field func(*api.Config) *time.Duration) func(*api.Config, string) error {
+	return func(cfg *api.Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.New("not a duration, e.g. 10s or 720h")
+		}
+		*field(cfg) = d
+		return nil
+	}
+}
+
+// listValue parses a comma separated list, replacing the values already set
+func listValue(field func(*api.Config) *[]string) func(*api.Config, string) error {
+	return func(cfg *api.Config, value string) error {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(cfg) = list
+		return nil
+	}
+}
+
+// levelDurationsValue parses comma separated LEVEL=duration pairs, replacing the levels already set
+func levelDurationsValue(field func(*api.Config) *map[string]time.Duration) func(*api.Config, string) error {
+	return func(cfg *api.Config, value string) error {
+		levels, err := parseDurations(value, "LEVEL", strings.ToUpper)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = levels
+		return nil
+	}
+}
+
+// routeDurationsValue parses comma separated /route=duration pairs, replacing the routes already set
+func routeDurationsValue(field func(*api.Config) *map[string]time.Duration) func(*api.Config, string) error {
+	return func(cfg *api.Config, value string) error {
+		routes, err := parseDurations(value, "/route", func(route string) string { return route })
+		if err != nil {
+			return err
+		}
+		*field(cfg) = routes
+		return nil
+	}
+}
+
+// parseDurations parses comma separated key=duration pairs, normalizing the keys
+func parseDurations(value, keyName string, normalize func(string) string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, duration, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("expected %s=duration, got %q", keyName, pair)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(duration))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a duration", duration)
+		}
+		durations[normalize(strings.TrimSpace(key))] = d
+	}
+	return durations, nil
+}
+
+// queueValue parses comma separated type=value pairs into a field of the queue of each job type,
+// keeping the other fields of the queues
+func queueValue(field func(*internal.QueueConfig) *int) func(*api.Config, string) error {
+	return func(cfg *api.Config, value string) error {
+		queues := maps.Clone(cfg.Queues)
+		if queues == nil {
+			queues = make(map[string]internal.QueueConfig)
+		}
+		for _, pair := range strings.Split(value, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			name, n, ok := strings.Cut(pair, "=")
+			if !ok || strings.TrimSpace(name) == "" {
+				return fmt.Errorf("expected type=value, got %q", pair)
+			}
+			parsed, err := strconv.Atoi(strings.TrimSpace(n))
+			if err != nil {
+				return fmt.Errorf("%q is not an integer", n)
+			}
+			name = strings.ToLower(strings.TrimSpace(name))
+			queue := queues[name]
+			*field(&queue) = parsed
+			queues[name] = queue
+		}
+		cfg.Queues = queues
+		return nil
+	}
+}
+
+func jobTypeNames() string {
+	names := make([]string, len(utils.JobTypes))
+	for i, jobType := range utils.JobTypes {
+		names[i] = strconv.Quote(jobType.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// scaleUpSaturation is the saturation of the fullest queue at which the autoscaler grows the pool
+const scaleUpSaturation = 0.5
+
+// AutoscalePolicy bounds the worker pool and decides when it grows or shrinks, autoscaling is disabled unless MaxWorkers is set
+type AutoscalePolicy struct {
+	MinWorkers int           `yaml:"min_workers"` // The pool never shrinks below this, at least 1
+	MaxWorkers int           `yaml:"max_workers"` // The pool never grows beyond this, 0 disables autoscaling
+	Interval   time.Duration `yaml:"interval"`    // How often the pool size is reconsidered
+	TargetWait time.Duration `yaml:"target_wait"` // The pool grows while jobs wait longer than this for a worker on average
+}
+
+// Enabled reports whether the policy resizes the pool
+func (p AutoscalePolicy) Enabled() bool {
+	return p.MaxWorkers > 0
+}
+
+// ScaleDecision describes a single evaluation of the autoscaler
+type ScaleDecision struct {
+	At          time.Time `json:"at"`
+	From        int       `json:"from"`
+	To          int       `json:"to"`
+	Queued      int       `json:"queued"`
+	AverageWait string    `json:"average_wait"` // Of the jobs picked up since the previous decision
+	Reason      string    `json:"reason"`
+}
+
+// AutoscaleStatus is the autoscaling policy along with its last decision
+type AutoscaleStatus struct {
+	Enabled      bool           `json:"enabled"`
+	Paused       bool           `json:"paused"` // The size was overridden, autoscaling waits to be resumed
+	MinWorkers   int            `json:"min_workers"`
+	MaxWorkers   int            `json:"max_workers"`
+	Interval     string         `json:"interval"`
+	TargetWait   string         `json:"target_wait"`
+	LastDecision *ScaleDecision `json:"last_decision,omitempty"`
+}
+
+// Autoscaler periodically grows the worker pool while jobs queue up or wait too long and shrinks it while idle.
+// A nil *Autoscaler is valid and never resizes anything.
+type Autoscaler struct {
+	pool *WorkerPool
+
+	mu     sync.Mutex // Serializes decisions and guards the fields below
+	policy AutoscalePolicy
+	paused bool
+	last   *ScaleDecision
+	ticker *time.Ticker
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewAutoscaler creates an autoscaler resizing pool within policy once started
+func NewAutoscaler(pool *WorkerPool, policy AutoscalePolicy) *Autoscaler {
+	return &Autoscaler{
+		pool:   pool,
+		policy: policy,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start reconsiders the pool size every interval until Stop is called
+func (a *Autoscaler) Start() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.ticker = time.NewTicker(a.policy.Interval)
+	a.mu.Unlock()
+	go func() {
+		defer close(a.done)
+		defer a.ticker.Stop()
+		for {
+			select {
+			case <-a.ticker.C:
+				a.Scale()
+			case <-a.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops resizing the pool, waiting for a running decision to finish
+func (a *Autoscaler) Stop() {
+	if a == nil {
+		return
+	}
+	close(a.quit)
+	<-a.done
+}
+
+// Scale reconsiders the pool size once, from the queue saturation and the average wait of the jobs since the last call
+func (a *Autoscaler) Scale() ScaleDecision {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	size := a.pool.Size()
+	queued, saturation := a.pool.QueuedTasks(), a.pool.Saturation()
+	wait := a.pool.takeAverageWait()
+	decision := ScaleDecision{At: time.Now().UTC(), From: size, To: size, Queued: queued, AverageWait: wait.String()}
+
+	switch {
+	case !a.policy.Enabled():
+		decision.Reason = "disabled"
+	case a.paused:
+		decision.Reason = "paused"
+	case saturation >= scaleUpSaturation || wait > a.policy.TargetWait:
+		// Grow by a quarter to catch up with bursts quickly
+		decision.To = size + max(1, size/4)
+		decision.Reason = "jobs are waiting"
+	case queued == 0 && wait <= a.policy.TargetWait/4:
+		decision.To = size - 1
+		decision.Reason = "pool is idle"
+	default:
+		decision.Reason = "steady"
+	}
+	if a.policy.Enabled() && !a.paused {
+		decision.To = min(max(decision.To, a.policy.MinWorkers, 1), a.policy.MaxWorkers)
+	}
+
+	if decision.To != size {
+		fmt.Printf("Autoscaling workers %d -> %d: %s, %d queued, %v average wait\n", size, decision.To, decision.Reason, queued, wait)
+		a.pool.Resize(decision.To)
+	}
+	a.last = &decision
+	return decision
+}
+
+// Override resizes the pool to n workers, within the bounds of the policy or up to MaxPoolSize while it is disabled,
+// and pauses autoscaling until Resume is called
+func (a *Autoscaler) Override(n int) error {
+	if a == nil {
+		return errors.New("autoscaling is not configured")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	lowest, highest := max(a.policy.MinWorkers, 1), MaxPoolSize
+	if a.policy.Enabled() {
+		highest = a.policy.MaxWorkers
+	}
+	if n < lowest || n > highest {
+		return fmt.Errorf("worker pool size must be between %d and %d, got %d", lowest, highest, n)
+	}
+	a.paused = true
+	a.pool.Resize(n)
+	return nil
+}
+
+// Pause stops autoscaling, keeping the current size, until Resume is called
+func (a *Autoscaler) Pause() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.paused = true
+}
+
+// Resume resumes autoscaling after Override or Pause
+func (a *Autoscaler) Resume() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.paused = false
+}
+
+// SetPolicy replaces the policy, taking effect from the next decision
+func (a *Autoscaler) SetPolicy(policy AutoscalePolicy) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.ticker != nil {
+		switch {
+		case !policy.Enabled() || policy.Interval <= 0:
+			// Nothing to decide until autoscaling is enabled again
+			a.ticker.Stop()
+		case policy.Interval != a.policy.Interval || !a.policy.Enabled():
+			a.ticker.Reset(policy.Interval)
+		}
+	}
+	a.policy = policy
+}
+
+// Status reports the policy and the last decision
+func (a *Autoscaler) Status() AutoscaleStatus {
+	if a == nil {
+		return AutoscaleStatus{}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return AutoscaleStatus{
+		Enabled:      a.policy.Enabled(),
+		Paused:       a.paused,
+		MinWorkers:   a.policy.MinWorkers,
+		MaxWorkers:   a.policy.MaxWorkers,
+		Interval:     a.policy.Interval.String(),
+		TargetWait:   a.policy.TargetWait.String(),
+		LastDecision: a.last,
+	}
+}
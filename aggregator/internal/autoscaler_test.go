@@ -0,0 +1,49 @@
+package internal_test
+
+import (
+	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"testing"
+	"time"
+)
+
+// TestAutoscaler_Scale tests that the pool grows while jobs queue up, shrinks while idle and stays put when overridden.
+func TestAutoscaler_Scale(t *testing.T) {
+	store := &blockingStore{LogStore: storage.NewMemoryStorage(), started: make(chan struct{}, 10), release: make(chan struct{})}
+	wp := internal.NewWorkerPool(1, map[utils.JobType]internal.QueueConfig{utils.StoreJob: {Capacity: 4}}, store, nil, nil)
+	defer wp.Stop()
+	autoscaler := internal.NewAutoscaler(wp, internal.AutoscalePolicy{MinWorkers: 1, MaxWorkers: 2, Interval: time.Hour, TargetWait: time.Hour})
+
+	for i := 0; i < 3; i++ {
+		wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: testBatch("queued")})
+	}
+	<-store.started
+	if decision := autoscaler.Scale(); decision.To != 2 || wp.Size() != 2 {
+		t.Errorf("Expected the pool to grow to 2 workers, got %+v", decision)
+	}
+	// Bounded by the max workers
+	if decision := autoscaler.Scale(); decision.To != 2 {
+		t.Errorf("Expected the pool to stay at 2 workers, got %+v", decision)
+	}
+
+	close(store.release)
+	deadline := time.Now().Add(time.Second)
+	for wp.QueuedTasks() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if decision := autoscaler.Scale(); decision.To != 1 || decision.Reason != "pool is idle" {
+		t.Errorf("Expected the idle pool to shrink to 1 worker, got %+v", decision)
+	}
+
+	if err := autoscaler.Override(0); err == nil {
+		t.Error("Expected an empty pool to be rejected")
+	}
+	if err := autoscaler.Override(3); err == nil || wp.Size() != 1 {
+		t.Errorf("Expected a size over the max workers to be rejected, got %v with %d workers", err, wp.Size())
+	}
+	autoscaler.Override(2)
+	if decision := autoscaler.Scale(); decision.To != 2 || decision.Reason != "paused" || !autoscaler.Status().Paused {
+		t.Errorf("Expected the overridden size to be kept, got %+v", decision)
+	}
+}
@@ -1,68 +1,410 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
+	"log-aggregator/aggregator/metrics"
 	"sync"
 	"time"
 )
 
-// CircuitBreaker struct
+// ErrCircuitOpen is returned for the calls rejected while the circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// OpenError rejects a call while the circuit breaker is open, telling when calls are let through again.
+// It matches ErrCircuitOpen.
+type OpenError struct {
+	Breaker    string
+	RetryAfter time.Duration // 0 when the breaker is half-open with all its probes under way
+}
+
+func (e *OpenError) Error() string {
+	return ErrCircuitOpen.Error()
+}
+
+func (e *OpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// BreakerState is the state of a circuit breaker
+type BreakerState string
+
+const (
+	StateClosed   BreakerState = "closed"    // Calls go through and their outcomes are counted
+	StateOpen     BreakerState = "open"      // Calls are rejected until the timeout passes
+	StateHalfOpen BreakerState = "half-open" // A few probe calls decide whether the breaker closes or opens again
+)
+
+// defaultBreakerName labels the metrics of a breaker created without a name
+const defaultBreakerName = "default"
+
+// timeWindowBuckets is the number of slices a time window is counted in, outcomes expire a slice at a time
+const timeWindowBuckets = 10
+
+// BreakerPolicy decides when a circuit breaker opens and how it recovers. The outcomes of the calls are counted
+// over a rolling window, either the last WindowSize calls or the calls of the last Window, and the breaker opens
+// once the window holds at least Threshold calls and the share of failed or slow calls reaches its rate.
+// Left empty, the breaker opens after Threshold consecutive failures and a single successful probe closes it.
+type BreakerPolicy struct {
+	Threshold      int           `yaml:"-"`                // Calls in the window before it can open the breaker, set by breaker_threshold
+	Timeout        time.Duration `yaml:"-"`                // How long the breaker stays open, set by breaker_timeout
+	Window         time.Duration `yaml:"window"`           // Span of a time window, the window counts calls instead when 0
+	WindowSize     int           `yaml:"window_size"`      // Calls in a count window, at least Threshold
+	FailureRate    float64       `yaml:"failure_rate"`     // Share of failed calls opening the breaker, 1 by default
+	SlowCall       time.Duration `yaml:"slow_call"`        // Calls taking longer than this are slow, disabled when 0
+	SlowCallRate   float64       `yaml:"slow_call_rate"`   // Share of slow calls opening the breaker, 1 by default
+	HalfOpenProbes int           `yaml:"half_open_probes"` // Calls let through while half-open, all must succeed to close, 1 by default
+}
+
+// withDefaults fills the settings left empty with their defaults
+func (p BreakerPolicy) withDefaults() BreakerPolicy {
+	p.Threshold = max(p.Threshold, 1)
+	p.WindowSize = max(p.WindowSize, p.Threshold)
+	if p.FailureRate <= 0 || p.FailureRate > 1 {
+		p.FailureRate = 1
+	}
+	if p.SlowCallRate <= 0 || p.SlowCallRate > 1 {
+		p.SlowCallRate = 1
+	}
+	p.HalfOpenProbes = max(p.HalfOpenProbes, 1)
+	return p
+}
+
+// BreakerCounts are the counters of a circuit breaker: the calls of its current window, the probes let through
+// while half-open, and the totals since it was created
+type BreakerCounts struct {
+	State          BreakerState `json:"state"`
+	Calls          int          `json:"calls"`
+	Failures       int          `json:"failures"`
+	SlowCalls      int          `json:"slow_calls"`
+	Probes         int          `json:"probes"`
+	TotalCalls     int64        `json:"total_calls"`
+	TotalFailures  int64        `json:"total_failures"`
+	TotalSlowCalls int64        `json:"total_slow_calls"`
+	TotalRejected  int64        `json:"total_rejected"`
+}
+
+// transition is a state change whose listeners haven't been told yet
+type transition struct {
+	from, to BreakerState
+}
+
+// CircuitBreaker rejects calls to a failing service for a while, counting the outcomes of the calls over a
+// rolling window and probing the service with a few calls before closing again
 type CircuitBreaker struct {
-	mu               sync.Mutex
-	failureCount     int
-	failureThreshold int
-	state            string // "closed", "open", "half-open"
-	resetTimeout     time.Duration
-	lastFailureTime  time.Time
+	name string // Labels the metrics of the breaker
+
+	mu             sync.Mutex
+	policy         BreakerPolicy
+	state          BreakerState
+	generation     uint64 // Bumped on every transition, the outcomes of calls allowed before it are ignored
+	window         *window
+	openedAt       time.Time
+	probes         int // Probes let through since the breaker went half-open
+	probeSuccesses int
+	counts         BreakerCounts // Totals, the window and probes are counted separately
+	listeners      []func(name string, from, to BreakerState)
+	pending        []transition
 }
 
-// NewCircuitBreaker creates a new circuit breaker
+// NewCircuitBreaker creates a new circuit breaker opening after threshold consecutive failures
 func NewCircuitBreaker(threshold int, timeout time.Duration) *CircuitBreaker {
+	return NewNamedCircuitBreaker(defaultBreakerName, threshold, timeout)
+}
+
+// NewNamedCircuitBreaker creates a new circuit breaker like NewCircuitBreaker, labelling its metrics with the name
+func NewNamedCircuitBreaker(name string, threshold int, timeout time.Duration) *CircuitBreaker {
+	return NewCircuitBreakerWithPolicy(name, BreakerPolicy{Threshold: threshold, Timeout: timeout})
+}
+
+// NewCircuitBreakerWithPolicy creates a new circuit breaker opening and recovering as the policy says
+func NewCircuitBreakerWithPolicy(name string, policy BreakerPolicy) *CircuitBreaker {
+	policy = policy.withDefaults()
 	return &CircuitBreaker{
-		failureThreshold: threshold,
-		state:            "closed",
-		resetTimeout:     timeout,
+		name:   name,
+		policy: policy,
+		state:  StateClosed,
+		window: newWindow(policy, time.Now()),
+	}
+}
+
+// Permit lets a single call through the breaker. The outcome of the call is given back with Report,
+// or dropped with Release when it says nothing about the health of the guarded service.
+type Permit struct {
+	cb         *CircuitBreaker
+	generation uint64
+	start      time.Time
+}
+
+// Report counts the outcome of the call, slow when it took longer than the SlowCall of the policy
+func (p Permit) Report(err error) {
+	p.cb.report(p, err != nil, time.Since(p.start))
+}
+
+// Release gives the permit back without counting the outcome of the call
+func (p Permit) Release() {
+	p.cb.mu.Lock()
+	defer p.cb.unlock()
+	if p.generation == p.cb.generation && p.cb.state == StateHalfOpen {
+		p.cb.probes--
 	}
 }
 
-// Call executes the given function and handles the circuit breaker logic
+// Call executes the given function and handles the circuit breaker logic, other calls aren't held up while it runs
 func (cb *CircuitBreaker) Call(fn func() error) error {
+	permit, err := cb.Allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	permit.Report(err)
+	return err
+}
+
+// Allow lets a call through, failing with an OpenError while the breaker is open or all the probes
+// of a half-open breaker are under way
+func (cb *CircuitBreaker) Allow() (Permit, error) {
 	cb.mu.Lock()
-	defer cb.mu.Unlock()
+	defer cb.unlock()
+
+	now := time.Now()
+	cb.refresh(now)
+	if cb.state == StateOpen || (cb.state == StateHalfOpen && cb.probes >= cb.policy.HalfOpenProbes) {
+		fmt.Printf("Circuit breaker %s is %s, rejecting call\n", cb.name, cb.state)
+		cb.counts.TotalRejected++
+		metrics.CircuitBreakerRejections.Inc(cb.name)
+		var retryAfter time.Duration
+		if cb.state == StateOpen {
+			retryAfter = max(0, cb.policy.Timeout-now.Sub(cb.openedAt))
+		}
+		return Permit{}, &OpenError{Breaker: cb.name, RetryAfter: retryAfter}
+	}
+	if cb.state == StateHalfOpen {
+		cb.probes++
+	}
+	return Permit{cb: cb, generation: cb.generation, start: now}, nil
+}
+
+// report counts the outcome of a call let through by permit
+func (cb *CircuitBreaker) report(permit Permit, failed bool, elapsed time.Duration) {
+	cb.mu.Lock()
+	defer cb.unlock()
+
+	slow := cb.policy.SlowCall > 0 && elapsed > cb.policy.SlowCall
+	cb.counts.TotalCalls++
+	if failed {
+		cb.counts.TotalFailures++
+	}
+	if slow {
+		cb.counts.TotalSlowCalls++
+	}
+	// The breaker changed state since the call was let through
+	if permit.generation != cb.generation {
+		return
+	}
 
+	now := time.Now()
 	switch cb.state {
-	case "open":
-		if time.Since(cb.lastFailureTime) < cb.resetTimeout {
-			fmt.Println("Circuit breaker is open, rejecting call")
-			return fmt.Errorf("circuit breaker is open")
+	case StateClosed:
+		cb.window.add(now, failed, slow)
+		if cb.tripped(cb.window.sum(now)) {
+			cb.setState(StateOpen, now)
 		}
-		// Switch to half-open state if timeout has passed
-		cb.state = "half-open"
-	case "half-open":
-	}
-
-	// Execute our function and check for errors
-	if err := fn(); err != nil {
-		cb.failureCount++
-		cb.lastFailureTime = time.Now()
-		fmt.Printf("Call failed, failure count: %d\n", cb.failureCount)
-		if cb.failureCount >= cb.failureThreshold {
-			cb.state = "open"
+	case StateHalfOpen:
+		if failed || slow {
+			cb.setState(StateOpen, now)
+			return
+		}
+		cb.probeSuccesses++
+		if cb.probeSuccesses >= cb.policy.HalfOpenProbes {
+			cb.setState(StateClosed, now)
 		}
-		return err
 	}
+}
 
-	// Successful call resets the circuit breaker
-	cb.failureCount = 0
-	if cb.state == "half-open" {
-		cb.state = "closed" // Return to closed state
+// tripped reports whether the outcomes of the window open the breaker
+func (cb *CircuitBreaker) tripped(outcomes windowBucket) bool {
+	if outcomes.calls < cb.policy.Threshold {
+		return false
 	}
-	return nil
+	calls := float64(outcomes.calls)
+	return float64(outcomes.failures)/calls >= cb.policy.FailureRate ||
+		(cb.policy.SlowCall > 0 && float64(outcomes.slow)/calls >= cb.policy.SlowCallRate)
 }
 
-// State returns the current state of the circuit breaker
-func (cb *CircuitBreaker) State() string {
+// refresh moves an open breaker to half-open once its timeout passed, the caller holds the lock
+func (cb *CircuitBreaker) refresh(now time.Time) {
+	if cb.state == StateOpen && now.Sub(cb.openedAt) >= cb.policy.Timeout {
+		cb.setState(StateHalfOpen, now)
+	}
+}
+
+// setState moves to the state, counting the transition and starting the state afresh, the caller holds the lock
+func (cb *CircuitBreaker) setState(state BreakerState, now time.Time) {
+	if cb.state == state {
+		return
+	}
+	cb.pending = append(cb.pending, transition{from: cb.state, to: state})
+	cb.state = state
+	cb.generation++
+	cb.probes, cb.probeSuccesses = 0, 0
+	switch state {
+	case StateOpen:
+		cb.openedAt = now
+	case StateClosed:
+		cb.window.reset(now)
+	}
+	metrics.CircuitBreakerTransitions.Inc(cb.name, string(state))
+}
+
+// unlock releases the lock, then tells the listeners about the transitions made while holding it
+func (cb *CircuitBreaker) unlock() {
+	pending, listeners := cb.pending, cb.listeners
+	cb.pending = nil
+	cb.mu.Unlock()
+	for _, t := range pending {
+		for _, listener := range listeners {
+			listener(cb.name, t.from, t.to)
+		}
+	}
+}
+
+// OnStateChange registers a listener called with the name of the breaker on every state change.
+// Listeners run once the breaker is unlocked and may call its methods.
+func (cb *CircuitBreaker) OnStateChange(listener func(name string, from, to BreakerState)) {
 	cb.mu.Lock()
 	defer cb.mu.Unlock()
+	cb.listeners = append(cb.listeners, listener)
+}
+
+// State returns the current state of the circuit breaker
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.unlock()
+	cb.refresh(time.Now())
 	return cb.state
 }
+
+// Counts returns the counters of the circuit breaker
+func (cb *CircuitBreaker) Counts() BreakerCounts {
+	cb.mu.Lock()
+	defer cb.unlock()
+	now := time.Now()
+	cb.refresh(now)
+	counts := cb.counts
+	counts.State = cb.state
+	if cb.state == StateClosed {
+		outcomes := cb.window.sum(now)
+		counts.Calls, counts.Failures, counts.SlowCalls = outcomes.calls, outcomes.failures, outcomes.slow
+	}
+	counts.Probes = cb.probes
+	return counts
+}
+
+// Name returns the name the breaker was created with
+func (cb *CircuitBreaker) Name() string {
+	return cb.name
+}
+
+// RetryAfter returns how long calls keep being rejected, 0 when they are let through
+func (cb *CircuitBreaker) RetryAfter() time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state != StateOpen {
+		return 0
+	}
+	return max(0, cb.policy.Timeout-time.Since(cb.openedAt))
+}
+
+// Policy returns the policy of the breaker with its defaults filled in
+func (cb *CircuitBreaker) Policy() BreakerPolicy {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.policy
+}
+
+// Configure changes the policy, keeping the current state. The window starts afresh when its shape changes.
+func (cb *CircuitBreaker) Configure(policy BreakerPolicy) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	policy = policy.withDefaults()
+	if policy.Window != cb.policy.Window || (policy.Window == 0 && policy.WindowSize != cb.policy.WindowSize) {
+		cb.window = newWindow(policy, time.Now())
+	}
+	cb.policy = policy
+}
+
+// windowBucket counts the outcomes of the calls of a slice of the window
+type windowBucket struct {
+	calls, failures, slow int
+}
+
+// window counts the outcomes of the latest calls in a ring of buckets, one per call for a count window
+// or one per slice of the span for a time window
+type window struct {
+	buckets    []windowBucket
+	head       int           // Bucket counting the latest outcomes
+	resolution time.Duration // Span of a bucket, 0 for a count window
+	headStart  time.Time     // When the head bucket started counting, for a time window
+}
+
+// newWindow creates the window described by the policy
+func newWindow(policy BreakerPolicy, now time.Time) *window {
+	if policy.Window > 0 {
+		resolution := max(policy.Window/timeWindowBuckets, 1)
+		return &window{buckets: make([]windowBucket, timeWindowBuckets), resolution: resolution, headStart: now}
+	}
+	return &window{buckets: make([]windowBucket, policy.WindowSize)}
+}
+
+// add counts the outcome of a call
+func (w *window) add(now time.Time, failed, slow bool) {
+	if w.resolution == 0 {
+		// Each call takes the place of the oldest one
+		w.head = (w.head + 1) % len(w.buckets)
+		w.buckets[w.head] = windowBucket{}
+	} else {
+		w.advance(now)
+	}
+	bucket := &w.buckets[w.head]
+	bucket.calls++
+	if failed {
+		bucket.failures++
+	}
+	if slow {
+		bucket.slow++
+	}
+}
+
+// sum returns the outcomes counted in the window
+func (w *window) sum(now time.Time) windowBucket {
+	if w.resolution > 0 {
+		w.advance(now)
+	}
+	var total windowBucket
+	for _, bucket := range w.buckets {
+		total.calls += bucket.calls
+		total.failures += bucket.failures
+		total.slow += bucket.slow
+	}
+	return total
+}
+
+// advance moves the head of a time window to the bucket covering now, clearing the buckets that expired
+func (w *window) advance(now time.Time) {
+	steps := int(now.Sub(w.headStart) / w.resolution)
+	if steps <= 0 {
+		return
+	}
+	for i := 0; i < min(steps, len(w.buckets)); i++ {
+		w.head = (w.head + 1) % len(w.buckets)
+		w.buckets[w.head] = windowBucket{}
+	}
+	w.headStart = w.headStart.Add(time.Duration(steps) * w.resolution)
+}
+
+// reset forgets every outcome
+func (w *window) reset(now time.Time) {
+	clear(w.buckets)
+	w.headStart = now
+}
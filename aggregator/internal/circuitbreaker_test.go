@@ -1,8 +1,10 @@
 package internal_test
 
 import (
+	"errors"
 	"fmt"
 	"log-aggregator/aggregator/internal"
+	"sync"
 	"testing"
 	"time"
 )
@@ -140,3 +142,105 @@ func TestCircuitBreaker_OpenStateAfterFailure(t *testing.T) {
 		t.Errorf("Expected circuit breaker state to be 'open', got '%s'", cb.State())
 	}
 }
+
+// TestCircuitBreaker_FailureRate tests that the breaker opens once the share of failed calls in its window reaches the rate.
+func TestCircuitBreaker_FailureRate(t *testing.T) {
+	cb := internal.NewCircuitBreakerWithPolicy("test", internal.BreakerPolicy{Threshold: 4, Timeout: time.Minute, WindowSize: 6, FailureRate: 0.5})
+	fail := func() error { return fmt.Errorf("simulated error") }
+	succeed := func() error { return nil }
+
+	// Failures short of the rate, then too few calls in the window
+	for _, fn := range []func() error{succeed, succeed, fail, succeed, succeed, fail} {
+		cb.Call(fn)
+	}
+	if state := cb.State(); state != internal.StateClosed {
+		t.Fatalf("Expected the breaker to stay closed at 2 of 6 failures, got %s", state)
+	}
+	// The oldest successes slide out of the window
+	cb.Call(fail)
+	if state := cb.State(); state != internal.StateOpen {
+		t.Fatalf("Expected the breaker to open at 3 of 6 failures, got %s", state)
+	}
+	counts := cb.Counts()
+	if counts.TotalCalls != 7 || counts.TotalFailures != 3 {
+		t.Errorf("Expected 3 failures out of 7 calls, got %+v", counts)
+	}
+	if err := cb.Call(succeed); !errors.Is(err, internal.ErrCircuitOpen) || cb.Counts().TotalRejected != 1 {
+		t.Errorf("Expected the call to be rejected, got %v", err)
+	}
+}
+
+// TestCircuitBreaker_SlowCalls tests that slow calls open the breaker even when they succeed.
+func TestCircuitBreaker_SlowCalls(t *testing.T) {
+	cb := internal.NewCircuitBreakerWithPolicy("test", internal.BreakerPolicy{Threshold: 2, Timeout: time.Minute, SlowCall: 10 * time.Millisecond})
+	for i := 0; i < 2; i++ {
+		cb.Call(func() error {
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		})
+	}
+	if state := cb.State(); state != internal.StateOpen {
+		t.Errorf("Expected slow calls to open the breaker, got %s", state)
+	}
+}
+
+// TestCircuitBreaker_TimeWindow tests that failures older than the time window are forgotten.
+func TestCircuitBreaker_TimeWindow(t *testing.T) {
+	cb := internal.NewCircuitBreakerWithPolicy("test", internal.BreakerPolicy{Threshold: 2, Timeout: time.Minute, Window: 50 * time.Millisecond})
+	cb.Call(func() error { return fmt.Errorf("simulated error") })
+	time.Sleep(80 * time.Millisecond)
+	cb.Call(func() error { return fmt.Errorf("simulated error") })
+	if counts := cb.Counts(); counts.State != internal.StateClosed || counts.Calls != 1 {
+		t.Errorf("Expected only the latest failure in the window, got %+v", counts)
+	}
+}
+
+// TestCircuitBreaker_HalfOpenProbes tests that a half-open breaker lets a limited number of concurrent probes through,
+// telling the listeners about every transition.
+func TestCircuitBreaker_HalfOpenProbes(t *testing.T) {
+	cb := internal.NewCircuitBreakerWithPolicy("test", internal.BreakerPolicy{Threshold: 1, Timeout: 50 * time.Millisecond, HalfOpenProbes: 2})
+	var mu sync.Mutex
+	var transitions []string
+	cb.OnStateChange(func(name string, from, to internal.BreakerState) {
+		mu.Lock()
+		defer mu.Unlock()
+		transitions = append(transitions, fmt.Sprintf("%s %s->%s", name, from, to))
+	})
+	cb.Call(func() error { return fmt.Errorf("simulated error") })
+	time.Sleep(80 * time.Millisecond)
+
+	// Both probes are let through while they run, the breaker doesn't hold them up, a third is rejected
+	release := make(chan struct{})
+	var started, done sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		started.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			cb.Call(func() error {
+				started.Done()
+				<-release
+				return nil
+			})
+		}()
+	}
+	started.Wait()
+	if err := cb.Call(func() error { return nil }); !errors.Is(err, internal.ErrCircuitOpen) {
+		t.Errorf("Expected a third probe to be rejected, got %v", err)
+	}
+	if counts := cb.Counts(); counts.State != internal.StateHalfOpen || counts.Probes != 2 {
+		t.Errorf("Expected 2 probes of a half-open breaker, got %+v", counts)
+	}
+	close(release)
+	done.Wait()
+
+	if state := cb.State(); state != internal.StateClosed {
+		t.Errorf("Expected the successful probes to close the breaker, got %s", state)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"test closed->open", "test open->half-open", "test half-open->closed"}
+	if fmt.Sprint(transitions) != fmt.Sprint(want) {
+		t.Errorf("Expected transitions %v, got %v", want, transitions)
+	}
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"context"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+)
+
+// Names of the circuit breakers guarding each class of storage operations
+const (
+	BreakerInsert = "insert"
+	BreakerQuery  = "query"
+)
+
+// GuardedStore is a LogStore whose inserts and queries each go through their own circuit breaker,
+// failing fast with ErrCircuitOpen while it is open. The workers report the outcome of the operations let through,
+// canceled operations and invalid queries aren't failures of the storage.
+type GuardedStore struct {
+	storage.LogStore
+	insert *CircuitBreaker
+	query  *CircuitBreaker
+}
+
+// NewGuardedStore guards the inserts of store with the insert breaker and its queries with the query breaker
+func NewGuardedStore(store storage.LogStore, insert, query *CircuitBreaker) *GuardedStore {
+	return &GuardedStore{LogStore: store, insert: insert, query: query}
+}
+
+// InsertLogMessages stores the logs unless the insert breaker is open
+func (s *GuardedStore) InsertLogMessages(ctx context.Context, logs []utils.LogMessage) error {
+	return guard(ctx, s.insert, func() error {
+		return s.LogStore.InsertLogMessages(ctx, logs)
+	})
+}
+
+// GetLogMessages retrieves the logs unless the query breaker is open
+func (s *GuardedStore) GetLogMessages(ctx context.Context, query utils.LogQuery) ([]utils.LogMessage, error) {
+	var logs []utils.LogMessage
+	err := guard(ctx, s.query, func() error {
+		var err error
+		logs, err = s.LogStore.GetLogMessages(ctx, query)
+		return err
+	})
+	return logs, err
+}
+
+// GetLogStats counts the logs unless the query breaker is open
+func (s *GuardedStore) GetLogStats(ctx context.Context, query utils.StatsQuery) ([]utils.StatsBucket, error) {
+	var buckets []utils.StatsBucket
+	err := guard(ctx, s.query, func() error {
+		var err error
+		buckets, err = s.LogStore.GetLogStats(ctx, query)
+		return err
+	})
+	return buckets, err
+}
+
+// guard runs op unless the breaker rejects it, reporting the successes and storage failures to the breaker
+func guard(ctx context.Context, cb *CircuitBreaker, op func() error) error {
+	permit, err := cb.Allow()
+	if err != nil {
+		return err
+	}
+	err = op()
+	switch errorKind(ctx, err) {
+	case utils.ErrorNone, utils.ErrorStorage:
+		permit.Report(err)
+	default:
+		permit.Release()
+	}
+	return err
+}
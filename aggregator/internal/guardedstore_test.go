@@ -0,0 +1,73 @@
+package internal_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"testing"
+	"time"
+)
+
+// TestGuardedStore_Breakers tests that only storage failures trip a breaker, and only the one of the failing operation.
+func TestGuardedStore_Breakers(t *testing.T) {
+	ctx := context.Background()
+	failing := &failingStore{LogStore: storage.NewMemoryStorage()}
+	insert := internal.NewNamedCircuitBreaker(internal.BreakerInsert, 1, time.Minute)
+	query := internal.NewNamedCircuitBreaker(internal.BreakerQuery, 1, time.Minute)
+	store := internal.NewGuardedStore(failing, insert, query)
+
+	// Invalid queries and canceled operations aren't the storage's fault
+	failing.err = fmt.Errorf("invalid field name %q: %w", "$where", storage.ErrInvalidQuery)
+	store.GetLogMessages(ctx, utils.LogQuery{})
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	failing.err = context.Canceled
+	store.GetLogMessages(canceled, utils.LogQuery{})
+	if state := query.State(); state != "closed" {
+		t.Fatalf("Expected the query breaker to stay closed, got %s", state)
+	}
+
+	failing.err = errors.New("server selection timeout")
+	store.GetLogMessages(ctx, utils.LogQuery{})
+	if state := query.State(); state != "open" {
+		t.Fatalf("Expected the query breaker to open, got %s", state)
+	}
+
+	failing.err = nil
+	if _, err := store.GetLogMessages(ctx, utils.LogQuery{}); !errors.Is(err, internal.ErrCircuitOpen) {
+		t.Errorf("Expected queries to be rejected, got %v", err)
+	}
+	if err := store.InsertLogMessages(ctx, testBatch("guarded")); err != nil {
+		t.Errorf("Expected inserts to go through, got %v", err)
+	}
+	if state := insert.State(); state != "closed" {
+		t.Errorf("Expected the insert breaker to stay closed, got %s", state)
+	}
+}
+
+// TestGuardedStore_HoldsBatches tests that batches turned away by the open insert breaker are stored once it lets calls through again.
+func TestGuardedStore_HoldsBatches(t *testing.T) {
+	memory := storage.NewMemoryStorage()
+	insert := internal.NewNamedCircuitBreaker(internal.BreakerInsert, 1, 100*time.Millisecond)
+	query := internal.NewNamedCircuitBreaker(internal.BreakerQuery, 1, 100*time.Millisecond)
+	wp := internal.NewWorkerPool(1, nil, internal.NewGuardedStore(memory, insert, query), nil, nil)
+	defer wp.Stop()
+	insert.Call(func() error { return errors.New("storage down") })
+
+	stored := make(chan utils.JobResult, 1)
+	wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: testBatch("held"), OnDone: func(result utils.JobResult) { stored <- result }})
+	select {
+	case result := <-stored:
+		if result.Err != nil || result.Stored != 1 {
+			t.Errorf("Expected the held batch to be stored, got %+v", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the held batch to be stored once the breaker half-opened")
+	}
+	if state := insert.State(); state != internal.StateClosed {
+		t.Errorf("Expected the stored batch to close the breaker, got %s", state)
+	}
+}
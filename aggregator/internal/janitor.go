@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log-aggregator/aggregator/archive"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"sync"
+	"time"
+)
+
+// PurgeReport describes a single run of the janitor
+type PurgeReport struct {
+	StartedAt time.Time `json:"started_at"`
+	Duration  string    `json:"duration"`
+	Archived  []string  `json:"archived,omitempty"` // Archives the expired logs were written to before deletion
+	Expired   int64     `json:"expired"`            // Logs deleted for being older than their level's max age
+	Trimmed   int64     `json:"trimmed"`            // Logs deleted to get under the max size
+	Error     string    `json:"error,omitempty"`
+}
+
+// RetentionStatus is the retention policy along with the state of its enforcement
+type RetentionStatus struct {
+	Enabled     bool              `json:"enabled"`
+	MaxAge      string            `json:"max_age,omitempty"`
+	LevelMaxAge map[string]string `json:"level_max_age,omitempty"`
+	MaxSize     int64             `json:"max_size,omitempty"`
+	Archiving   bool              `json:"archiving"`
+	Size        int64             `json:"size"`
+	Interval    string            `json:"interval,omitempty"`
+	LastPurge   *PurgeReport      `json:"last_purge,omitempty"`
+	NextPurge   *time.Time        `json:"next_purge,omitempty"`
+}
+
+// Janitor periodically deletes the logs the retention policy no longer keeps.
+// A nil *Janitor is valid and never deletes anything.
+type Janitor struct {
+	store    storage.LogStore
+	policy   storage.RetentionPolicy
+	interval time.Duration
+	archiver *archive.Archiver // Expired logs are archived before deletion when set
+
+	purgeMu   sync.Mutex // Serializes purges, which run without holding mu
+	mu        sync.Mutex // Guards the fields below, along with policy and interval
+	lastPurge *PurgeReport
+	nextPurge time.Time
+	ticker    *time.Ticker
+
+	ctx    context.Context // Canceled by Stop, aborting a running purge
+	cancel context.CancelFunc
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// NewJanitor creates a janitor enforcing policy on store every interval once started,
+// archiving expired logs first unless archiver is nil
+func NewJanitor(store storage.LogStore, policy storage.RetentionPolicy, interval time.Duration, archiver *archive.Archiver) *Janitor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Janitor{
+		store:    store,
+		policy:   policy,
+		interval: interval,
+		archiver: archiver,
+		ctx:      ctx,
+		cancel:   cancel,
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start purges right away and then every interval until Stop is called
+func (j *Janitor) Start() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.ticker = time.NewTicker(j.interval)
+	j.mu.Unlock()
+	go func() {
+		defer close(j.done)
+		defer j.ticker.Stop()
+		for {
+			j.Purge(j.ctx)
+			j.mu.Lock()
+			j.nextPurge = time.Now().Add(j.interval)
+			j.mu.Unlock()
+
+			select {
+			case <-j.ticker.C:
+			case <-j.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic purges, aborting a running one and waiting for it to return
+func (j *Janitor) Stop() {
+	if j == nil {
+		return
+	}
+	j.cancel()
+	close(j.quit)
+	<-j.done
+}
+
+// SetPolicy replaces the policy and interval, taking effect from the next purge
+func (j *Janitor) SetPolicy(policy storage.RetentionPolicy, interval time.Duration) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.policy = policy
+	if interval != j.interval {
+		j.interval = interval
+		if j.ticker != nil {
+			j.ticker.Reset(interval)
+			j.nextPurge = time.Now().Add(interval)
+		}
+	}
+}
+
+// Purge archives and deletes the expired logs, then deletes the oldest logs beyond the max size.
+// Logs deleted for size are not archived. The purge stops at the first step failing once ctx is done.
+func (j *Janitor) Purge(ctx context.Context) PurgeReport {
+	j.purgeMu.Lock()
+	defer j.purgeMu.Unlock()
+	// A policy set while purging takes effect from the next purge
+	j.mu.Lock()
+	policy := j.policy
+	j.mu.Unlock()
+
+	report := PurgeReport{StartedAt: time.Now().UTC()}
+	cutoffs := policy.Cutoffs(report.StartedAt)
+	var err error
+	if j.archiver != nil {
+		// Nothing is deleted past the newest archived log, logs stored meanwhile wait for the next purge
+		var archived storage.RetentionCutoffs
+		report.Archived, archived, err = j.archiveExpired(ctx, cutoffs)
+		if err == nil {
+			report.Expired, err = j.store.DeleteExpired(ctx, archived)
+		}
+	} else {
+		report.Expired, err = j.store.DeleteExpired(ctx, cutoffs)
+	}
+	if err == nil && policy.MaxSize > 0 {
+		report.Trimmed, err = j.store.TrimToSize(ctx, policy.MaxSize)
+	}
+	if err != nil {
+		report.Error = err.Error()
+		fmt.Printf("Retention purge failed: %v\n", err)
+	} else if report.Expired > 0 || report.Trimmed > 0 {
+		fmt.Printf("Retention purge archived %d files, deleted %d expired and %d logs over the size limit\n", len(report.Archived), report.Expired, report.Trimmed)
+	}
+	report.Duration = time.Since(report.StartedAt).String()
+
+	j.mu.Lock()
+	j.lastPurge = &report
+	j.mu.Unlock()
+	return report
+}
+
+// archiveExpired archives the logs past their cutoff, one archive per distinct cutoff, returning the names of
+// the archives and the cutoffs moved back to just after the newest log written to each archive
+func (j *Janitor) archiveExpired(ctx context.Context, cutoffs storage.RetentionCutoffs) ([]string, storage.RetentionCutoffs, error) {
+	var names []string
+	archive := func(cutoff time.Time, query utils.LogQuery) (time.Time, error) {
+		// Logs are expired when strictly before the cutoff, while query ranges include their end
+		query.StartTime, query.EndTime = time.Unix(0, 0), cutoff.Add(-time.Nanosecond)
+		entry, err := j.archiver.Archive(ctx, query)
+		if err != nil || entry == nil {
+			return time.Time{}, err
+		}
+		names = append(names, entry.Name)
+		return entry.To.Add(time.Nanosecond), nil
+	}
+
+	// Levels keep their own cutoff even when nothing of theirs was archived, a zero cutoff deleting nothing
+	archived := storage.RetentionCutoffs{Levels: make(map[string]time.Time, len(cutoffs.Levels))}
+	var overridden []utils.QueryNode
+	for level, cutoff := range cutoffs.Levels {
+		overridden = append(overridden, &utils.QueryTerm{Field: utils.QueryFieldLevel, Value: level})
+		archived.Levels[level] = time.Time{}
+		if cutoff.IsZero() {
+			continue
+		}
+		to, err := archive(cutoff, utils.LogQuery{LogLevel: level})
+		if err != nil {
+			return names, archived, fmt.Errorf("failed to archive expired logs: %v", err)
+		}
+		archived.Levels[level] = to
+	}
+	if !cutoffs.Default.IsZero() {
+		var query utils.LogQuery
+		if len(overridden) > 0 {
+			query.Expr = &utils.QueryNot{Child: &utils.QueryOr{Children: overridden}}
+		}
+		to, err := archive(cutoffs.Default, query)
+		if err != nil {
+			return names, archived, fmt.Errorf("failed to archive expired logs: %v", err)
+		}
+		archived.Default = to
+	}
+	return names, archived, nil
+}
+
+// Status reports the policy, the current storage size and the last purge
+func (j *Janitor) Status(ctx context.Context) RetentionStatus {
+	if j == nil {
+		return RetentionStatus{}
+	}
+
+	var size int64
+	if s, err := j.store.Size(ctx); err == nil {
+		size = s
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := RetentionStatus{
+		Enabled:   j.policy.Enabled(),
+		MaxSize:   j.policy.MaxSize,
+		Archiving: j.archiver != nil,
+		Size:      size,
+		Interval:  j.interval.String(),
+	}
+	if j.policy.MaxAge > 0 {
+		status.MaxAge = j.policy.MaxAge.String()
+	}
+	if len(j.policy.LevelMaxAge) > 0 {
+		status.LevelMaxAge = make(map[string]string, len(j.policy.LevelMaxAge))
+		for level, age := range j.policy.LevelMaxAge {
+			status.LevelMaxAge[level] = age.String()
+		}
+	}
+	status.LastPurge = j.lastPurge
+	if !j.nextPurge.IsZero() {
+		next := j.nextPurge
+		status.NextPurge = &next
+	}
+	return status
+}
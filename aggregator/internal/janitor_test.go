@@ -0,0 +1,145 @@
+package internal_test
+
+import (
+	"context"
+	"log-aggregator/aggregator/archive"
+	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"testing"
+	"time"
+)
+
+// TestJanitor_Purge tests that the janitor deletes expired logs and oversized storage, and reports it.
+func TestJanitor_Purge(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: time.Now().Add(-2 * time.Hour), Level: "DEBUG", Message: "old debug"},
+		{Timestamp: time.Now().Add(-2 * time.Hour), Level: "ERROR", Message: "old error"},
+		{Timestamp: time.Now().Add(-time.Minute), Level: "INFO", Message: "first"},
+		{Timestamp: time.Now(), Level: "INFO", Message: "second"},
+	})
+	size, _ := store.Size(context.Background())
+
+	policy := storage.RetentionPolicy{
+		MaxAge:      time.Hour,
+		LevelMaxAge: map[string]time.Duration{"ERROR": 24 * time.Hour},
+		MaxSize:     size - 50, // Only room for two of the logs
+	}
+	janitor := internal.NewJanitor(store, policy, time.Hour, nil)
+	janitor.Start()
+	// Stopping aborts a running purge, so let the first one finish
+	status := janitor.Status(context.Background())
+	for deadline := time.Now().Add(time.Second); status.LastPurge == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		status = janitor.Status(context.Background())
+	}
+	janitor.Stop()
+
+	if status.LastPurge == nil || status.LastPurge.Expired != 1 || status.LastPurge.Trimmed != 1 {
+		t.Fatalf("Expected 1 expired and 1 trimmed log in the last purge, got %+v", status.LastPurge)
+	}
+	logs, _ := store.GetLogMessages(context.Background(), utils.LogQuery{})
+	if len(logs) != 2 || logs[0].Message != "first" || status.LevelMaxAge["ERROR"] != "24h0m0s" {
+		t.Errorf("Expected the INFO logs to remain, got %v with status %+v", logs, status)
+	}
+}
+
+// TestJanitor_Archive tests that expired logs of every level are archived before they are deleted.
+func TestJanitor_Archive(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: time.Now().Add(-2 * time.Hour), Level: "INFO", Message: "old info"},
+		{Timestamp: time.Now().Add(-2 * time.Hour), Level: "DEBUG", Message: "old debug"},
+		{Timestamp: time.Now().Add(-2 * time.Hour), Level: "ERROR", Message: "kept error"},
+		{Timestamp: time.Now(), Level: "INFO", Message: "new info"},
+	})
+
+	bucket, _ := archive.NewDirBucket(t.TempDir())
+	archiver, _ := archive.NewArchiver(store, bucket, archive.CompressionZstd)
+	policy := storage.RetentionPolicy{
+		MaxAge:      time.Hour,
+		LevelMaxAge: map[string]time.Duration{"ERROR": 0, "DEBUG": time.Minute},
+	}
+	report := internal.NewJanitor(store, policy, time.Hour, archiver).Purge(context.Background())
+	if report.Error != "" || report.Expired != 2 || len(report.Archived) != 2 {
+		t.Fatalf("Expected 2 logs archived into 2 files and deleted, got %+v", report)
+	}
+
+	restored := storage.NewMemoryStorage()
+	for _, name := range report.Archived {
+		archive.Restore(context.Background(), bucket, name, restored)
+	}
+	logs, _ := restored.GetLogMessages(context.Background(), utils.LogQuery{})
+	if len(logs) != 2 {
+		t.Errorf("Expected the 2 deleted logs in the archives, got %v", logs)
+	}
+}
+
+// lateStore stores a late log, already expired, right before deleting archived logs
+type lateStore struct {
+	storage.LogStore
+}
+
+func (s *lateStore) DeleteExpired(ctx context.Context, cutoffs storage.RetentionCutoffs) (int64, error) {
+	s.LogStore.InsertLogMessages(ctx, []utils.LogMessage{{Timestamp: time.Now().Add(-2 * time.Hour), Level: "INFO", Message: "late"}})
+	return s.LogStore.DeleteExpired(ctx, cutoffs)
+}
+
+// TestJanitor_ArchiveRace tests that logs stored between archiving and deleting are left for the next purge instead of deleted unarchived.
+func TestJanitor_ArchiveRace(t *testing.T) {
+	store := &lateStore{LogStore: storage.NewMemoryStorage()}
+	store.LogStore.InsertLogMessages(context.Background(), []utils.LogMessage{{Timestamp: time.Now().Add(-2 * time.Hour), Level: "INFO", Message: "old"}})
+
+	bucket, _ := archive.NewDirBucket(t.TempDir())
+	archiver, _ := archive.NewArchiver(store, bucket, archive.CompressionGzip)
+	report := internal.NewJanitor(store, storage.RetentionPolicy{MaxAge: time.Hour}, time.Hour, archiver).Purge(context.Background())
+	if report.Error != "" || report.Expired != 1 {
+		t.Fatalf("Expected only the archived log to be deleted, got %+v", report)
+	}
+	logs, _ := store.GetLogMessages(context.Background(), utils.LogQuery{})
+	if len(logs) != 1 || logs[0].Message != "late" {
+		t.Errorf("Expected the late log to be kept, got %v", logs)
+	}
+}
+
+// slowDeleteStore blocks deleting expired logs until released
+type slowDeleteStore struct {
+	storage.LogStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowDeleteStore) DeleteExpired(ctx context.Context, cutoffs storage.RetentionCutoffs) (int64, error) {
+	s.started <- struct{}{}
+	<-s.release
+	return s.LogStore.DeleteExpired(ctx, cutoffs)
+}
+
+// TestJanitor_PurgeDoesNotBlock tests that the status and policy can be read and changed while a purge runs.
+func TestJanitor_PurgeDoesNotBlock(t *testing.T) {
+	store := &slowDeleteStore{LogStore: storage.NewMemoryStorage(), started: make(chan struct{}), release: make(chan struct{})}
+	janitor := internal.NewJanitor(store, storage.RetentionPolicy{MaxAge: time.Hour}, time.Hour, nil)
+	purged := make(chan internal.PurgeReport)
+	go func() { purged <- janitor.Purge(context.Background()) }()
+	<-store.started
+
+	done := make(chan struct{})
+	go func() {
+		janitor.SetPolicy(storage.RetentionPolicy{MaxAge: 2 * time.Hour}, time.Hour)
+		janitor.Status(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the status and policy not to wait for the running purge")
+	}
+	close(store.release)
+	if report := <-purged; report.Error != "" {
+		t.Errorf("Expected the purge to succeed, got %+v", report)
+	}
+	if status := janitor.Status(context.Background()); status.MaxAge != "2h0m0s" || status.LastPurge == nil {
+		t.Errorf("Expected the new policy and the last purge, got %+v", status)
+	}
+}
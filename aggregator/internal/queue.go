@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"log-aggregator/aggregator/utils"
+)
+
+// defaultQueueCapacity is the capacity of the queues configured without one
+const defaultQueueCapacity = 100
+
+// defaultQueueWeights favours interactive reads and ingestion over the heavier stats aggregations
+var defaultQueueWeights = map[utils.JobType]int{
+	utils.FetchJob: 2,
+	utils.StoreJob: 2,
+	utils.StatsJob: 1,
+}
+
+// QueueConfig sizes the queue of a job type and weighs how often workers take its jobs over the other queues'
+type QueueConfig struct {
+	Capacity int `yaml:"capacity"` // Jobs queued before submitting more of the type blocks
+	Weight   int `yaml:"weight"`   // Share of the turns the queue gets while others have jobs too
+}
+
+// QueueStatus is the state of the queue of a job type
+type QueueStatus struct {
+	Type     string `json:"type"`
+	Queued   int    `json:"queued"`
+	Capacity int    `json:"capacity"`
+	Weight   int    `json:"weight"`
+}
+
+// queue holds the jobs of a single type
+type queue struct {
+	jobType utils.JobType
+	jobs    chan utils.Job
+	weight  int
+}
+
+// newQueues creates a queue per job type, filling in the capacities and weights left empty
+func newQueues(configs map[utils.JobType]QueueConfig) []*queue {
+	queues := make([]*queue, len(utils.JobTypes))
+	for i, jobType := range utils.JobTypes {
+		config := configs[jobType]
+		if config.Capacity <= 0 {
+			config.Capacity = defaultQueueCapacity
+		}
+		if config.Weight <= 0 {
+			config.Weight = defaultQueueWeights[jobType]
+		}
+		queues[i] = &queue{jobType: jobType, jobs: make(chan utils.Job, config.Capacity), weight: config.Weight}
+	}
+	return queues
+}
+
+// weightedSchedule spreads turns among the queues in proportion to their weights, interleaving them
+// (smooth weighted round robin) so a heavy queue doesn't take its turns in one long run
+func weightedSchedule(queues []*queue) []int {
+	total := 0
+	for _, q := range queues {
+		total += q.weight
+	}
+	current := make([]int, len(queues))
+	schedule := make([]int, 0, total)
+	for len(schedule) < total {
+		best := 0
+		for i, q := range queues {
+			current[i] += q.weight
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"log-aggregator/aggregator/utils"
+	"sync"
+	"sync/atomic"
+)
+
+// TailHub fans stored logs out to live tail subscribers.
+// A nil *TailHub is valid and publishes nowhere.
+type TailHub struct {
+	mu          sync.RWMutex
+	subscribers map[*Subscription]struct{}
+	dropped     uint64 // Logs dropped across every subscriber
+}
+
+// Subscription receives the published logs matching its filter
+type Subscription struct {
+	hub     *TailHub
+	filter  func(utils.LogMessage) bool
+	logs    chan utils.LogMessage
+	dropped uint64
+	once    sync.Once
+}
+
+// NewTailHub creates a hub without subscribers
+func NewTailHub() *TailHub {
+	return &TailHub{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscribe registers a subscriber buffering up to bufferSize logs matching filter
+func (h *TailHub) Subscribe(filter func(utils.LogMessage) bool, bufferSize int) *Subscription {
+	sub := &Subscription{hub: h, filter: filter, logs: make(chan utils.LogMessage, bufferSize)}
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+// Publish hands the logs to every matching subscriber without ever blocking.
+// Logs that don't fit in a subscriber's buffer are dropped and counted.
+func (h *TailHub) Publish(logs []utils.LogMessage) {
+	if h == nil {
+		return
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for sub := range h.subscribers {
+		for _, log := range logs {
+			if !sub.filter(log) {
+				continue
+			}
+			select {
+			case sub.logs <- log:
+			default:
+				// Slow subscribers lose logs rather than stall ingestion
+				atomic.AddUint64(&sub.dropped, 1)
+				atomic.AddUint64(&h.dropped, 1)
+			}
+		}
+	}
+}
+
+// Subscribers returns the number of active subscriptions
+func (h *TailHub) Subscribers() int {
+	if h == nil {
+		return 0
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subscribers)
+}
+
+// Close ends every subscription, so live tail streams finish on shutdown
+func (h *TailHub) Close() {
+	if h == nil {
+		return
+	}
+	h.mu.RLock()
+	subscribers := make([]*Subscription, 0, len(h.subscribers))
+	for sub := range h.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	h.mu.RUnlock()
+	for _, sub := range subscribers {
+		sub.Close()
+	}
+}
+
+// Dropped returns the number of logs dropped across every subscriber
+func (h *TailHub) Dropped() uint64 {
+	if h == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&h.dropped)
+}
+
+// Logs returns the channel the subscription's logs are delivered on, closed on Close
+func (s *Subscription) Logs() <-chan utils.LogMessage {
+	return s.logs
+}
+
+// TakeDropped returns the number of logs dropped since the last call
+func (s *Subscription) TakeDropped() uint64 {
+	return atomic.SwapUint64(&s.dropped, 0)
+}
+
+// Close unregisters the subscription
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.hub.mu.Lock()
+		delete(s.hub.subscribers, s)
+		s.hub.mu.Unlock()
+		close(s.logs)
+	})
+}
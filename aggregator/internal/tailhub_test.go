@@ -0,0 +1,60 @@
+package internal_test
+
+import (
+	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/utils"
+	"testing"
+	"time"
+)
+
+// TestTailHub_FiltersAndDrops tests that subscribers only get matching logs and overflow is counted.
+func TestTailHub_FiltersAndDrops(t *testing.T) {
+	hub := internal.NewTailHub()
+	errorsOnly := hub.Subscribe(func(log utils.LogMessage) bool { return log.Level == "ERROR" }, 2)
+	defer errorsOnly.Close()
+
+	var logs []utils.LogMessage
+	for i := 0; i < 5; i++ {
+		logs = append(logs, utils.LogMessage{Timestamp: time.Now(), Level: "ERROR"}, utils.LogMessage{Timestamp: time.Now(), Level: "INFO"})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		hub.Publish(logs) // Must not block even though nobody reads
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a full subscriber")
+	}
+
+	if len(errorsOnly.Logs()) != 2 {
+		t.Errorf("Expected 2 buffered logs, got %d", len(errorsOnly.Logs()))
+	}
+	if dropped := errorsOnly.TakeDropped(); dropped != 3 {
+		t.Errorf("Expected 3 dropped logs, got %d", dropped)
+	}
+	if errorsOnly.TakeDropped() != 0 {
+		t.Error("Expected the dropped count to reset after being taken")
+	}
+	if hub.Dropped() != 3 {
+		t.Errorf("Expected the hub to count 3 dropped logs, got %d", hub.Dropped())
+	}
+}
+
+// TestTailHub_Close tests that closed subscriptions are unregistered.
+func TestTailHub_Close(t *testing.T) {
+	hub := internal.NewTailHub()
+	sub := hub.Subscribe(func(utils.LogMessage) bool { return true }, 1)
+	sub.Close()
+	sub.Close()
+
+	hub.Publish([]utils.LogMessage{{Level: "INFO"}})
+	if hub.Subscribers() != 0 {
+		t.Errorf("Expected no subscribers, got %d", hub.Subscribers())
+	}
+	if _, ok := <-sub.Logs(); ok {
+		t.Error("Expected the subscription channel to be closed")
+	}
+}
@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log-aggregator/aggregator/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	walFileName = "batches.wal"
+	// walCompactSize is the file size after which acknowledged batches are compacted away
+	walCompactSize = 64 << 20
+
+	walRecordAppend byte = 1
+	walRecordAck    byte = 2
+
+	// walHeaderSize is type(1) + seq(8) + length(4) + crc32(4)
+	walHeaderSize = 17
+)
+
+// WAL is a write-ahead log holding accepted log batches until they are stored.
+// A nil *WAL is valid and disables write-ahead logging.
+type WAL struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	lastSeq uint64
+	pending map[uint64][]utils.LogMessage // Appended batches that have not been acknowledged yet
+}
+
+// WALEntry is a batch waiting in the WAL to be stored
+type WALEntry struct {
+	Seq  uint64
+	Logs []utils.LogMessage
+}
+
+// OpenWAL opens (or creates) the WAL in dir and loads every unacknowledged batch
+func OpenWAL(dir string) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL directory: %v", err)
+	}
+	path := filepath.Join(dir, walFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL: %v", err)
+	}
+
+	wal := &WAL{path: path, file: file, pending: make(map[uint64][]utils.LogMessage)}
+	if err := wal.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return wal, nil
+}
+
+// load replays the records in the file, stopping at the first incomplete one
+func (l *WAL) load() error {
+	info, err := l.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat WAL: %v", err)
+	}
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := l.file.ReadAt(header, l.size); err != nil {
+			break
+		}
+		recordType := header[0]
+		seq := binary.LittleEndian.Uint64(header[1:9])
+		length := binary.LittleEndian.Uint32(header[9:13])
+		checksum := binary.LittleEndian.Uint32(header[13:17])
+		if int64(length) > info.Size()-l.size-walHeaderSize {
+			break // Corrupt length, treated like any other torn tail
+		}
+
+		payload := make([]byte, length)
+		if _, err := l.file.ReadAt(payload, l.size+walHeaderSize); err != nil {
+			break
+		}
+		if crc32.Update(crc32.ChecksumIEEE(header[:13]), crc32.IEEETable, payload) != checksum {
+			break
+		}
+
+		switch recordType {
+		case walRecordAppend:
+			var logs []utils.LogMessage
+			if err := json.Unmarshal(payload, &logs); err != nil {
+				return fmt.Errorf("failed to decode WAL batch %d: %v", seq, err)
+			}
+			l.pending[seq] = logs
+		case walRecordAck:
+			delete(l.pending, seq)
+		}
+		if seq > l.lastSeq {
+			l.lastSeq = seq
+		}
+		l.size += walHeaderSize + int64(length)
+	}
+
+	// Drop a torn write at the tail so new records follow the last complete one
+	if err := l.file.Truncate(l.size); err != nil {
+		return fmt.Errorf("failed to truncate WAL: %v", err)
+	}
+	return nil
+}
+
+// Append durably writes the batch to the WAL and returns its sequence number
+func (l *WAL) Append(logs []utils.LogMessage) (uint64, error) {
+	if l == nil {
+		return 0, nil
+	}
+	payload, err := json.Marshal(logs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode WAL batch: %v", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lastSeq++
+	seq := l.lastSeq
+	if err := l.write(walRecordAppend, seq, payload); err != nil {
+		return 0, err
+	}
+	// The batch is only acknowledged to the client once it is on disk
+	if err := l.file.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync WAL: %v", err)
+	}
+	l.pending[seq] = logs
+	return seq, nil
+}
+
+// Ack marks the batch as stored, truncating the WAL once nothing is pending
+func (l *WAL) Ack(seq uint64) error {
+	if l == nil || seq == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.pending[seq]; !ok {
+		return nil
+	}
+	delete(l.pending, seq)
+
+	if len(l.pending) == 0 {
+		// Everything has been stored, start over with an empty file
+		if err := l.file.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate WAL: %v", err)
+		}
+		l.size = 0
+		return l.file.Sync()
+	}
+
+	// Acks are not synced, losing one only means the batch is stored twice after a crash
+	if err := l.write(walRecordAck, seq, nil); err != nil {
+		return err
+	}
+	if l.size > walCompactSize {
+		return l.compact()
+	}
+	return nil
+}
+
+// Pending returns the unacknowledged batches in the order they were appended
+func (l *WAL) Pending() []WALEntry {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]WALEntry, 0, len(l.pending))
+	for seq, logs := range l.pending {
+		entries = append(entries, WALEntry{Seq: seq, Logs: logs})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries
+}
+
+// Backlog returns the number of unacknowledged batches and the size of the WAL file
+func (l *WAL) Backlog() (int, int64) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.pending), l.size
+}
+
+// Close closes the WAL file
+func (l *WAL) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// write appends a single record at the end of the file
+func (l *WAL) write(recordType byte, seq uint64, payload []byte) error {
+	record := encodeWALRecord(recordType, seq, payload)
+	if _, err := l.file.WriteAt(record, l.size); err != nil {
+		return fmt.Errorf("failed to write WAL record: %v", err)
+	}
+	l.size += int64(len(record))
+	return nil
+}
+
+// encodeWALRecord frames the payload with its header and checksum
+func encodeWALRecord(recordType byte, seq uint64, payload []byte) []byte {
+	record := make([]byte, walHeaderSize+len(payload))
+	record[0] = recordType
+	binary.LittleEndian.PutUint64(record[1:9], seq)
+	binary.LittleEndian.PutUint32(record[9:13], uint32(len(payload)))
+	copy(record[walHeaderSize:], payload)
+	binary.LittleEndian.PutUint32(record[13:17], crc32.Update(crc32.ChecksumIEEE(record[:13]), crc32.IEEETable, payload))
+	return record
+}
+
+// compact rewrites the WAL with only the pending batches. The current file stays in use until
+// the compacted one has replaced it, so a failed compaction leaves the WAL as it was.
+func (l *WAL) compact() error {
+	tmpPath := l.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create compacted WAL: %v", err)
+	}
+	abort := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	seqs := make([]uint64, 0, len(l.pending))
+	for seq := range l.pending {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	var size int64
+	for _, seq := range seqs {
+		payload, err := json.Marshal(l.pending[seq])
+		if err != nil {
+			return abort(fmt.Errorf("failed to encode WAL record: %v", err))
+		}
+		record := encodeWALRecord(walRecordAppend, seq, payload)
+		if _, err := tmp.WriteAt(record, size); err != nil {
+			return abort(fmt.Errorf("failed to write WAL record: %v", err))
+		}
+		size += int64(len(record))
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return abort(fmt.Errorf("failed to sync compacted WAL: %v", err))
+	}
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		return abort(fmt.Errorf("failed to replace WAL: %v", err))
+	}
+	old := l.file
+	l.file, l.size = tmp, size
+	return old.Close()
+}
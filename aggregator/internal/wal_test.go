@@ -0,0 +1,115 @@
+package internal_test
+
+import (
+	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testBatch(message string) []utils.LogMessage {
+	return []utils.LogMessage{{Timestamp: time.Now().UTC(), Level: "INFO", Message: message}}
+}
+
+// TestWAL_ReplaysUnacknowledged tests that only unacknowledged batches are pending after reopening the WAL.
+func TestWAL_ReplaysUnacknowledged(t *testing.T) {
+	dir := t.TempDir()
+
+	wal, err := internal.OpenWAL(dir)
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	first, _ := wal.Append(testBatch("first"))
+	second, _ := wal.Append(testBatch("second"))
+	third, _ := wal.Append(testBatch("third"))
+	wal.Ack(second)
+	wal.Close()
+
+	wal, err = internal.OpenWAL(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer wal.Close()
+
+	pending := wal.Pending()
+	if len(pending) != 2 || pending[0].Seq != first || pending[1].Seq != third {
+		t.Fatalf("Expected batches %d and %d to be pending, got %v", first, third, pending)
+	}
+	if pending[1].Logs[0].Message != "third" {
+		t.Errorf("Expected the third batch to be replayed, got %v", pending[1].Logs)
+	}
+
+	// New batches must not reuse sequence numbers still in the log
+	next, _ := wal.Append(testBatch("fourth"))
+	if next <= third {
+		t.Errorf("Expected a sequence number after %d, got %d", third, next)
+	}
+}
+
+// TestWAL_TruncatesWhenDrained tests that the WAL file is emptied once every batch is acknowledged.
+func TestWAL_TruncatesWhenDrained(t *testing.T) {
+	dir := t.TempDir()
+	wal, _ := internal.OpenWAL(dir)
+	defer wal.Close()
+
+	seq, _ := wal.Append(testBatch("only"))
+	wal.Ack(seq)
+
+	info, err := os.Stat(filepath.Join(dir, "batches.wal"))
+	if err != nil {
+		t.Fatalf("Failed to stat WAL: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("Expected an empty WAL, got %d bytes", info.Size())
+	}
+}
+
+// TestWAL_CorruptLength tests that a record header claiming more bytes than the file holds is dropped as a torn tail.
+func TestWAL_CorruptLength(t *testing.T) {
+	dir := t.TempDir()
+	wal, _ := internal.OpenWAL(dir)
+	seq, _ := wal.Append(testBatch("kept"))
+	wal.Close()
+
+	// An append record of sequence 99 claiming nearly 4 GiB of payload
+	header := []byte{1, 99, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}
+	f, _ := os.OpenFile(filepath.Join(dir, "batches.wal"), os.O_APPEND|os.O_WRONLY, 0o644)
+	f.Write(append(header, []byte("garbage")...))
+	f.Close()
+
+	wal, err := internal.OpenWAL(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer wal.Close()
+	if pending := wal.Pending(); len(pending) != 1 || pending[0].Seq != seq {
+		t.Errorf("Expected only batch %d to be pending, got %v", seq, pending)
+	}
+	if next, _ := wal.Append(testBatch("next")); next != seq+1 {
+		t.Errorf("Expected the corrupt record to be ignored, got sequence %d", next)
+	}
+}
+
+// TestWorkerPool_AcksStoredBatches tests that workers acknowledge batches once they are stored.
+func TestWorkerPool_AcksStoredBatches(t *testing.T) {
+	wal, _ := internal.OpenWAL(t.TempDir())
+	defer wal.Close()
+
+	wp := internal.NewWorkerPool(1, nil, storage.NewMemoryStorage(), wal, nil)
+	defer wp.Stop()
+
+	logs := testBatch("stored")
+	seq, _ := wal.Append(logs)
+	wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: logs, WALSeq: seq})
+
+	deadline := time.Now().Add(time.Second)
+	for len(wal.Pending()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(wal.Pending()) != 0 {
+		t.Errorf("Expected the batch to be acknowledged, still pending: %v", wal.Pending())
+	}
+}
@@ -1,64 +1,172 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log-aggregator/aggregator/metrics"
 	"log-aggregator/aggregator/storage"
 	"log-aggregator/aggregator/utils"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// ErrPoolStopped is returned when submitting jobs to a pool that is shutting down
+var ErrPoolStopped = errors.New("worker pool is stopped")
+
+// ErrQueueFull is returned when the queue of a job stays full for longer than the submit wait
+var ErrQueueFull = errors.New("job queue is full")
+
+// MaxPoolSize bounds the number of workers the pool can be resized to by hand while autoscaling is off
+const MaxPoolSize = 1024
+
+const (
+	// retryBaseDelay is how long a failed store job waits before it is queued again, doubling with every failure
+	retryBaseDelay = 100 * time.Millisecond
+	// retryMaxDelay caps the wait between the attempts at a store job
+	retryMaxDelay = 30 * time.Second
+	// maxPendingRetries bounds the failed store jobs waiting out their backoff, further failures are given up on
+	maxPendingRetries = 1024
+)
+
+// ErrMemoryBudget is returned when queuing a batch would take the queued logs over the memory budget
+var ErrMemoryBudget = errors.New("memory budget for queued logs is exhausted")
+
 type Worker struct {
 	id     int
-	jobs   <-chan utils.Job
-	quit   <-chan struct{}
+	ready  <-chan struct{}
+	quit   chan struct{}
 	active *int32
-	store  *storage.Storage
+	store  storage.LogStore
+	wal    *WAL
+	hub    *TailHub
+	pool   *WorkerPool
 }
 
 type WorkerPool struct {
-	jobs        chan utils.Job
-	quit        chan struct{}
+	queues      []*queue      // One per job type, in the order of utils.JobTypes
+	schedule    []int         // Indexes of the queues, each appearing as many times as its weight
+	turn        uint64        // Position in the schedule, shared by the workers
+	ready       chan struct{} // Receives a token for every queued job, workers take one before taking a job
+	queueMu     sync.RWMutex  // Held for reading while submitting, so the queues are only closed once nobody sends on them
+	closed      bool
+	mu          sync.Mutex // Guards workers and nextID while resizing
 	workers     []*Worker
+	nextID      int
 	activeCount int32
+	wg          sync.WaitGroup // Tracks running workers so Stop can wait for them
+	store       storage.LogStore
+	wal         *WAL
+	hub         *TailHub
+	ctx         context.Context // Canceled once the shutdown deadline passes, aborting the storage operations in flight
+	cancel      context.CancelFunc
+	storedLogs  int64 // Logs stored by the workers, for the drain report
+	failedLogs  int64 // Logs the workers failed to store
+	waitNanos   int64 // Time the jobs picked up since the last autoscaling decision waited for a worker
+	waitCount   int64
+	submitWait  int64 // Nanoseconds AddJob waits for room in a full queue, forever when 0
+	memBudget   int64 // Bytes of logs the queued and running store jobs may hold, unlimited when 0
+	queuedBytes int64 // Bytes of logs held by the queued, running and retried store jobs
+	retryMu     sync.Mutex
+	retries     map[*pendingRetry]struct{} // Failed store jobs waiting to be queued again, nil once shutting down
+	retryWg     sync.WaitGroup             // Tracks the retries being queued so Shutdown can wait for them
+}
+
+// pendingRetry is a failed store job waiting out its backoff
+type pendingRetry struct {
+	job    utils.Job
+	result utils.JobResult // Of the last attempt
+	timer  *time.Timer
+}
+
+// DrainReport describes what became of the queued jobs when the pool shut down
+type DrainReport struct {
+	Flushed   int64 // Logs stored while draining
+	Spilled   int64 // Logs left unstored in the WAL, replayed on the next start
+	Dropped   int64 // Logs left unstored without a WAL to replay them from
+	Abandoned int   // Fetch and stats jobs left unprocessed
+	Unstarted int   // Store jobs still queued at the deadline
+	TimedOut  bool  // Whether the deadline passed before the queue was empty
 }
 
-func NewWorkerPool(numWorkers int, store *storage.Storage) *WorkerPool {
-	jobs := make(chan utils.Job, 100) // Buffer to hold incoming jobs
-	quit := make(chan struct{})       // Channel to signal worker to stop
+// NewWorkerPool starts numWorkers workers taking jobs from a queue per job type, sized and weighted by queues
+// (which may leave out types, or be nil, for the defaults). They write to store, acknowledging stored batches in the WAL
+// and publishing them to the tail hub (both of which may be nil)
+func NewWorkerPool(numWorkers int, queues map[utils.JobType]QueueConfig, store storage.LogStore, wal *WAL, hub *TailHub) *WorkerPool {
 	pool := &WorkerPool{
-		jobs:        jobs,
-		quit:        quit,
-		workers:     make([]*Worker, numWorkers),
+		queues:      newQueues(queues),
+		retries:     make(map[*pendingRetry]struct{}),
 		activeCount: 0,
+		store:       store,
+		wal:         wal,
+		hub:         hub,
+	}
+
+	pool.ctx, pool.cancel = context.WithCancel(context.Background())
+	pool.schedule = weightedSchedule(pool.queues)
+	capacity := 0
+	for _, q := range pool.queues {
+		capacity += cap(q.jobs)
 	}
+	pool.ready = make(chan struct{}, capacity)
 
 	// Setup workers and put them in the pool
 	for i := 0; i < numWorkers; i++ {
-		worker := Worker{
-			id:     i,
-			jobs:   jobs,
-			quit:   quit,
-			active: &pool.activeCount,
-			store:  store,
-		}
-		pool.workers[i] = &worker
-		// Start each worker in a new goroutine
-		go worker.start()
+		pool.startWorker()
 	}
 
 	return pool
 }
 
+// startWorker adds a worker to the pool, the caller holds mu unless the pool isn't shared yet
+func (wp *WorkerPool) startWorker() {
+	worker := &Worker{
+		id:     wp.nextID,
+		ready:  wp.ready,
+		quit:   make(chan struct{}), // Channel to signal worker to stop
+		active: &wp.activeCount,
+		store:  wp.store,
+		wal:    wp.wal,
+		hub:    wp.hub,
+		pool:   wp,
+	}
+	wp.nextID++
+	wp.workers = append(wp.workers, worker)
+	// Start each worker in a new goroutine
+	wp.wg.Add(1)
+	// Count the worker as active right away so health checks don't see an idle pool while it starts
+	atomic.AddInt32(&wp.activeCount, 1)
+	go func() {
+		defer wp.wg.Done()
+		worker.start()
+	}()
+}
+
 // Start starts the worker's job processing loop.
 func (w *Worker) start() {
-	atomic.AddInt32(w.active, 1)        // Increment active worker count
-	defer atomic.AddInt32(w.active, -1) // Decrement active worker count when done
+	defer atomic.AddInt32(w.active, -1) // Decrement active worker count when done, it was incremented when started
 
 free:
 	for {
+		// Stopping takes precedence over the queued jobs
+		select {
+		case <-w.quit:
+			fmt.Printf("Worker %d stopping\n", w.id)
+			break free
+		default:
+		}
+
 		select {
-		case job := <-w.jobs:
-			w.processJob(job) // Process the job
+		case _, ok := <-w.ready:
+			if !ok {
+				// The pool is shutting down and the queues have been drained
+				fmt.Printf("Worker %d stopping\n", w.id)
+				break free
+			}
+			if job, ok := w.pool.takeJob(); ok {
+				w.processJob(job) // Process the job
+			}
 
 		case <-w.quit:
 			fmt.Printf("Worker %d stopping\n", w.id)
@@ -68,22 +176,220 @@ free:
 	}
 }
 
-// processJob processes the given job based on its type.
+// processJob processes the given job based on its type, then reports its result.
 func (w *Worker) processJob(job utils.Job) {
+	start := time.Now()
+	result := utils.JobResult{Type: job.Type}
+	if !job.Queued.IsZero() {
+		result.Wait = start.Sub(job.Queued)
+		metrics.JobWait.Observe(result.Wait.Seconds(), job.Type.String())
+		atomic.AddInt64(&w.pool.waitNanos, int64(result.Wait))
+		atomic.AddInt64(&w.pool.waitCount, 1)
+	}
+	defer func() { metrics.JobDuration.Observe(time.Since(start).Seconds(), job.Type.String()) }()
+
+	ctx, cancel := w.pool.jobContext(job)
+	defer cancel()
+	// Nobody is waiting for the job anymore, typically a client that went away while it was queued
+	if result.Err = ctx.Err(); result.Err != nil {
+		fmt.Printf("Worker %d skipped a %s job: %v\n", w.id, job.Type, result.Err)
+	} else {
+		result.Err = w.run(ctx, job, &result)
+	}
+	result.Kind = errorKind(ctx, result.Err)
+	result.Duration = time.Since(start)
+
+	if job.Type == utils.StoreJob && result.Err != nil {
+		// Accepted batches are stored at least once, storage failures and breaker rejections are retried while the pool runs.
+		// Retried batches keep their logs charged to the memory budget.
+		if (result.Kind == utils.ErrorStorage || result.Kind == utils.ErrorUnavailable) && w.pool.retry(job, result) {
+			return
+		}
+		// The batch stays in the WAL and is replayed on the next start
+		atomic.AddInt64(&w.pool.failedLogs, int64(len(job.Logs)))
+	}
+	atomic.AddInt64(&w.pool.queuedBytes, -jobSize(job))
+	finish(ctx, job, result)
+}
+
+// finish hands the result of a job to its submitter, unless ctx is done before the submitter takes it
+func finish(ctx context.Context, job utils.Job, result utils.JobResult) {
+	if job.OnDone != nil {
+		job.OnDone(result)
+	}
+	if job.Done != nil {
+		// The submitter may have given up on the result
+		select {
+		case job.Done <- result:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// retry queues a failed store job again after a backoff growing with its failures, false once the pool is shutting down
+// or too many jobs are waiting for a retry. Jobs rejected by an open circuit breaker are held until it lets calls
+// through again, which isn't counted as a failure.
+func (wp *WorkerPool) retry(job utils.Job, result utils.JobResult) bool {
+	wp.retryMu.Lock()
+	defer wp.retryMu.Unlock()
+	if wp.retries == nil {
+		return false
+	}
+	if len(wp.retries) >= maxPendingRetries {
+		fmt.Printf("Giving up on %d logs, %d batches are already waiting for a retry\n", len(job.Logs), len(wp.retries))
+		return false
+	}
+	var delay time.Duration
+	var openErr *OpenError
+	if errors.As(result.Err, &openErr) {
+		delay = max(openErr.RetryAfter, retryBaseDelay)
+		fmt.Printf("Holding %d logs for %v while the %s circuit breaker is open\n", len(job.Logs), delay, openErr.Breaker)
+	} else {
+		job.Tries++
+		delay = min(retryBaseDelay<<min(job.Tries-1, 16), retryMaxDelay)
+		fmt.Printf("Retrying %d logs in %v after %d failed attempts\n", len(job.Logs), delay, job.Tries)
+	}
+	pending := &pendingRetry{job: job, result: result}
+	pending.timer = time.AfterFunc(delay, func() { wp.requeue(pending) })
+	wp.retries[pending] = struct{}{}
+	metrics.StoreRetries.Inc()
+	return true
+}
+
+// requeue queues a retried job once its backoff passed, backing off again while the pool has no room for it
+func (wp *WorkerPool) requeue(pending *pendingRetry) {
+	wp.retryMu.Lock()
+	if _, ok := wp.retries[pending]; !ok {
+		// Shutdown took the job over
+		wp.retryMu.Unlock()
+		return
+	}
+	delete(wp.retries, pending)
+	wp.retryWg.Add(1)
+	wp.retryMu.Unlock()
+	defer wp.retryWg.Done()
+
+	// The logs are still charged to the memory budget from the first attempt
+	err := wp.addJob(pending.job, false)
+	if err == nil {
+		return
+	}
+	pending.job.Tries-- // Not an attempt at storing it
+	if IsOverloaded(err) && wp.retry(pending.job, pending.result) {
+		return
+	}
+	atomic.AddInt64(&wp.failedLogs, int64(len(pending.job.Logs)))
+	atomic.AddInt64(&wp.queuedBytes, -jobSize(pending.job))
+	finish(wp.ctx, pending.job, pending.result)
+}
+
+// cancelRetries stops retrying the failed store jobs, returning the number of logs left unstored,
+// and waits for the retries being queued
+func (wp *WorkerPool) cancelRetries() int64 {
+	wp.retryMu.Lock()
+	var unstored int64
+	for pending := range wp.retries {
+		pending.timer.Stop()
+		unstored += int64(len(pending.job.Logs))
+		atomic.AddInt64(&wp.queuedBytes, -jobSize(pending.job))
+		// Nobody waits on the results of store jobs at shutdown, so Done isn't waited on either
+		if pending.job.OnDone != nil {
+			pending.job.OnDone(pending.result)
+		}
+		if pending.job.Done != nil {
+			select {
+			case pending.job.Done <- pending.result:
+			default:
+			}
+		}
+	}
+	wp.retries = nil
+	wp.retryMu.Unlock()
+	wp.retryWg.Wait()
+	return unstored
+}
+
+// run runs the storage operation of the job, filling in its data in result
+func (w *Worker) run(ctx context.Context, job utils.Job, result *utils.JobResult) error {
+	start := time.Now()
 	switch job.Type {
 	case utils.FetchJob: // Specify the log level
 		// Fetch logs from the store
-		fetchedLogs, err := w.store.GetLogMessages(job.StartTime, job.EndTime, job.LogLevel)
-		// Send the fetched logs back via the Result channel
+		logs, err := w.store.GetLogMessages(ctx, job.Query)
+		observeStorage(ctx, "query", start, err)
 		if err != nil {
 			fmt.Println(err)
-			job.Result <- nil
-			return
+			return err
 		}
-		job.Result <- fetchedLogs
+		result.Logs = logs
+
+	case utils.StatsJob:
+		buckets, err := w.store.GetLogStats(ctx, job.Stats)
+		observeStorage(ctx, "stats", start, err)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+		result.Buckets = buckets
 
 	case utils.StoreJob:
-		w.store.InsertLogMessages(job.Logs)
+		err := w.store.InsertLogMessages(ctx, job.Logs)
+		observeStorage(ctx, "insert", start, err)
+		if err != nil {
+			fmt.Printf("Worker %d failed to store %d logs: %v\n", w.id, len(job.Logs), err)
+			return err
+		}
+		result.Stored = len(job.Logs)
+		atomic.AddInt64(&w.pool.storedLogs, int64(len(job.Logs)))
+		if err := w.wal.Ack(job.WALSeq); err != nil {
+			fmt.Printf("Worker %d failed to acknowledge WAL batch %d: %v\n", w.id, job.WALSeq, err)
+		}
+		// Stream the stored logs to live tail subscribers
+		w.hub.Publish(job.Logs)
+	}
+	return nil
+}
+
+// errorKind tells why a job running under ctx failed with err
+func errorKind(ctx context.Context, err error) utils.ErrorKind {
+	switch {
+	case err == nil:
+		return utils.ErrorNone
+	case ctx.Err() != nil:
+		return utils.ErrorCanceled
+	case errors.Is(err, storage.ErrInvalidQuery):
+		return utils.ErrorInvalid
+	case errors.Is(err, ErrCircuitOpen):
+		return utils.ErrorUnavailable
+	default:
+		return utils.ErrorStorage
+	}
+}
+
+// jobContext returns the context a job runs under, done once the job's own context is (store jobs usually have none)
+// or the pool gives up on draining
+func (wp *WorkerPool) jobContext(job utils.Job) (context.Context, context.CancelFunc) {
+	if job.Ctx == nil {
+		return wp.ctx, func() {}
+	}
+	ctx, cancel := context.WithCancel(job.Ctx)
+	stop := context.AfterFunc(wp.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// observeStorage records the latency and failure of a storage operation started at start,
+// canceled operations and invalid queries aren't storage failures, and rejected operations never reached storage
+func observeStorage(ctx context.Context, operation string, start time.Time, err error) {
+	kind := errorKind(ctx, err)
+	if kind == utils.ErrorUnavailable {
+		return
+	}
+	metrics.StorageDuration.Observe(time.Since(start).Seconds(), operation)
+	if kind == utils.ErrorStorage {
+		metrics.StorageErrors.Inc(operation)
 	}
 }
 
@@ -92,19 +398,246 @@ func (w *Worker) Stop() {
 	// You can implement any cleanup logic here if needed
 }
 
-func (wp *WorkerPool) AddJob(job utils.Job) {
-	wp.jobs <- job
+// AddJob queues a job for the workers, waiting while the queue of its type is full until job.Ctx is done
+// or the submit wait passes, then failing with ErrQueueFull. Store jobs fail with ErrMemoryBudget when their logs
+// don't fit in the memory budget, and every job fails once the pool is shutting down.
+func (wp *WorkerPool) AddJob(job utils.Job) error {
+	return wp.addJob(job, true)
 }
 
-// Stop stops all workers in the pool.
-func (wp *WorkerPool) Stop() {
-	// Signal all workers to stop
-	for range wp.workers {
-		wp.quit <- struct{}{} // Send stop signal to worker
+// addJob queues a job like AddJob, charging the logs of store jobs to the memory budget unless charge is false
+func (wp *WorkerPool) addJob(job utils.Job, charge bool) error {
+	q := wp.queueOf(job.Type)
+	if q == nil {
+		return fmt.Errorf("unknown job type %d", job.Type)
+	}
+
+	job.Queued = time.Now()
+	wp.queueMu.RLock()
+	defer wp.queueMu.RUnlock()
+	if wp.closed {
+		return ErrPoolStopped
+	}
+	// A batch larger than the whole budget is still let through when nothing else is queued
+	var size int64
+	if charge {
+		size = jobSize(job)
+	}
+	if queued := atomic.AddInt64(&wp.queuedBytes, size); size > 0 && queued != size {
+		if budget := atomic.LoadInt64(&wp.memBudget); budget > 0 && queued > budget {
+			atomic.AddInt64(&wp.queuedBytes, -size)
+			metrics.RejectedJobs.Inc(job.Type.String(), "memory_budget")
+			return ErrMemoryBudget
+		}
+	}
+	if err := wp.enqueue(q, job); err != nil {
+		atomic.AddInt64(&wp.queuedBytes, -size)
+		return err
+	}
+	// Never blocks, there are never more tokens than queued jobs
+	wp.ready <- struct{}{}
+	return nil
+}
+
+// enqueue sends the job on the queue, waiting for room at most the submit wait, the caller holds queueMu for reading
+func (wp *WorkerPool) enqueue(q *queue, job utils.Job) error {
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+	}
+
+	var done <-chan struct{} // Never ready without a context
+	if job.Ctx != nil {
+		done = job.Ctx.Done()
+	}
+	var timeout <-chan time.Time // Never fires without a submit wait
+	if wait := time.Duration(atomic.LoadInt64(&wp.submitWait)); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case q.jobs <- job:
+		return nil
+	case <-done:
+		return job.Ctx.Err()
+	case <-timeout:
+		metrics.RejectedJobs.Inc(job.Type.String(), "queue_full")
+		return ErrQueueFull
+	}
+}
+
+// jobSize returns the bytes held by the logs of a store job
+func jobSize(job utils.Job) int64 {
+	if job.Type != utils.StoreJob {
+		return 0
+	}
+	var size int64
+	for _, log := range job.Logs {
+		size += storage.LogSize(log)
 	}
+	return size
+}
+
+// IsOverloaded reports whether err turned a job away because the pool had no room for it
+func IsOverloaded(err error) bool {
+	return errors.Is(err, ErrQueueFull) || errors.Is(err, ErrMemoryBudget)
+}
+
+// SetSubmitLimits sets how long AddJob waits for room in a full queue, forever when 0,
+// and the bytes of logs the store jobs may hold until they are processed, unlimited when 0
+func (wp *WorkerPool) SetSubmitLimits(wait time.Duration, memoryBudget int64) {
+	atomic.StoreInt64(&wp.submitWait, int64(wait))
+	atomic.StoreInt64(&wp.memBudget, memoryBudget)
+}
+
+// QueuedBytes returns the bytes of logs held by the queued, running and retried store jobs
+func (wp *WorkerPool) QueuedBytes() int64 {
+	return atomic.LoadInt64(&wp.queuedBytes)
+}
+
+// takeJob takes the job of a worker holding a ready token. Queues take turns in proportion to their weight,
+// and a queue without jobs passes its turn to the next.
+func (wp *WorkerPool) takeJob() (utils.Job, bool) {
+	turn := int(atomic.AddUint64(&wp.turn, 1) % uint64(len(wp.schedule)))
+	for i := range wp.schedule {
+		q := wp.queues[wp.schedule[(turn+i)%len(wp.schedule)]]
+		select {
+		case job, ok := <-q.jobs:
+			if ok {
+				return job, true
+			}
+		default:
+		}
+	}
+	return utils.Job{}, false
+}
 
-	// Optionally close the jobs channel to prevent further job submissions
-	close(wp.jobs) // This is optional
+func (wp *WorkerPool) queueOf(jobType utils.JobType) *queue {
+	for _, q := range wp.queues {
+		if q.jobType == jobType {
+			return q
+		}
+	}
+	return nil
+}
+
+// Resize grows or shrinks the pool to n workers, at least one. Removed workers finish their current job first.
+func (wp *WorkerPool) Resize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	wp.queueMu.RLock()
+	defer wp.queueMu.RUnlock()
+	if wp.closed {
+		return
+	}
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if n > len(wp.workers) {
+		metrics.WorkerPoolResizes.Inc("grow")
+	} else if n < len(wp.workers) {
+		metrics.WorkerPoolResizes.Inc("shrink")
+	}
+	for len(wp.workers) < n {
+		wp.startWorker()
+	}
+	for len(wp.workers) > n {
+		last := len(wp.workers) - 1
+		close(wp.workers[last].quit)
+		wp.workers = wp.workers[:last]
+	}
+}
+
+// Size returns the number of workers the pool is sized to, workers being removed excluded
+func (wp *WorkerPool) Size() int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return len(wp.workers)
+}
+
+// Shutdown stops accepting jobs and lets the workers process the queued ones until ctx is done.
+// Past that, workers stop after their current job and the rest of the queue is left unprocessed.
+func (wp *WorkerPool) Shutdown(ctx context.Context) DrainReport {
+	storedBefore, failedBefore := atomic.LoadInt64(&wp.storedLogs), atomic.LoadInt64(&wp.failedLogs)
+
+	wp.queueMu.Lock()
+	if wp.closed {
+		wp.queueMu.Unlock()
+		return DrainReport{}
+	}
+	wp.closed = true
+	// Workers exit once they have emptied the closed queues
+	for _, q := range wp.queues {
+		close(q.jobs)
+	}
+	close(wp.ready)
+	wp.queueMu.Unlock()
+	// The batches waiting for a retry stay in the WAL as well
+	unstored := wp.cancelRetries()
+
+	done := make(chan struct{})
+	go func() {
+		// Wait for every worker to exit its loop
+		wp.wg.Wait()
+		close(done)
+	}()
+
+	var report DrainReport
+	select {
+	case <-done:
+	case <-ctx.Done():
+		report.TimedOut = true
+		// Signal all workers to stop
+		wp.mu.Lock()
+		for _, worker := range wp.workers {
+			close(worker.quit)
+		}
+		wp.workers = nil
+		wp.mu.Unlock()
+		// Abort what the workers are still busy with
+		wp.cancel()
+		<-done
+		for _, q := range wp.queues {
+			for job := range q.jobs {
+				atomic.AddInt64(&wp.queuedBytes, -jobSize(job))
+				if job.Type == utils.StoreJob {
+					unstored += int64(len(job.Logs))
+					report.Unstarted++
+				} else {
+					report.Abandoned++
+				}
+			}
+		}
+	}
+	wp.mu.Lock()
+	wp.workers = nil
+	wp.mu.Unlock()
+	wp.cancel()
+
+	report.Flushed = atomic.LoadInt64(&wp.storedLogs) - storedBefore
+	unstored += atomic.LoadInt64(&wp.failedLogs) - failedBefore
+	if wp.wal != nil {
+		report.Spilled = unstored
+	} else {
+		report.Dropped = unstored
+	}
+	return report
+}
+
+// Stop stops all workers in the pool once they have processed the queued jobs.
+func (wp *WorkerPool) Stop() {
+	wp.Shutdown(context.Background())
+}
+
+// takeAverageWait returns the average time the jobs picked up since the last call waited for a worker
+func (wp *WorkerPool) takeAverageWait() time.Duration {
+	waited, count := atomic.SwapInt64(&wp.waitNanos, 0), atomic.SwapInt64(&wp.waitCount, 0)
+	if count == 0 {
+		return 0
+	}
+	return time.Duration(waited / count)
 }
 
 // ActiveWorkers returns the number of active workers.
@@ -112,7 +645,43 @@ func (wp *WorkerPool) ActiveWorkers() int {
 	return int(atomic.LoadInt32(&wp.activeCount))
 }
 
+// QueueCapacity returns the number of jobs the queues hold together.
+func (wp *WorkerPool) QueueCapacity() int {
+	capacity := 0
+	for _, q := range wp.queues {
+		capacity += cap(q.jobs)
+	}
+	return capacity
+}
+
+// Ping checks the storage the workers write to.
+func (wp *WorkerPool) Ping(ctx context.Context) error {
+	return wp.store.Ping(ctx)
+}
+
 // QueuedTasks returns the number of queued tasks.
 func (wp *WorkerPool) QueuedTasks() int {
-	return len(wp.jobs)
+	queued := 0
+	for _, q := range wp.queues {
+		queued += len(q.jobs)
+	}
+	return queued
+}
+
+// Queues returns the state of the queue of every job type
+func (wp *WorkerPool) Queues() []QueueStatus {
+	statuses := make([]QueueStatus, len(wp.queues))
+	for i, q := range wp.queues {
+		statuses[i] = QueueStatus{Type: q.jobType.String(), Queued: len(q.jobs), Capacity: cap(q.jobs), Weight: q.weight}
+	}
+	return statuses
+}
+
+// Saturation returns how full the fullest queue is, from 0 to 1
+func (wp *WorkerPool) Saturation() float64 {
+	saturation := 0.0
+	for _, q := range wp.queues {
+		saturation = max(saturation, float64(len(q.jobs))/float64(cap(q.jobs)))
+	}
+	return saturation
 }
@@ -0,0 +1,348 @@
+package internal_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log-aggregator/aggregator/internal"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingStore holds every insert until release is closed or the insert is canceled
+type blockingStore struct {
+	storage.LogStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) InsertLogMessages(ctx context.Context, logs []utils.LogMessage) error {
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.LogStore.InsertLogMessages(ctx, logs)
+}
+
+// TestWorkerPool_ShutdownDrains tests that shutting down stores the queued batches and rejects new jobs.
+func TestWorkerPool_ShutdownDrains(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	wp := internal.NewWorkerPool(2, nil, store, nil, nil)
+	for i := 0; i < 10; i++ {
+		if err := wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: testBatch("queued")}); err != nil {
+			t.Fatalf("Failed to add job: %v", err)
+		}
+	}
+
+	report := wp.Shutdown(context.Background())
+	if report.TimedOut || report.Flushed != 10 || report.Dropped != 0 {
+		t.Errorf("Expected every queued log to be flushed, got %+v", report)
+	}
+	if logs, _ := store.GetLogMessages(context.Background(), utils.LogQuery{}); len(logs) != 10 {
+		t.Errorf("Expected 10 stored logs, got %d", len(logs))
+	}
+	if err := wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: testBatch("late")}); !errors.Is(err, internal.ErrPoolStopped) {
+		t.Errorf("Expected ErrPoolStopped, got %v", err)
+	}
+	if wp.ActiveWorkers() != 0 {
+		t.Errorf("Expected no active workers, got %d", wp.ActiveWorkers())
+	}
+}
+
+// TestWorkerPool_ShutdownDeadline tests that the batches still queued or being stored at the deadline are left in the WAL.
+func TestWorkerPool_ShutdownDeadline(t *testing.T) {
+	wal, err := internal.OpenWAL(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	defer wal.Close()
+	store := &blockingStore{LogStore: storage.NewMemoryStorage(), started: make(chan struct{}, 1), release: make(chan struct{})}
+	wp := internal.NewWorkerPool(1, nil, store, wal, nil)
+
+	for i := 0; i < 3; i++ {
+		logs := testBatch("queued")
+		seq, _ := wal.Append(logs)
+		wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: logs, WALSeq: seq})
+	}
+	wp.AddJob(utils.Job{Type: utils.FetchJob, Done: make(chan utils.JobResult)})
+	<-store.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// The batch being stored is never released, the deadline aborts it
+	report := wp.Shutdown(ctx)
+
+	if !report.TimedOut || report.Flushed != 0 || report.Spilled != 3 || report.Abandoned != 1 || report.Unstarted != 2 {
+		t.Errorf("Expected 3 spilled, 2 unstarted and 1 abandoned, got %+v", report)
+	}
+	if pending := wal.Pending(); len(pending) != 3 {
+		t.Errorf("Expected 3 batches pending in the WAL, got %d", len(pending))
+	}
+}
+
+// recordingStore records the order storage operations are called in
+type recordingStore struct {
+	storage.LogStore
+	mu  sync.Mutex
+	ops []string
+}
+
+func (s *recordingStore) record(op string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, op)
+}
+
+func (s *recordingStore) InsertLogMessages(ctx context.Context, logs []utils.LogMessage) error {
+	s.record("insert")
+	return s.LogStore.InsertLogMessages(ctx, logs)
+}
+
+func (s *recordingStore) GetLogMessages(ctx context.Context, query utils.LogQuery) ([]utils.LogMessage, error) {
+	s.record("query")
+	return s.LogStore.GetLogMessages(ctx, query)
+}
+
+// TestWorkerPool_WeightedQueues tests that fetch jobs don't wait behind a backlog of store jobs.
+func TestWorkerPool_WeightedQueues(t *testing.T) {
+	store := &recordingStore{LogStore: storage.NewMemoryStorage()}
+	wp := internal.NewWorkerPool(0, nil, store, nil, nil)
+	for i := 0; i < 20; i++ {
+		wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: testBatch("backlog")})
+	}
+	results := make(chan utils.JobResult, 2)
+	for i := 0; i < 2; i++ {
+		wp.AddJob(utils.Job{Type: utils.FetchJob, Done: results})
+	}
+
+	// A single worker makes the order deterministic
+	wp.Resize(1)
+	wp.Shutdown(context.Background())
+
+	if len(store.ops) != 22 {
+		t.Fatalf("Expected 22 operations, got %d", len(store.ops))
+	}
+	queries := 0
+	for _, op := range store.ops[:5] {
+		if op == "query" {
+			queries++
+		}
+	}
+	if queries != 2 {
+		t.Errorf("Expected both queries among the first operations, got %v", store.ops[:5])
+	}
+}
+
+// TestWorkerPool_CanceledJobs tests that jobs canceled while waiting for room or a worker are given up on.
+func TestWorkerPool_CanceledJobs(t *testing.T) {
+	store := &recordingStore{LogStore: storage.NewMemoryStorage()}
+	wp := internal.NewWorkerPool(0, map[utils.JobType]internal.QueueConfig{utils.FetchJob: {Capacity: 2}}, store, nil, nil)
+	defer wp.Stop()
+
+	// Nobody reads the result of the canceled job, which must not hold up the worker
+	ctx, cancel := context.WithCancel(context.Background())
+	wp.AddJob(utils.Job{Ctx: ctx, Type: utils.FetchJob, Done: make(chan utils.JobResult)})
+	cancel()
+	results := make(chan utils.JobResult, 1)
+	wp.AddJob(utils.Job{Type: utils.FetchJob, Done: results})
+
+	// The queue is full until a worker comes along
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := wp.AddJob(utils.Job{Ctx: ctx, Type: utils.FetchJob, Done: results}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to pass while the queue is full, got %v", err)
+	}
+
+	wp.Resize(1)
+	select {
+	case <-results:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the worker to process the job after the canceled one")
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.ops) != 1 {
+		t.Errorf("Expected only the live job to query storage, got %v", store.ops)
+	}
+}
+
+// failingStore fails inserts and queries with err unless it is nil
+type failingStore struct {
+	storage.LogStore
+	err error
+}
+
+func (s *failingStore) InsertLogMessages(ctx context.Context, logs []utils.LogMessage) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.LogStore.InsertLogMessages(ctx, logs)
+}
+
+func (s *failingStore) GetLogMessages(ctx context.Context, query utils.LogQuery) ([]utils.LogMessage, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.LogStore.GetLogMessages(ctx, query)
+}
+
+// TestWorkerPool_Results tests that jobs report their data, or why they failed, to their submitter and hook.
+func TestWorkerPool_Results(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind utils.ErrorKind
+	}{
+		{"success", nil, utils.ErrorNone},
+		{"storage failure", errors.New("connection refused"), utils.ErrorStorage},
+		{"invalid query", fmt.Errorf("%w: invalid field name", storage.ErrInvalidQuery), utils.ErrorInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &failingStore{LogStore: storage.NewMemoryStorage(), err: tt.err}
+			wp := internal.NewWorkerPool(1, nil, store, nil, nil)
+			defer wp.Stop()
+
+			// Batches failing on storage are retried instead of reporting their failure
+			if tt.kind != utils.ErrorStorage {
+				stored := make(chan utils.JobResult, 1)
+				wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: testBatch("hello"), OnDone: func(result utils.JobResult) { stored <- result }})
+				if result := <-stored; result.Kind != tt.kind || !errors.Is(result.Err, tt.err) || (tt.err == nil && result.Stored != 1) {
+					t.Errorf("Unexpected store result %+v", result)
+				}
+			}
+
+			fetched := make(chan utils.JobResult, 1)
+			wp.AddJob(utils.Job{Type: utils.FetchJob, Done: fetched})
+			result := <-fetched
+			if result.Kind != tt.kind || !errors.Is(result.Err, tt.err) || result.Duration <= 0 {
+				t.Errorf("Unexpected fetch result %+v", result)
+			}
+			if tt.err == nil && len(result.Logs) != 1 {
+				t.Errorf("Expected the stored log to be fetched, got %v", result.Logs)
+			}
+		})
+	}
+}
+
+// flakyStore fails the first inserts, then stores the logs
+type flakyStore struct {
+	storage.LogStore
+	failures int32
+}
+
+func (s *flakyStore) InsertLogMessages(ctx context.Context, logs []utils.LogMessage) error {
+	if atomic.AddInt32(&s.failures, -1) >= 0 {
+		return errors.New("connection refused")
+	}
+	return s.LogStore.InsertLogMessages(ctx, logs)
+}
+
+// TestWorkerPool_RetriesFailedBatches tests that a batch failing to be stored is queued again until it is stored and acknowledged.
+func TestWorkerPool_RetriesFailedBatches(t *testing.T) {
+	wal, err := internal.OpenWAL(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+	defer wal.Close()
+	store := &flakyStore{LogStore: storage.NewMemoryStorage(), failures: 1}
+	wp := internal.NewWorkerPool(1, nil, store, wal, nil)
+	defer wp.Stop()
+
+	logs := testBatch("retried")
+	seq, _ := wal.Append(logs)
+	stored := make(chan utils.JobResult, 1)
+	wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: logs, WALSeq: seq, OnDone: func(result utils.JobResult) { stored <- result }})
+	queued := wp.QueuedBytes()
+	for atomic.LoadInt32(&store.failures) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The failed batch keeps its logs charged to the memory budget while it waits for the retry
+	if wp.QueuedBytes() != queued || queued == 0 {
+		t.Errorf("Expected %d bytes to stay queued while retrying, got %d", queued, wp.QueuedBytes())
+	}
+
+	select {
+	case result := <-stored:
+		if result.Err != nil || result.Stored != 1 {
+			t.Errorf("Expected the retry to store the batch, got %+v", result)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the batch to be retried")
+	}
+	if found, _ := store.GetLogMessages(context.Background(), utils.LogQuery{}); len(found) != 1 {
+		t.Errorf("Expected the batch to be stored once, got %d logs", len(found))
+	}
+	if pending := wal.Pending(); len(pending) != 0 {
+		t.Errorf("Expected the stored batch to be acknowledged in the WAL, %d pending", len(pending))
+	}
+	if wp.QueuedBytes() != 0 {
+		t.Errorf("Expected the stored batch to release its bytes, %d queued", wp.QueuedBytes())
+	}
+}
+
+// TestWorkerPool_ShutdownRetries tests that batches waiting for a retry at shutdown are left in the WAL.
+func TestWorkerPool_ShutdownRetries(t *testing.T) {
+	store := &flakyStore{LogStore: storage.NewMemoryStorage(), failures: 1}
+	wp := internal.NewWorkerPool(1, nil, store, nil, nil)
+	stored := make(chan utils.JobResult, 1)
+	wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: testBatch("retried"), OnDone: func(result utils.JobResult) { stored <- result }})
+	for atomic.LoadInt32(&store.failures) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	report := wp.Shutdown(context.Background())
+	if report.Dropped != 1 || report.Flushed != 0 || wp.QueuedBytes() != 0 {
+		t.Errorf("Expected the batch waiting for a retry to be dropped, got %+v with %d bytes queued", report, wp.QueuedBytes())
+	}
+	if result := <-stored; result.Kind != utils.ErrorStorage {
+		t.Errorf("Expected the last failure to be reported, got %+v", result)
+	}
+}
+
+// TestWorkerPool_Backpressure tests that jobs are turned away once their queue stays full for the submit wait
+// or their logs would exceed the memory budget, which frees up as the jobs are processed.
+func TestWorkerPool_Backpressure(t *testing.T) {
+	store := &blockingStore{LogStore: storage.NewMemoryStorage(), started: make(chan struct{}, 1), release: make(chan struct{})}
+	wp := internal.NewWorkerPool(1, map[utils.JobType]internal.QueueConfig{utils.StoreJob: {Capacity: 1}}, store, nil, nil)
+	defer wp.Stop()
+	wp.SetSubmitLimits(20*time.Millisecond, 0)
+
+	// One batch keeps the worker busy, the next fills the queue
+	for i := 0; i < 2; i++ {
+		if err := wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: testBatch("held")}); err != nil {
+			t.Fatalf("Failed to add job: %v", err)
+		}
+		if i == 0 {
+			<-store.started
+		}
+	}
+	start := time.Now()
+	if err := wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: testBatch("overflow")}); !errors.Is(err, internal.ErrQueueFull) {
+		t.Errorf("Expected the job to be turned away with a full queue, got %v", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("Expected the submission to wait for room, gave up after %v", waited)
+	}
+
+	wp.SetSubmitLimits(time.Second, wp.QueuedBytes())
+	if err := wp.AddJob(utils.Job{Type: utils.StoreJob, Logs: testBatch("overflow")}); !errors.Is(err, internal.ErrMemoryBudget) {
+		t.Errorf("Expected the job to be turned away over the memory budget, got %v", err)
+	}
+
+	close(store.release)
+	<-store.started
+	deadline := time.Now().Add(time.Second)
+	for wp.QueuedBytes() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if queued := wp.QueuedBytes(); queued != 0 {
+		t.Errorf("Expected the processed jobs to free the memory budget, %d bytes still queued", queued)
+	}
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import "strings"
+
+// Default holds the metrics of the aggregator, served on /metrics
+var Default = NewRegistry()
+
+var (
+	latencyBuckets   = []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	batchSizeBuckets = []float64{1, 5, 10, 50, 100, 500, 1000, 5000, 10000}
+)
+
+// Ingestion
+var (
+	IngestedLogs = Default.NewCounterVec("log_aggregator_ingested_logs_total",
+		"Logs accepted for storage by level, see LevelLabel.", "level")
+	IngestedBytes = Default.NewCounterVec("log_aggregator_ingested_bytes_total",
+		"Bytes of log payloads received by transport.", "transport")
+	BatchSize = Default.NewHistogramVec("log_aggregator_batch_size",
+		"Number of logs in the batches accepted for storage.", batchSizeBuckets)
+)
+
+// levelLabels maps the levels IngestedLogs counts on their own to their label
+var levelLabels = map[string]string{
+	"TRACE":   "TRACE",
+	"DEBUG":   "DEBUG",
+	"INFO":    "INFO",
+	"WARN":    "WARN",
+	"WARNING": "WARN",
+	"ERROR":   "ERROR",
+	"FATAL":   "FATAL",
+}
+
+// LevelLabel maps a client supplied log level to one of a fixed set of labels, "other" for unknown levels,
+// so clients can't create a series per made-up level
+func LevelLabel(level string) string {
+	if label, ok := levelLabels[strings.ToUpper(level)]; ok {
+		return label
+	}
+	return "other"
+}
+
+// Worker pool
+var (
+	JobWait = Default.NewHistogramVec("log_aggregator_job_wait_seconds",
+		"Time jobs spent queued before a worker picked them up by job type.", latencyBuckets, "type")
+	JobDuration = Default.NewHistogramVec("log_aggregator_job_duration_seconds",
+		"Time workers spent processing jobs by job type.", latencyBuckets, "type")
+	WorkerPoolResizes = Default.NewCounterVec("log_aggregator_worker_pool_resizes_total",
+		"Worker pool resizes by direction, grow or shrink.", "direction")
+	StoreRetries = Default.NewCounterVec("log_aggregator_store_retries_total",
+		"Failed store jobs queued again after a backoff.")
+	RejectedJobs = Default.NewCounterVec("log_aggregator_rejected_jobs_total",
+		"Jobs turned away for lack of room by job type and reason, queue_full or memory_budget.", "type", "reason")
+)
+
+// Storage
+var (
+	StorageDuration = Default.NewHistogramVec("log_aggregator_storage_duration_seconds",
+		"Latency of storage operations by operation.", latencyBuckets, "operation")
+	StorageErrors = Default.NewCounterVec("log_aggregator_storage_errors_total",
+		"Failed storage operations by operation.", "operation")
+)
+
+// Circuit breaker
+var (
+	CircuitBreakerTransitions = Default.NewCounterVec("log_aggregator_circuit_breaker_transitions_total",
+		"Circuit breaker state changes by breaker and state entered.", "breaker", "state")
+	CircuitBreakerRejections = Default.NewCounterVec("log_aggregator_circuit_breaker_rejections_total",
+		"Calls rejected while the circuit breaker was open by breaker.", "breaker")
+)
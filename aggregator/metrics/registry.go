@@ -0,0 +1,250 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metrics and writes them in the Prometheus text exposition format
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// metric is a counter or histogram family
+type metric interface {
+	write(w io.Writer) error
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Write writes every registered metric in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// labelEscaper escapes label values as the text format expects
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// family holds what every metric family has in common
+type family struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// key joins label values into a map key
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats the label values, plus extra pairs, as {name="value",...}
+func (f *family) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	if len(f.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, f.labels[i]+`="`+labelEscaper.Replace(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *family) header(w io.Writer, kind string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, kind)
+	return err
+}
+
+// CounterVec is a family of counters partitioned by label values
+type CounterVec struct {
+	family
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec registers a counter family with the given label names
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{family: family{name: name, help: help, labels: labels}, values: make(map[string]float64)}
+	r.register(c)
+	return c
+}
+
+// Add increases the counter with the label values by delta, which must not be negative
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	c.values[key] += delta
+	c.mu.Unlock()
+}
+
+// Inc increases the counter with the label values by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns the counter with the label values
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	if err := c.header(w, "counter"); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(key), formatFloat(c.values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HistogramVec is a family of histograms partitioned by label values
+type HistogramVec struct {
+	family
+	buckets []float64 // Upper bounds, ascending
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec registers a histogram family with the given bucket upper bounds and label names
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{family: family{name: name, help: help, labels: labels}, buckets: buckets, values: make(map[string]*histogram)}
+	r.register(h)
+	return h
+}
+
+// Observe records a value in the histogram with the label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += value
+}
+
+// Count returns the number of observations of the histogram with the label values
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hist, ok := h.values[key]; ok {
+		return hist.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w io.Writer) error {
+	if err := h.header(w, "histogram"); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", formatFloat(bound)), cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.name, h.labelPairs(key, "le", "+Inf"), hist.count,
+			h.name, h.labelPairs(key), formatFloat(hist.sum),
+			h.name, h.labelPairs(key), hist.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteGauge writes a single gauge sampled at scrape time, labels are name/value pairs
+func WriteGauge(w io.Writer, name, help string, value float64, labels ...string) error {
+	f := family{name: name, help: help}
+	if err := f.header(w, "gauge"); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s%s %s\n", name, f.labelPairs("", labels...), formatFloat(value))
+	return err
+}
+
+// WriteGaugeVec writes a gauge family sampled at scrape time, with a sample per value of the label
+func WriteGaugeVec(w io.Writer, name, help, label string, values map[string]float64) error {
+	f := family{name: name, help: help, labels: []string{label}}
+	if err := f.header(w, "gauge"); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(values) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", name, f.labelPairs(key), formatFloat(values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,50 @@
+package metrics_test
+
+import (
+	"bytes"
+	"log-aggregator/aggregator/metrics"
+	"strings"
+	"testing"
+)
+
+// TestRegistry_Write tests that counters, histograms and gauges are written in the Prometheus text format.
+func TestRegistry_Write(t *testing.T) {
+	registry := metrics.NewRegistry()
+	counter := registry.NewCounterVec("test_logs_total", "Logs by level.", "level")
+	histogram := registry.NewHistogramVec("test_duration_seconds", "Durations.", []float64{0.1, 1}, "type")
+
+	counter.Inc("ERROR")
+	counter.Add(2, `say "hi"`)
+	histogram.Observe(0.05, "fetch")
+	histogram.Observe(1, "fetch")
+	histogram.Observe(3, "fetch")
+
+	var out bytes.Buffer
+	registry.Write(&out)
+	metrics.WriteGauge(&out, "test_queue_depth", "Queued jobs.", 4)
+	metrics.WriteGaugeVec(&out, "test_queue_jobs", "Queued jobs by type.", "type", map[string]float64{"store": 3, "fetch": 1})
+
+	want := strings.Join([]string{
+		"# HELP test_logs_total Logs by level.",
+		"# TYPE test_logs_total counter",
+		`test_logs_total{level="ERROR"} 1`,
+		`test_logs_total{level="say \"hi\""} 2`,
+		"# HELP test_duration_seconds Durations.",
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{type="fetch",le="0.1"} 1`,
+		`test_duration_seconds_bucket{type="fetch",le="1"} 2`,
+		`test_duration_seconds_bucket{type="fetch",le="+Inf"} 3`,
+		`test_duration_seconds_sum{type="fetch"} 4.05`,
+		`test_duration_seconds_count{type="fetch"} 3`,
+		"# HELP test_queue_depth Queued jobs.",
+		"# TYPE test_queue_depth gauge",
+		"test_queue_depth 4",
+		"# HELP test_queue_jobs Queued jobs by type.",
+		"# TYPE test_queue_jobs gauge",
+		`test_queue_jobs{type="fetch"} 1`,
+		`test_queue_jobs{type="store"} 3`,
+	}, "\n") + "\n"
+	if out.String() != want {
+		t.Errorf("Unexpected exposition:\n%s\nexpected:\n%s", out.String(), want)
+	}
+}
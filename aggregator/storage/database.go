@@ -2,8 +2,11 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -17,8 +20,8 @@ type Storage struct {
 // NewStorage initializes a new Storage instance and connects to MongoDB
 // reference https://stackoverflow.com/questions/71893934/how-to-connect-to-mongodb-running-inside-one-container-from-golang-app-container
 func NewStorage(uri, dbName, collectionName string) (*Storage, error) {
-	// Set MongoDB client options
-	clientOptions := options.Client().ApplyURI(uri)
+	// Set MongoDB client options, decoding nested field documents as maps so they encode back to JSON objects
+	clientOptions := options.Client().ApplyURI(uri).SetBSONOptions(&options.BSONOptions{DefaultDocumentM: true})
 	// Connect to MongoDB
 	client, err := mongo.Connect(context.TODO(), clientOptions)
 	if err != nil {
@@ -33,12 +36,60 @@ func NewStorage(uri, dbName, collectionName string) (*Storage, error) {
 
 	collection := client.Database(dbName).Collection(collectionName)
 
+	// Index the (time, _id) order retrievals are sorted and paged by
+	_, err = collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys: bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create time index: %v", err)
+	}
+
+	// Index the message words for full-text search, without stemming so words match as typed
+	_, err = collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "message", Value: "text"}},
+		Options: options.Index().SetDefaultLanguage("none"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create text index: %v", err)
+	}
+
 	return &Storage{
 		client:     client,
 		collection: collection,
 	}, nil
 }
 
+// retentionIndexName names the TTL index expiring logs past the retention policy's max age
+const retentionIndexName = "retention_ttl"
+
+// SetRetentionTTL lets MongoDB expire logs older than maxAge through a TTL index, which is dropped when maxAge is 0.
+// TTL indexes can't tell levels apart, so policies with per-level overrides are left to the janitor.
+func (s *Storage) SetRetentionTTL(ctx context.Context, maxAge time.Duration) error {
+	// The index is recreated since its expiry can't be changed in place without collMod
+	if _, err := s.collection.Indexes().DropOne(ctx, retentionIndexName); err != nil {
+		var cmdErr mongo.CommandError
+		if !errors.As(err, &cmdErr) || cmdErr.Name != "IndexNotFound" {
+			return fmt.Errorf("failed to drop TTL index: %v", err)
+		}
+	}
+	if maxAge <= 0 {
+		return nil
+	}
+	_, err := s.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "time", Value: 1}},
+		Options: options.Index().SetName(retentionIndexName).SetExpireAfterSeconds(int32(maxAge.Seconds())),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create TTL index: %v", err)
+	}
+	return nil
+}
+
+// Ping checks the connection to MongoDB
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, nil)
+}
+
 // Close closes the MongoDB client connection
 func (s *Storage) Close() error {
 	return s.client.Disconnect(context.TODO())
@@ -0,0 +1,564 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log-aggregator/aggregator/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// segmentDuration is the time partition covered by a single segment file
+	segmentDuration = time.Hour
+	segmentExt      = ".seg"
+	// recordHeaderSize is the length and crc32 prefixed to every record
+	recordHeaderSize = 8
+)
+
+// DiskStorage is an embedded LogStore writing logs to append-only, time-partitioned segment files.
+// Only the newest segment, which takes nearly every append, keeps its file open, older ones are opened when used.
+type DiskStorage struct {
+	mu       sync.RWMutex
+	dir      string
+	segments map[int64]*segment // Keyed by the unix start of the segment's partition
+}
+
+// segment is a single append-only file holding every log in one time partition
+type segment struct {
+	start    int64
+	file     *os.File // Open while the segment is the newest, nil otherwise
+	size     int64
+	minTime  time.Time
+	maxTime  time.Time
+	levels   map[string]int // Number of records per level, used to skip whole segments
+	index    []indexEntry
+	postings map[string][]int // Inverted index from message words to positions in index
+}
+
+// indexEntry locates a single record within a segment
+type indexEntry struct {
+	time   time.Time
+	level  string
+	offset int64
+	length int32
+}
+
+// NewDiskStorage opens (or creates) the segment files in dir and rebuilds their indexes
+func NewDiskStorage(dir string) (*DiskStorage, error) {
+	if dir == "" {
+		return nil, errors.New("disk storage requires a data directory")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+
+	d := &DiskStorage{dir: dir, segments: make(map[int64]*segment)}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list segments: %v", err)
+	}
+	for _, path := range paths {
+		start, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), segmentExt), 10, 64)
+		if err != nil {
+			continue // Not one of ours
+		}
+		seg, err := openSegment(path, start)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.segments[start] = seg
+	}
+	if err := d.keepNewestOpen(); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// openSegment opens a segment file and rebuilds its index, truncating any torn write at the tail.
+// The file is closed again once indexed.
+func openSegment(path string, start int64) (*segment, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment %s: %v", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat segment %s: %v", path, err)
+	}
+	defer file.Close()
+	seg := &segment{start: start, levels: make(map[string]int), postings: make(map[string][]int)}
+
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := file.ReadAt(header, seg.size); err != nil {
+			break // EOF or a partial header
+		}
+		length := int32(binary.LittleEndian.Uint32(header[0:4]))
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+		if length <= 0 || int64(length) > info.Size()-seg.size-recordHeaderSize {
+			break // Corrupt length, treated like any other torn tail
+		}
+
+		payload := make([]byte, length)
+		if _, err := file.ReadAt(payload, seg.size+recordHeaderSize); err != nil || crc32.ChecksumIEEE(payload) != checksum {
+			break // Record was only partially written
+		}
+
+		var log utils.LogMessage
+		if err := json.Unmarshal(payload, &log); err != nil {
+			break
+		}
+		seg.add(log, seg.size, length)
+		seg.size += recordHeaderSize + int64(length)
+	}
+
+	// Drop whatever follows the last complete record so new appends stay readable
+	if err := file.Truncate(seg.size); err != nil {
+		return nil, fmt.Errorf("failed to truncate segment %s: %v", path, err)
+	}
+	return seg, nil
+}
+
+// add records a log in the segment's index
+func (seg *segment) add(log utils.LogMessage, offset int64, length int32) {
+	if len(seg.index) == 0 || log.Timestamp.Before(seg.minTime) {
+		seg.minTime = log.Timestamp
+	}
+	if len(seg.index) == 0 || log.Timestamp.After(seg.maxTime) {
+		seg.maxTime = log.Timestamp
+	}
+	seg.levels[log.Level]++
+	addPostings(seg.postings, log.Message, len(seg.index))
+	seg.index = append(seg.index, indexEntry{time: log.Timestamp, level: log.Level, offset: offset, length: length})
+}
+
+// InsertLogMessages appends the log messages to the segments covering their timestamps and syncs them to disk
+func (d *DiskStorage) InsertLogMessages(ctx context.Context, logs []utils.LogMessage) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// Checked once the lock is held, a batch is then written whole or fails on an I/O error
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	touched := make(map[int64]*os.File)
+	for _, log := range logs {
+		log.Timestamp = log.Timestamp.UTC().Truncate(time.Millisecond)
+		log.ID = "" // Derived from the record position when read
+
+		seg, err := d.segmentFor(log.Timestamp)
+		if err != nil {
+			return err
+		}
+
+		payload, err := json.Marshal(log)
+		if err != nil {
+			return fmt.Errorf("failed to encode log message: %v", err)
+		}
+		record := make([]byte, recordHeaderSize+len(payload))
+		binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+		copy(record[recordHeaderSize:], payload)
+
+		file, ok := touched[seg.start]
+		if !ok {
+			var release func()
+			if file, release, err = d.fileOf(seg); err != nil {
+				return err
+			}
+			defer release()
+			touched[seg.start] = file
+		}
+		if _, err := file.WriteAt(record, seg.size); err != nil {
+			return fmt.Errorf("failed to write log message: %v", err)
+		}
+		seg.add(log, seg.size, int32(len(payload)))
+		seg.size += int64(len(record))
+	}
+
+	for _, file := range touched {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync segment: %v", err)
+		}
+	}
+	// The batch may have started a newer segment
+	return d.keepNewestOpen()
+}
+
+// segmentFor returns the segment covering the timestamp, creating it if needed with its file left closed
+func (d *DiskStorage) segmentFor(ts time.Time) (*segment, error) {
+	start := ts.Truncate(segmentDuration).Unix()
+	if seg, ok := d.segments[start]; ok {
+		return seg, nil
+	}
+	seg, err := openSegment(d.segmentPath(start), start)
+	if err != nil {
+		return nil, err
+	}
+	d.segments[start] = seg
+	return seg, nil
+}
+
+// keepNewestOpen keeps the file of the newest segment open for appends and closes those of the older segments,
+// the caller holds the lock for writing
+func (d *DiskStorage) keepNewestOpen() error {
+	var newest *segment
+	for _, seg := range d.segments {
+		if newest == nil || seg.start > newest.start {
+			newest = seg
+		}
+	}
+	for _, seg := range d.segments {
+		if seg != newest && seg.file != nil {
+			seg.file.Close()
+			seg.file = nil
+		}
+	}
+	if newest != nil && newest.file == nil {
+		file, err := os.OpenFile(d.segmentPath(newest.start), os.O_RDWR, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open segment: %v", err)
+		}
+		newest.file = file
+	}
+	return nil
+}
+
+// fileOf returns the file of the segment, opened for the caller when the segment isn't the newest.
+// release closes the file opened for the caller.
+func (d *DiskStorage) fileOf(seg *segment) (file *os.File, release func(), err error) {
+	if seg.file != nil {
+		return seg.file, func() {}, nil
+	}
+	if file, err = os.OpenFile(d.segmentPath(seg.start), os.O_RDWR, 0o644); err != nil {
+		return nil, nil, fmt.Errorf("failed to open segment: %v", err)
+	}
+	return file, func() { file.Close() }, nil
+}
+
+// segmentPath returns the path of the segment file starting at start
+func (d *DiskStorage) segmentPath(start int64) string {
+	return filepath.Join(d.dir, strconv.FormatInt(start, 10)+segmentExt)
+}
+
+// GetLogMessages retrieves the page of log messages matching the query
+func (d *DiskStorage) GetLogMessages(ctx context.Context, query utils.LogQuery) ([]utils.LogMessage, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Use the index to find the records in range without reading them
+	type candidate struct {
+		seg   *segment
+		entry indexEntry
+		key   utils.LogMessage
+	}
+	var candidates []candidate
+	terms := utils.Tokenize(query.Text)
+	for _, seg := range d.segments {
+		if !seg.mayMatch(query) {
+			continue
+		}
+		for _, entry := range seg.entries(terms) {
+			key := utils.LogMessage{ID: seg.recordID(entry), Timestamp: entry.time, Level: entry.level}
+			if matchesTimeAndLevel(key, query) && isAfterCursor(key, query) {
+				candidates = append(candidates, candidate{seg: seg, entry: entry, key: key})
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if query.Order == utils.OrderDesc {
+			return compareLogs(candidates[i].key, candidates[j].key) > 0
+		}
+		return compareLogs(candidates[i].key, candidates[j].key) < 0
+	})
+
+	// Read the candidates in order until the page is full, ranking needs every match
+	ranked := query.Order == utils.OrderRelevance
+	var logs []utils.LogMessage
+	// Candidates of a segment are next to each other, so a single segment file is open at a time
+	var current *segment
+	var file *os.File
+	release := func() {}
+	defer func() { release() }()
+	for _, c := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if c.seg != current {
+			release()
+			var err error
+			if file, release, err = d.fileOf(c.seg); err != nil {
+				release = func() {}
+				return nil, err
+			}
+			current = c.seg
+		}
+		log, err := c.seg.read(file, c.entry)
+		if err != nil {
+			return nil, err
+		}
+		if !MatchesQuery(log, query) {
+			continue
+		}
+		logs = append(logs, log)
+		if !ranked && query.Limit > 0 && len(logs) == query.Limit {
+			break
+		}
+	}
+	if ranked {
+		return paginate(logs, query), nil
+	}
+	return logs, nil
+}
+
+// GetLogStats counts the log messages matching the filter per time bucket and group
+func (d *DiskStorage) GetLogStats(ctx context.Context, query utils.StatsQuery) ([]utils.StatsBucket, error) {
+	filter := query.Filter
+	filter.Limit, filter.Order, filter.After = 0, utils.OrderAsc, nil
+	logs, err := d.GetLogMessages(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return countStats(logs, query), nil
+}
+
+// entries returns the index entries of the records containing every term, or all of them without terms
+func (seg *segment) entries(terms []string) []indexEntry {
+	if len(terms) == 0 {
+		return seg.index
+	}
+	positions := intersectPostings(seg.postings, terms)
+	entries := make([]indexEntry, len(positions))
+	for i, position := range positions {
+		entries[i] = seg.index[position]
+	}
+	return entries
+}
+
+// mayMatch uses the segment summary to skip segments that cannot contain matching logs
+func (seg *segment) mayMatch(query utils.LogQuery) bool {
+	if len(seg.index) == 0 {
+		return false
+	}
+	if query.LogLevel != "" && seg.levels[query.LogLevel] == 0 {
+		return false
+	}
+	if !query.StartTime.IsZero() && !query.EndTime.IsZero() {
+		if seg.maxTime.Before(query.StartTime) || seg.minTime.After(query.EndTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// read decodes the record referenced by the index entry from the segment's file
+func (seg *segment) read(file *os.File, entry indexEntry) (utils.LogMessage, error) {
+	var log utils.LogMessage
+	payload := make([]byte, entry.length)
+	if _, err := file.ReadAt(payload, entry.offset+recordHeaderSize); err != nil && err != io.EOF {
+		return log, fmt.Errorf("failed to read log message: %v", err)
+	}
+	if err := json.Unmarshal(payload, &log); err != nil {
+		return log, fmt.Errorf("failed to decode log message: %v", err)
+	}
+	log.ID = seg.recordID(entry)
+	return log, nil
+}
+
+// recordID identifies a record by its segment and offset, fixed width so IDs sort in write order
+func (seg *segment) recordID(entry indexEntry) string {
+	return fmt.Sprintf("%011d-%012d", seg.start, entry.offset)
+}
+
+// DeleteExpired removes the segments whose logs have all expired and rewrites the segments holding some expired logs.
+// Rewritten records move, so cursors into those segments may skip or repeat logs.
+func (d *DiskStorage) DeleteExpired(ctx context.Context, cutoffs RetentionCutoffs) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var deleted int64
+	for _, seg := range d.segments {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		expired := 0
+		for _, entry := range seg.index {
+			if cutoffs.Expired(entry.time, entry.level) {
+				expired++
+			}
+		}
+		if expired == 0 {
+			continue
+		}
+
+		var err error
+		if expired == len(seg.index) {
+			err = d.removeSegment(seg)
+		} else {
+			err = d.rewriteSegment(seg, func(entry indexEntry) bool { return !cutoffs.Expired(entry.time, entry.level) })
+		}
+		if err != nil {
+			return deleted, err
+		}
+		deleted += int64(expired)
+	}
+	return deleted, nil
+}
+
+// Size returns the bytes used by the segment files
+func (d *DiskStorage) Size(ctx context.Context) (int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, seg := range d.segments {
+		size += seg.size
+	}
+	return size, nil
+}
+
+// TrimToSize removes the oldest segments until at most maxSize bytes are used.
+// Whole segments are removed, so up to a partition more than needed may go.
+func (d *DiskStorage) TrimToSize(ctx context.Context, maxSize int64) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var size int64
+	starts := make([]int64, 0, len(d.segments))
+	for start, seg := range d.segments {
+		size += seg.size
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	var deleted int64
+	for _, start := range starts {
+		if size <= maxSize {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		seg := d.segments[start]
+		if err := d.removeSegment(seg); err != nil {
+			return deleted, err
+		}
+		size -= seg.size
+		deleted += int64(len(seg.index))
+	}
+	return deleted, nil
+}
+
+// removeSegment closes and deletes a segment file
+func (d *DiskStorage) removeSegment(seg *segment) error {
+	if seg.file != nil {
+		seg.file.Close()
+		seg.file = nil
+	}
+	delete(d.segments, seg.start)
+	if err := os.Remove(d.segmentPath(seg.start)); err != nil {
+		return fmt.Errorf("failed to remove segment: %v", err)
+	}
+	return d.keepNewestOpen()
+}
+
+// rewriteSegment copies the records to keep into a new file which then atomically replaces the segment
+func (d *DiskStorage) rewriteSegment(seg *segment, keep func(indexEntry) bool) error {
+	path := d.segmentPath(seg.start)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	file, release, err := d.fileOf(seg)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	defer release()
+
+	for _, entry := range seg.index {
+		if !keep(entry) {
+			continue
+		}
+		record := make([]byte, recordHeaderSize+int64(entry.length))
+		if _, err := file.ReadAt(record, entry.offset); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to read log message: %v", err)
+		}
+		if _, err := tmp.Write(record); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write log message: %v", err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync segment: %v", err)
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace segment: %v", err)
+	}
+	if seg.file != nil {
+		seg.file.Close()
+		seg.file = nil
+	}
+	rewritten, err := openSegment(path, seg.start)
+	if err != nil {
+		delete(d.segments, seg.start)
+		return err
+	}
+	d.segments[seg.start] = rewritten
+	return d.keepNewestOpen()
+}
+
+// Ping checks that the data directory is still there
+func (d *DiskStorage) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(d.dir); err != nil {
+		return fmt.Errorf("data directory unavailable: %v", err)
+	}
+	return nil
+}
+
+// Close closes every open segment file
+func (d *DiskStorage) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var firstErr error
+	for start, seg := range d.segments {
+		if seg.file == nil {
+			delete(d.segments, start)
+			continue
+		}
+		if err := seg.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(d.segments, start)
+	}
+	return firstErr
+}
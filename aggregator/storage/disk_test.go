@@ -0,0 +1,284 @@
+package storage_test
+
+import (
+	"context"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestDiskStorage_SurvivesRestart tests that logs written to disk are readable after reopening the store.
+func TestDiskStorage_SurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2024, 10, 8, 0, 30, 0, 0, time.UTC)
+
+	store, err := storage.NewDiskStorage(dir)
+	if err != nil {
+		t.Fatalf("Failed to open disk storage: %v", err)
+	}
+	err = store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: base, Level: "ERROR", Message: "Database connection failed.", Service: "db", Fields: map[string]interface{}{"attempt": 3}},
+		{Timestamp: base.Add(time.Hour), Level: "INFO", Message: "User login successful."},
+		{Timestamp: base.Add(2 * time.Hour), Level: "WARNING", Message: "High memory usage detected."},
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert logs: %v", err)
+	}
+	store.Close()
+
+	store, err = storage.NewDiskStorage(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk storage: %v", err)
+	}
+	defer store.Close()
+
+	all, err := store.GetLogMessages(context.Background(), utils.LogQuery{})
+	if err != nil {
+		t.Fatalf("Failed to get logs: %v", err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("Expected 3 logs after restart, got %d", len(all))
+	}
+	if all[0].Message != "Database connection failed." || !all[0].Timestamp.Equal(base) {
+		t.Errorf("Unexpected first log: %v", all[0])
+	}
+
+	attempts, _ := store.GetLogMessages(context.Background(), utils.LogQuery{Service: "db", Fields: map[string]string{"attempt": "3"}})
+	if len(attempts) != 1 {
+		t.Errorf("Expected the structured fields to survive a restart, got %v", attempts)
+	}
+
+	ranged, _ := store.GetLogMessages(context.Background(), utils.LogQuery{StartTime: base.Add(30 * time.Minute), EndTime: base.Add(3 * time.Hour), LogLevel: "WARNING"})
+	if len(ranged) != 1 || ranged[0].Level != "WARNING" {
+		t.Errorf("Expected one WARNING log in range, got %v", ranged)
+	}
+}
+
+// TestDiskStorage_TornWrite tests that a partially written record is discarded on open.
+func TestDiskStorage_TornWrite(t *testing.T) {
+	dir := t.TempDir()
+	ts := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+
+	store, _ := storage.NewDiskStorage(dir)
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{{Timestamp: ts, Level: "INFO", Message: "complete"}})
+	store.Close()
+
+	// Simulate a crash in the middle of appending a record
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(segments) != 1 {
+		t.Fatalf("Expected 1 segment file, got %d", len(segments))
+	}
+	f, _ := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0o644)
+	f.Write([]byte{42, 0, 0, 0, 1, 2})
+	f.Close()
+
+	store, err := storage.NewDiskStorage(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk storage: %v", err)
+	}
+	defer store.Close()
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{{Timestamp: ts, Level: "INFO", Message: "after crash"}})
+
+	logs, _ := store.GetLogMessages(context.Background(), utils.LogQuery{})
+	if len(logs) != 2 || logs[1].Message != "after crash" {
+		t.Errorf("Expected the torn record to be dropped, got %v", logs)
+	}
+}
+
+// TestDiskStorage_CorruptLength tests that a record header with an impossible length is discarded on open instead of being allocated.
+func TestDiskStorage_CorruptLength(t *testing.T) {
+	dir := t.TempDir()
+	ts := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+
+	store, _ := storage.NewDiskStorage(dir)
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{{Timestamp: ts, Level: "INFO", Message: "complete"}})
+	store.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(segments) != 1 {
+		t.Fatalf("Expected 1 segment file, got %d", len(segments))
+	}
+	for _, header := range [][]byte{
+		{0xff, 0xff, 0xff, 0x7f, 0, 0, 0, 0}, // Far larger than the file
+		{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, // Negative
+		{0, 0, 0, 0, 0, 0, 0, 0},             // Empty
+	} {
+		f, _ := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0o644)
+		f.Write(append(header, []byte("garbage")...))
+		f.Close()
+
+		store, err := storage.NewDiskStorage(dir)
+		if err != nil {
+			t.Fatalf("Failed to reopen disk storage: %v", err)
+		}
+		logs, _ := store.GetLogMessages(context.Background(), utils.LogQuery{})
+		store.Close()
+		if len(logs) != 1 || logs[0].Message != "complete" {
+			t.Errorf("Expected the corrupt record to be dropped, got %v", logs)
+		}
+		if info, _ := os.Stat(segments[0]); info.Size() == 0 {
+			t.Errorf("Expected the complete record to be kept")
+		}
+	}
+}
+
+// TestDiskStorage_Pagination tests paging through logs spread over several segments in descending order.
+func TestDiskStorage_Pagination(t *testing.T) {
+	store, _ := storage.NewDiskStorage(t.TempDir())
+	defer store.Close()
+
+	base := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		// Two logs share each timestamp so the ID breaks the tie
+		ts := base.Add(time.Duration(i/2) * time.Hour)
+		store.InsertLogMessages(context.Background(), []utils.LogMessage{{Timestamp: ts, Level: "INFO", Message: string(rune('a' + i))}})
+	}
+
+	var messages string
+	query := utils.LogQuery{Order: utils.OrderDesc, Limit: 2}
+	for {
+		page, err := store.GetLogMessages(context.Background(), query)
+		if err != nil {
+			t.Fatalf("Failed to get logs: %v", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, log := range page {
+			messages += log.Message
+		}
+		last := page[len(page)-1]
+		query.After = &utils.Cursor{Time: last.Timestamp, ID: last.ID}
+	}
+
+	if messages != "edcba" {
+		t.Errorf("Expected logs in descending order, got %q", messages)
+	}
+}
+
+// TestDiskStorage_TextSearch tests that full-text search uses the segment postings across restarts.
+func TestDiskStorage_TextSearch(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := storage.NewDiskStorage(dir)
+	base := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: base, Level: "ERROR", Message: "Database connection failed."},
+		{Timestamp: base.Add(2 * time.Hour), Level: "WARN", Message: "Connection pool exhausted, connection dropped"},
+		{Timestamp: base.Add(3 * time.Hour), Level: "INFO", Message: "User login successful."},
+	})
+	store.Close()
+
+	store, err := storage.NewDiskStorage(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk storage: %v", err)
+	}
+	defer store.Close()
+
+	logs, _ := store.GetLogMessages(context.Background(), utils.LogQuery{Text: "connection", Order: utils.OrderRelevance})
+	if len(logs) != 2 || logs[0].Level != "WARN" {
+		t.Errorf("Expected 2 connection logs with the WARN one ranked first, got %v", logs)
+	}
+
+	logs, _ = store.GetLogMessages(context.Background(), utils.LogQuery{Text: "connection failed", LogLevel: "ERROR"})
+	if len(logs) != 1 || logs[0].Message != "Database connection failed." {
+		t.Errorf("Expected only the database log, got %v", logs)
+	}
+}
+
+// TestDiskStorage_Stats tests that stats count the logs across segments.
+func TestDiskStorage_Stats(t *testing.T) {
+	store, _ := storage.NewDiskStorage(t.TempDir())
+	defer store.Close()
+
+	base := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		store.InsertLogMessages(context.Background(), []utils.LogMessage{{Timestamp: base.Add(time.Duration(i) * 30 * time.Minute), Level: "INFO", Service: "billing", Message: "tick"}})
+	}
+
+	buckets, err := store.GetLogStats(context.Background(), utils.StatsQuery{Interval: 2 * time.Hour, GroupBy: []string{"service"}})
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	if len(buckets) != 2 || buckets[0].Count != 4 || buckets[1].Count != 2 || buckets[1].Group["service"] != "billing" {
+		t.Errorf("Expected 4 then 2 billing logs, got %v", buckets)
+	}
+}
+
+// TestDiskStorage_Retention tests removing and rewriting segments holding expired logs, and trimming whole segments.
+func TestDiskStorage_Retention(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := storage.NewDiskStorage(dir)
+	now := time.Date(2024, 10, 8, 12, 0, 0, 0, time.UTC)
+
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: now.Add(-48 * time.Hour), Level: "INFO", Message: "expired segment"},
+		{Timestamp: now.Add(-24 * time.Hour), Level: "INFO", Message: "expired info"},
+		{Timestamp: now.Add(-24 * time.Hour), Level: "ERROR", Message: "kept error"},
+		{Timestamp: now, Level: "INFO", Message: "new info"},
+	})
+
+	policy := storage.RetentionPolicy{MaxAge: 12 * time.Hour, LevelMaxAge: map[string]time.Duration{"ERROR": 72 * time.Hour}}
+	deleted, err := store.DeleteExpired(context.Background(), policy.Cutoffs(now))
+	if err != nil || deleted != 2 {
+		t.Fatalf("Expected 2 expired logs to be deleted, got %d (%v)", deleted, err)
+	}
+	store.Close()
+
+	// The rewritten segment is read back after a restart
+	store, _ = storage.NewDiskStorage(dir)
+	defer store.Close()
+	logs, _ := store.GetLogMessages(context.Background(), utils.LogQuery{})
+	if len(logs) != 2 || logs[0].Message != "kept error" || logs[1].Message != "new info" {
+		t.Errorf("Expected the error and new log to remain, got %v", logs)
+	}
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*.seg")); len(segments) != 2 {
+		t.Errorf("Expected the fully expired segment to be removed, got %v", segments)
+	}
+
+	size, _ := store.Size(context.Background())
+	trimmed, _ := store.TrimToSize(context.Background(), size-1)
+	logs, _ = store.GetLogMessages(context.Background(), utils.LogQuery{})
+	if trimmed != 1 || len(logs) != 1 || logs[0].Message != "new info" {
+		t.Errorf("Expected the oldest segment to be trimmed, got %d trimmed leaving %v", trimmed, logs)
+	}
+}
+
+// TestDiskStorage_OpenFiles tests that only the newest segment keeps its file open while the older ones stay readable.
+func TestDiskStorage_OpenFiles(t *testing.T) {
+	openFiles := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("Open files can't be counted on this platform")
+		}
+		return len(entries)
+	}
+	dir := t.TempDir()
+	before := openFiles()
+
+	store, _ := storage.NewDiskStorage(dir)
+	base := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 48; i++ {
+		store.InsertLogMessages(context.Background(), []utils.LogMessage{{Timestamp: base.Add(time.Duration(i) * time.Hour), Level: "INFO", Message: "hourly"}})
+	}
+	if open := openFiles() - before; open != 1 {
+		t.Errorf("Expected 1 open segment file, got %d", open)
+	}
+	store.Close()
+
+	store, err := storage.NewDiskStorage(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk storage: %v", err)
+	}
+	defer store.Close()
+	logs, _ := store.GetLogMessages(context.Background(), utils.LogQuery{})
+	if len(logs) != 48 {
+		t.Errorf("Expected 48 logs across the segments, got %d", len(logs))
+	}
+	if open := openFiles() - before; open != 1 {
+		t.Errorf("Expected 1 open segment file after reading, got %d", open)
+	}
+}
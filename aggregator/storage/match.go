@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"fmt"
+	"log-aggregator/aggregator/utils"
+	"sort"
+	"strings"
+)
+
+// MatchesQuery mirrors the semantics of Storage.buildFilter for backends and live tails filtering in-process
+func MatchesQuery(log utils.LogMessage, query utils.LogQuery) bool {
+	if !matchesTimeAndLevel(log, query) {
+		return false
+	}
+	if query.Service != "" && log.Service != query.Service {
+		return false
+	}
+	if query.Source != "" && log.Source != query.Source {
+		return false
+	}
+	if terms := utils.Tokenize(query.Text); len(terms) > 0 && utils.TextScore(log.Message, terms) == 0 {
+		return false
+	}
+	if query.MessageRegex != nil && !query.MessageRegex.MatchString(log.Message) {
+		return false
+	}
+	for name, want := range query.Fields {
+		value, ok := log.Fields[name]
+		if !ok || fmt.Sprint(value) != want {
+			return false
+		}
+	}
+	if query.Expr != nil && !evalQuery(query.Expr, log) {
+		return false
+	}
+	return true
+}
+
+// evalQuery evaluates a query language expression against a log
+func evalQuery(node utils.QueryNode, log utils.LogMessage) bool {
+	switch n := node.(type) {
+	case *utils.QueryAnd:
+		for _, child := range n.Children {
+			if !evalQuery(child, log) {
+				return false
+			}
+		}
+		return true
+	case *utils.QueryOr:
+		for _, child := range n.Children {
+			if evalQuery(child, log) {
+				return true
+			}
+		}
+		return false
+	case *utils.QueryNot:
+		return !evalQuery(n.Child, log)
+	case *utils.QueryTerm:
+		value, ok := termValue(n, log)
+		return ok && n.MatchValue(value)
+	}
+	return false
+}
+
+// termValue returns the value of the log the term compares against
+func termValue(term *utils.QueryTerm, log utils.LogMessage) (string, bool) {
+	switch term.Field {
+	case utils.QueryFieldLevel:
+		return log.Level, true
+	case utils.QueryFieldService:
+		return log.Service, true
+	case utils.QueryFieldSource:
+		return log.Source, true
+	case utils.QueryFieldMessage:
+		return log.Message, true
+	}
+	value, ok := log.Fields[term.StructuredField()]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
+
+// matchesTimeAndLevel checks only the time range and log level, which backends may index
+func matchesTimeAndLevel(log utils.LogMessage, query utils.LogQuery) bool {
+	// The time range only applies when both bounds are provided
+	if !query.StartTime.IsZero() && !query.EndTime.IsZero() {
+		if log.Timestamp.Before(query.StartTime) || log.Timestamp.After(query.EndTime) {
+			return false
+		}
+	}
+	if query.LogLevel != "" && log.Level != query.LogLevel {
+		return false
+	}
+	return true
+}
+
+// compareLogs orders logs by time, then by ID
+func compareLogs(a, b utils.LogMessage) int {
+	if c := a.Timestamp.Compare(b.Timestamp); c != 0 {
+		return c
+	}
+	return strings.Compare(a.ID, b.ID)
+}
+
+// sortLogs sorts the logs in the order requested by the query
+func sortLogs(logs []utils.LogMessage, query utils.LogQuery) {
+	sort.SliceStable(logs, func(i, j int) bool {
+		if query.Order == utils.OrderDesc {
+			return compareLogs(logs[i], logs[j]) > 0
+		}
+		return compareLogs(logs[i], logs[j]) < 0
+	})
+}
+
+// isAfterCursor reports whether the log sorts after the query's cursor
+func isAfterCursor(log utils.LogMessage, query utils.LogQuery) bool {
+	// Ranked results are paged by offset instead
+	if query.After == nil || query.Order == utils.OrderRelevance {
+		return true
+	}
+	c := compareLogs(log, utils.LogMessage{Timestamp: query.After.Time, ID: query.After.ID})
+	if query.Order == utils.OrderDesc {
+		return c < 0
+	}
+	return c > 0
+}
+
+// paginate sorts the matched logs and cuts out the page following the query's cursor
+func paginate(logs []utils.LogMessage, query utils.LogQuery) []utils.LogMessage {
+	if query.Order == utils.OrderRelevance {
+		return paginateByRelevance(logs, query)
+	}
+	sortLogs(logs, query)
+	page := logs[:0]
+	for _, log := range logs {
+		if !isAfterCursor(log, query) {
+			continue
+		}
+		page = append(page, log)
+		if query.Limit > 0 && len(page) == query.Limit {
+			break
+		}
+	}
+	return page
+}
+
+// paginateByRelevance ranks the matched logs by their text score, newest first on ties, and cuts out the page at the cursor's offset
+func paginateByRelevance(logs []utils.LogMessage, query utils.LogQuery) []utils.LogMessage {
+	terms := utils.Tokenize(query.Text)
+	for i := range logs {
+		logs[i].Score = utils.TextScore(logs[i].Message, terms)
+	}
+	sort.SliceStable(logs, func(i, j int) bool {
+		if logs[i].Score != logs[j].Score {
+			return logs[i].Score > logs[j].Score
+		}
+		return compareLogs(logs[i], logs[j]) > 0
+	})
+
+	if query.After != nil {
+		if query.After.Offset >= len(logs) {
+			return nil
+		}
+		logs = logs[query.After.Offset:]
+	}
+	if query.Limit > 0 && len(logs) > query.Limit {
+		logs = logs[:query.Limit]
+	}
+	return logs
+}
+
+// intersectPostings returns the positions present in the postings of every term, in ascending order
+func intersectPostings(postings map[string][]int, terms []string) []int {
+	var result []int
+	for i, term := range terms {
+		list := postings[term]
+		if i == 0 {
+			result = append([]int(nil), list...)
+			continue
+		}
+		// Both lists are sorted, so merge them
+		merged := result[:0]
+		for a, b := 0, 0; a < len(result) && b < len(list); {
+			switch {
+			case result[a] < list[b]:
+				a++
+			case result[a] > list[b]:
+				b++
+			default:
+				merged = append(merged, result[a])
+				a++
+				b++
+			}
+		}
+		result = merged
+	}
+	return result
+}
+
+// addPostings indexes the words of message at position
+func addPostings(postings map[string][]int, message string, position int) {
+	seen := make(map[string]bool)
+	for _, token := range utils.Tokenize(message) {
+		if !seen[token] {
+			seen[token] = true
+			postings[token] = append(postings[token], position)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"log-aggregator/aggregator/utils"
+	"sync"
+	"time"
+)
+
+// MemoryStorage is an in-memory LogStore, useful for local development and tests
+type MemoryStorage struct {
+	mu       sync.RWMutex
+	logs     []utils.LogMessage
+	postings map[string][]int // Inverted index from message words to positions in logs
+	nextID   uint64
+	size     int64 // Estimated bytes used by logs
+}
+
+// NewMemoryStorage initializes an empty in-memory store
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{postings: make(map[string][]int)}
+}
+
+// InsertLogMessages appends the log messages to the store
+func (m *MemoryStorage) InsertLogMessages(ctx context.Context, logs []utils.LogMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, log := range logs {
+		// Match the millisecond precision MongoDB stores timestamps with
+		log.Timestamp = log.Timestamp.UTC().Truncate(time.Millisecond)
+		// Fixed width IDs sort in insertion order
+		m.nextID++
+		log.ID = fmt.Sprintf("%016x", m.nextID)
+		addPostings(m.postings, log.Message, len(m.logs))
+		m.logs = append(m.logs, log)
+		m.size += LogSize(log)
+	}
+	return nil
+}
+
+// GetLogMessages retrieves the page of log messages matching the query
+func (m *MemoryStorage) GetLogMessages(ctx context.Context, query utils.LogQuery) ([]utils.LogMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return paginate(m.matching(query), query), nil
+}
+
+// GetLogStats counts the log messages matching the filter per time bucket and group
+func (m *MemoryStorage) GetLogStats(ctx context.Context, query utils.StatsQuery) ([]utils.StatsBucket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return countStats(m.matching(query.Filter), query), nil
+}
+
+// matching returns every stored log matching the query, the caller holds the lock
+func (m *MemoryStorage) matching(query utils.LogQuery) []utils.LogMessage {
+	var matched []utils.LogMessage
+	if terms := utils.Tokenize(query.Text); len(terms) > 0 {
+		// Only look at the logs containing every word
+		for _, position := range intersectPostings(m.postings, terms) {
+			if MatchesQuery(m.logs[position], query) {
+				matched = append(matched, m.logs[position])
+			}
+		}
+	} else {
+		for _, log := range m.logs {
+			if MatchesQuery(log, query) {
+				matched = append(matched, log)
+			}
+		}
+	}
+	return matched
+}
+
+// DeleteExpired drops the log messages past the cutoff of their level
+func (m *MemoryStorage) DeleteExpired(ctx context.Context, cutoffs RetentionCutoffs) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.removeWhere(func(log utils.LogMessage) bool { return cutoffs.Expired(log.Timestamp, log.Level) }), nil
+}
+
+// Size returns the estimated bytes used by the stored log messages
+func (m *MemoryStorage) Size(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size, nil
+}
+
+// TrimToSize drops the oldest log messages until at most maxSize bytes are used
+func (m *MemoryStorage) TrimToSize(ctx context.Context, maxSize int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.size <= maxSize {
+		return 0, nil
+	}
+
+	// Logs are stored in insertion order, which isn't necessarily the order of their timestamps
+	oldest := make([]utils.LogMessage, len(m.logs))
+	copy(oldest, m.logs)
+	sortLogs(oldest, utils.LogQuery{Order: utils.OrderAsc})
+	trimmed := make(map[string]bool)
+	for size := m.size; size > maxSize && len(trimmed) < len(oldest); {
+		log := oldest[len(trimmed)]
+		trimmed[log.ID] = true
+		size -= LogSize(log)
+	}
+	return m.removeWhere(func(log utils.LogMessage) bool { return trimmed[log.ID] }), nil
+}
+
+// removeWhere drops the logs matching remove and rebuilds the inverted index, the caller holds the lock
+func (m *MemoryStorage) removeWhere(remove func(utils.LogMessage) bool) int64 {
+	kept := m.logs[:0]
+	var removed int64
+	m.postings = make(map[string][]int)
+	for _, log := range m.logs {
+		if remove(log) {
+			removed++
+			m.size -= LogSize(log)
+			continue
+		}
+		addPostings(m.postings, log.Message, len(kept))
+		kept = append(kept, log)
+	}
+	m.logs = kept
+	return removed
+}
+
+// Ping only fails once ctx is done since there is nothing to reach
+func (m *MemoryStorage) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Close drops every stored log message
+func (m *MemoryStorage) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logs = nil
+	m.postings = make(map[string][]int)
+	m.size = 0
+	return nil
+}
@@ -0,0 +1,206 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log-aggregator/aggregator/storage"
+	"log-aggregator/aggregator/utils"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMemoryStorage_Filters tests that the in-memory store filters by time range and log level.
+func TestMemoryStorage_Filters(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	base := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+
+	err := store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: base, Level: "ERROR", Message: "Database connection failed."},
+		{Timestamp: base.Add(time.Hour), Level: "INFO", Message: "User login successful."},
+		{Timestamp: base.Add(2 * time.Hour), Level: "ERROR", Message: "High memory usage detected."},
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert logs: %v", err)
+	}
+
+	all, _ := store.GetLogMessages(context.Background(), utils.LogQuery{})
+	if len(all) != 3 {
+		t.Errorf("Expected 3 logs without filters, got %d", len(all))
+	}
+
+	errors, _ := store.GetLogMessages(context.Background(), utils.LogQuery{LogLevel: "ERROR"})
+	if len(errors) != 2 {
+		t.Errorf("Expected 2 ERROR logs, got %d", len(errors))
+	}
+
+	ranged, _ := store.GetLogMessages(context.Background(), utils.LogQuery{StartTime: base.Add(30 * time.Minute), EndTime: base.Add(3 * time.Hour), LogLevel: "ERROR"})
+	if len(ranged) != 1 || ranged[0].Message != "High memory usage detected." {
+		t.Errorf("Expected only the last ERROR log in range, got %v", ranged)
+	}
+}
+
+// TestMemoryStorage_Concurrent tests that concurrent inserts are all stored.
+func TestMemoryStorage_Concurrent(t *testing.T) {
+	store := storage.NewMemoryStorage()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.InsertLogMessages(context.Background(), []utils.LogMessage{{Timestamp: time.Now(), Level: "INFO", Message: "hello"}})
+			store.GetLogMessages(context.Background(), utils.LogQuery{LogLevel: "INFO"})
+		}()
+	}
+	wg.Wait()
+
+	logs, _ := store.GetLogMessages(context.Background(), utils.LogQuery{})
+	if len(logs) != 10 {
+		t.Errorf("Expected 10 logs, got %d", len(logs))
+	}
+}
+
+// TestMemoryStorage_FieldFilters tests filtering on service, source and structured fields.
+func TestMemoryStorage_FieldFilters(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	now := time.Now()
+
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: now, Level: "ERROR", Message: "charge failed", Service: "billing", Source: "host-1", Fields: map[string]interface{}{"env": "prod", "attempt": 3}},
+		{Timestamp: now, Level: "ERROR", Message: "charge failed", Service: "billing", Source: "host-2", Fields: map[string]interface{}{"env": "staging", "attempt": 1}},
+		{Timestamp: now, Level: "INFO", Message: "logged in", Service: "auth", Source: "host-1"},
+	})
+
+	billing, _ := store.GetLogMessages(context.Background(), utils.LogQuery{Service: "billing"})
+	if len(billing) != 2 {
+		t.Errorf("Expected 2 billing logs, got %d", len(billing))
+	}
+
+	host1, _ := store.GetLogMessages(context.Background(), utils.LogQuery{Source: "host-1"})
+	if len(host1) != 2 {
+		t.Errorf("Expected 2 logs from host-1, got %d", len(host1))
+	}
+
+	prod, _ := store.GetLogMessages(context.Background(), utils.LogQuery{Fields: map[string]string{"env": "prod", "attempt": "3"}})
+	if len(prod) != 1 || prod[0].Source != "host-1" {
+		t.Errorf("Expected the prod log from host-1, got %v", prod)
+	}
+}
+
+// TestMemoryStorage_TextSearch tests full-text, regex and relevance-ranked message search.
+func TestMemoryStorage_TextSearch(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	base := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: base, Level: "ERROR", Message: "Database connection failed: connection refused"},
+		{Timestamp: base.Add(time.Minute), Level: "ERROR", Message: "Connection to cache failed after 3 retries"},
+		{Timestamp: base.Add(2 * time.Minute), Level: "INFO", Message: "User login successful."},
+	})
+
+	both, _ := store.GetLogMessages(context.Background(), utils.LogQuery{Text: "FAILED connection"})
+	if len(both) != 2 {
+		t.Errorf("Expected 2 logs containing both words, got %v", both)
+	}
+
+	partial, _ := store.GetLogMessages(context.Background(), utils.LogQuery{Text: "connect"})
+	if len(partial) != 0 {
+		t.Errorf("Expected whole words only, got %v", partial)
+	}
+
+	regex, _ := store.GetLogMessages(context.Background(), utils.LogQuery{Regex: `after \d+ retries`, MessageRegex: regexp.MustCompile(`after \d+ retries`)})
+	if len(regex) != 1 || regex[0].Message != "Connection to cache failed after 3 retries" {
+		t.Errorf("Expected only the retried log, got %v", regex)
+	}
+
+	ranked, _ := store.GetLogMessages(context.Background(), utils.LogQuery{Text: "connection", Order: utils.OrderRelevance, Limit: 1})
+	if len(ranked) != 1 || ranked[0].Message != "Database connection failed: connection refused" || ranked[0].Score <= 0 {
+		t.Errorf("Expected the log mentioning connection twice first, got %v", ranked)
+	}
+
+	next, _ := store.GetLogMessages(context.Background(), utils.LogQuery{Text: "connection", Order: utils.OrderRelevance, Limit: 1, After: &utils.Cursor{Offset: 1}})
+	if len(next) != 1 || next[0].Message != "Connection to cache failed after 3 retries" {
+		t.Errorf("Expected the second ranked log at offset 1, got %v", next)
+	}
+}
+
+// TestMemoryStorage_Stats tests counting logs per time bucket, level and structured field.
+func TestMemoryStorage_Stats(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	base := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: base, Level: "ERROR", Message: "a", Fields: map[string]interface{}{"env": "prod"}},
+		{Timestamp: base.Add(10 * time.Minute), Level: "ERROR", Message: "b", Fields: map[string]interface{}{"env": "prod"}},
+		{Timestamp: base.Add(20 * time.Minute), Level: "INFO", Message: "c"},
+		{Timestamp: base.Add(90 * time.Minute), Level: "ERROR", Message: "d", Fields: map[string]interface{}{"env": "staging"}},
+	})
+
+	buckets, err := store.GetLogStats(context.Background(), utils.StatsQuery{Interval: time.Hour, GroupBy: []string{"level", "fields.env"}})
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	want := []utils.StatsBucket{
+		{Time: base, Group: map[string]string{"level": "ERROR", "fields.env": "prod"}, Count: 2},
+		{Time: base, Group: map[string]string{"level": "INFO", "fields.env": ""}, Count: 1},
+		{Time: base.Add(time.Hour), Group: map[string]string{"level": "ERROR", "fields.env": "staging"}, Count: 1},
+	}
+	if fmt.Sprint(buckets) != fmt.Sprint(want) {
+		t.Errorf("Expected buckets %v, got %v", want, buckets)
+	}
+
+	errors, _ := store.GetLogStats(context.Background(), utils.StatsQuery{Filter: utils.LogQuery{LogLevel: "ERROR"}, Interval: 30 * time.Minute})
+	if len(errors) != 2 || errors[0].Count != 2 || errors[1].Count != 1 {
+		t.Errorf("Expected 2 and 1 ERROR logs in two half-hour buckets, got %v", errors)
+	}
+}
+
+// TestMemoryStorage_Retention tests deleting logs past their level's cutoff and trimming the oldest logs.
+func TestMemoryStorage_Retention(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	now := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+
+	store.InsertLogMessages(context.Background(), []utils.LogMessage{
+		{Timestamp: now.Add(-10 * 24 * time.Hour), Level: "ERROR", Message: "old error"},
+		{Timestamp: now.Add(-10 * 24 * time.Hour), Level: "INFO", Message: "old info"},
+		{Timestamp: now.Add(-2 * 24 * time.Hour), Level: "DEBUG", Message: "recent debug"},
+		{Timestamp: now, Level: "INFO", Message: "new info"},
+	})
+
+	policy := storage.RetentionPolicy{MaxAge: 7 * 24 * time.Hour, LevelMaxAge: map[string]time.Duration{"ERROR": 0, "DEBUG": 24 * time.Hour}}
+	deleted, err := store.DeleteExpired(context.Background(), policy.Cutoffs(now))
+	if err != nil || deleted != 2 {
+		t.Fatalf("Expected 2 expired logs to be deleted, got %d (%v)", deleted, err)
+	}
+	logs, _ := store.GetLogMessages(context.Background(), utils.LogQuery{Text: "info"})
+	if len(logs) != 1 || logs[0].Message != "new info" {
+		t.Errorf("Expected only the new info log to remain searchable, got %v", logs)
+	}
+
+	size, _ := store.Size(context.Background())
+	trimmed, _ := store.TrimToSize(context.Background(), size-1)
+	logs, _ = store.GetLogMessages(context.Background(), utils.LogQuery{})
+	if trimmed != 1 || len(logs) != 1 || logs[0].Message != "new info" {
+		t.Errorf("Expected the oldest log to be trimmed, got %d trimmed leaving %v", trimmed, logs)
+	}
+}
+
+// TestMemoryStorage_Canceled tests that operations fail without touching the logs once their context is done.
+func TestMemoryStorage_Canceled(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := store.InsertLogMessages(ctx, []utils.LogMessage{{Timestamp: time.Now(), Level: "INFO", Message: "late"}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the insert to be canceled, got %v", err)
+	}
+	if _, err := store.GetLogMessages(ctx, utils.LogQuery{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the query to be canceled, got %v", err)
+	}
+	if logs, _ := store.GetLogMessages(context.Background(), utils.LogQuery{}); len(logs) != 0 {
+		t.Errorf("Expected nothing stored, got %v", logs)
+	}
+}
@@ -4,8 +4,12 @@ import "go.mongodb.org/mongo-driver/bson/primitive"
 
 // LogMessage represents a log entry in the database
 type LogEntry struct {
-	ID      primitive.ObjectID `bson:"_id,omitempty"`
-	Message string             `bson:"message"`
-	Level   string             `bson:"level"`
-	Time    primitive.DateTime `bson:"time"`
+	ID      primitive.ObjectID     `bson:"_id,omitempty"`
+	Message string                 `bson:"message"`
+	Level   string                 `bson:"level"`
+	Time    primitive.DateTime     `bson:"time"`
+	Service string                 `bson:"service,omitempty"`
+	Source  string                 `bson:"source,omitempty"`
+	Fields  map[string]interface{} `bson:"fields,omitempty"`
+	Score   float64                `bson:"score,omitempty"` // Text score, only projected when ranking by relevance
 }
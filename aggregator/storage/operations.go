@@ -4,14 +4,17 @@ import (
 	"context"
 	"fmt"
 	"log-aggregator/aggregator/utils"
-	"time"
+	"strconv"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // InsertLogMessages inserts multiple LogMessages into the MongoDB collection
-func (s *Storage) InsertLogMessages(logs []utils.LogMessage) error {
+func (s *Storage) InsertLogMessages(ctx context.Context, logs []utils.LogMessage) error {
 	var logEntries []interface{} // Create a slice to hold the log entries
 
 	// Iterate over the logs and create LogEntry documents
@@ -21,53 +24,77 @@ func (s *Storage) InsertLogMessages(logs []utils.LogMessage) error {
 			Message: log.Message,
 			Level:   log.Level,
 			Time:    primitive.NewDateTimeFromTime(log.Timestamp.UTC()),
+			Service: log.Service,
+			Source:  log.Source,
+			Fields:  log.Fields,
 		}
 		logEntries = append(logEntries, logEntry) // Append each log entry to the slice
 	}
 
 	// Insert all log entries into the collection
-	_, err := s.collection.InsertMany(context.TODO(), logEntries)
+	_, err := s.collection.InsertMany(ctx, logEntries)
 	if err != nil {
 		return fmt.Errorf("failed to insert log messages: %v", err)
 	}
 	return nil
 }
 
-// GetLogMessages retrieves log messages from the collection filtered by time range and log level
-func (s *Storage) GetLogMessages(startTime, endTime time.Time, logLevel string) ([]utils.LogMessage, error) {
+// GetLogMessages retrieves log messages from the collection matching the query
+func (s *Storage) GetLogMessages(ctx context.Context, query utils.LogQuery) ([]utils.LogMessage, error) {
 	var utilsLogs []utils.LogMessage
 	// Create the filter based on the provided parameters
 
-	filter, err := s.buildFilter(startTime, endTime, logLevel)
+	filter, err := s.buildFilter(query)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println("Filter:", filter)
+	// Sort on (time, _id) so pages follow each other without gaps or duplicates
+	direction := 1
+	if query.Order == utils.OrderDesc {
+		direction = -1
+	}
+	findOptions := options.Find().SetSort(bson.D{{Key: "time", Value: direction}, {Key: "_id", Value: direction}})
+	if query.Order == utils.OrderRelevance {
+		// Ranked results are sorted by text score and paged by offset
+		score := bson.D{{Key: "$meta", Value: "textScore"}}
+		findOptions.SetProjection(bson.D{{Key: "score", Value: score}})
+		findOptions.SetSort(bson.D{{Key: "score", Value: score}, {Key: "time", Value: -1}, {Key: "_id", Value: -1}})
+		if query.After != nil {
+			findOptions.SetSkip(int64(query.After.Offset))
+		}
+	}
+	if query.Limit > 0 {
+		findOptions.SetLimit(int64(query.Limit))
+	}
 
 	// Find log messages with the specified filter
-	cursor, err := s.collection.Find(context.TODO(), filter)
+	cursor, err := s.collection.Find(ctx, filter, findOptions)
 	if err != nil {
 		fmt.Println("Failed to find log messages")
 		return nil, fmt.Errorf("failed to find log messages: %v", err)
 	}
-	defer cursor.Close(context.TODO())
+	defer cursor.Close(ctx)
 
 	// Decode each log message and convert it to utils.LogMessage in one loop
-	for cursor.Next(context.TODO()) {
+	for cursor.Next(ctx) {
 		var log LogEntry
 		if err := cursor.Decode(&log); err != nil {
 			return nil, fmt.Errorf("failed to decode log message: %v", err)
 		}
 		// Directly append to utilsLogs
 		utilsLogs = append(utilsLogs, utils.LogMessage{
+			ID:        log.ID.Hex(),
 			Timestamp: log.Time.Time(), // Format timestamp if needed
 			Level:     log.Level,
 			Message:   log.Message,
+			Service:   log.Service,
+			Source:    log.Source,
+			Fields:    log.Fields,
+			Score:     log.Score,
 		})
 	}
 
-	fmt.Println(utilsLogs)
 	// Check for any cursor errors
 	if err := cursor.Err(); err != nil {
 		return nil, fmt.Errorf("cursor error: %v", err)
@@ -76,23 +103,205 @@ func (s *Storage) GetLogMessages(startTime, endTime time.Time, logLevel string)
 	return utilsLogs, nil
 }
 
-// buildFilter constructs a filter for log messages based on the provided time range and log level
-func (s *Storage) buildFilter(startTime, endTime time.Time, logLevel string) (bson.D, error) {
+// GetLogStats counts the log messages matching the filter per time bucket and group with an aggregation pipeline
+func (s *Storage) GetLogStats(ctx context.Context, query utils.StatsQuery) ([]utils.StatsBucket, error) {
+	filter, err := s.buildFilter(query.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// Buckets are aligned on the epoch by subtracting the remainder of the interval from the time
+	step := query.Interval.Milliseconds()
+	remainder := bson.D{{Key: "$mod", Value: bson.A{bson.D{{Key: "$toLong", Value: "$time"}}, step}}}
+	group := bson.D{{Key: "time", Value: bson.D{{Key: "$subtract", Value: bson.A{"$time", remainder}}}}}
+	// Field paths may contain dots, which aren't allowed in group keys, so those are positional
+	for i, field := range query.GroupBy {
+		group = append(group, bson.E{Key: "g" + strconv.Itoa(i), Value: "$" + field})
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: group}, {Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}}}}},
+	}
+
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate log stats: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	buckets := []utils.StatsBucket{}
+	for cursor.Next(ctx) {
+		var result struct {
+			ID    bson.M `bson:"_id"`
+			Count int64  `bson:"count"`
+		}
+		if err := cursor.Decode(&result); err != nil {
+			return nil, fmt.Errorf("failed to decode log stats: %v", err)
+		}
+		bucket := utils.StatsBucket{Count: result.Count}
+		if start, ok := result.ID["time"].(primitive.DateTime); ok {
+			bucket.Time = start.Time().UTC()
+		}
+		if len(query.GroupBy) > 0 {
+			bucket.Group = make(map[string]string, len(query.GroupBy))
+			for i, field := range query.GroupBy {
+				// Missing fields are grouped under null, reported as ""
+				if value := result.ID["g"+strconv.Itoa(i)]; value != nil {
+					bucket.Group[field] = fmt.Sprint(value)
+				} else {
+					bucket.Group[field] = ""
+				}
+			}
+		}
+		buckets = append(buckets, bucket)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("cursor error: %v", err)
+	}
+
+	sortStatsBuckets(buckets, query.GroupBy)
+	return buckets, nil
+}
+
+// DeleteExpired deletes the log messages past the cutoff of their level
+func (s *Storage) DeleteExpired(ctx context.Context, cutoffs RetentionCutoffs) (int64, error) {
+	var clauses bson.A
+	var overridden bson.A
+	for level, cutoff := range cutoffs.Levels {
+		overridden = append(overridden, level)
+		if !cutoff.IsZero() {
+			clauses = append(clauses, bson.D{{Key: "level", Value: level}, {Key: "time", Value: bson.D{{Key: "$lt", Value: primitive.NewDateTimeFromTime(cutoff)}}}})
+		}
+	}
+	if !cutoffs.Default.IsZero() {
+		clause := bson.D{{Key: "time", Value: bson.D{{Key: "$lt", Value: primitive.NewDateTimeFromTime(cutoffs.Default)}}}}
+		if len(overridden) > 0 {
+			clause = append(clause, bson.E{Key: "level", Value: bson.D{{Key: "$nin", Value: overridden}}})
+		}
+		clauses = append(clauses, clause)
+	}
+	if len(clauses) == 0 {
+		return 0, nil
+	}
+
+	result, err := s.collection.DeleteMany(ctx, bson.D{{Key: "$or", Value: clauses}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired log messages: %v", err)
+	}
+	return result.DeletedCount, nil
+}
+
+// Size returns the uncompressed size of the log documents
+func (s *Storage) Size(ctx context.Context) (int64, error) {
+	size, _, err := s.collectionStats(ctx)
+	return size, err
+}
+
+// TrimToSize deletes the oldest log messages until at most maxSize bytes are used, estimating how many
+// to delete from the average document size
+func (s *Storage) TrimToSize(ctx context.Context, maxSize int64) (int64, error) {
+	size, count, err := s.collectionStats(ctx)
+	if err != nil || size <= maxSize || count == 0 {
+		return 0, err
+	}
+	excess := (size - maxSize + size/count - 1) / (size / count)
+
+	// Find the newest of the documents to delete, then delete everything up to it in (time, _id) order
+	var last LogEntry
+	findOptions := options.FindOne().SetSort(bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}}).SetSkip(excess - 1)
+	if err := s.collection.FindOne(ctx, bson.D{}, findOptions).Decode(&last); err != nil {
+		return 0, fmt.Errorf("failed to find the oldest log messages: %v", err)
+	}
+	result, err := s.collection.DeleteMany(ctx, bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "time", Value: bson.D{{Key: "$lt", Value: last.Time}}}},
+		bson.D{{Key: "time", Value: last.Time}, {Key: "_id", Value: bson.D{{Key: "$lte", Value: last.ID}}}},
+	}}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete the oldest log messages: %v", err)
+	}
+	return result.DeletedCount, nil
+}
+
+// collectionStats returns the uncompressed size and number of the log documents
+func (s *Storage) collectionStats(ctx context.Context) (int64, int64, error) {
+	var stats struct {
+		Size  float64 `bson:"size"`
+		Count float64 `bson:"count"`
+	}
+	command := bson.D{{Key: "collStats", Value: s.collection.Name()}}
+	if err := s.collection.Database().RunCommand(ctx, command).Decode(&stats); err != nil {
+		return 0, 0, fmt.Errorf("failed to get collection stats: %v", err)
+	}
+	return int64(stats.Size), int64(stats.Count), nil
+}
+
+// buildFilter constructs a filter for log messages based on the provided query
+func (s *Storage) buildFilter(query utils.LogQuery) (bson.D, error) {
 	filter := bson.D{}
 
 	// Check if startTime and endTime are provided and not zero values
-	if !startTime.IsZero() && !endTime.IsZero() {
+	if !query.StartTime.IsZero() && !query.EndTime.IsZero() {
 		// Create a filter for the time range
 		filter = append(filter, bson.E{Key: "time", Value: bson.D{
-			{Key: "$gte", Value: primitive.NewDateTimeFromTime(startTime)},
-			{Key: "$lte", Value: primitive.NewDateTimeFromTime(endTime)},
+			{Key: "$gte", Value: primitive.NewDateTimeFromTime(query.StartTime)},
+			{Key: "$lte", Value: primitive.NewDateTimeFromTime(query.EndTime)},
 		}})
 	}
 
 	// Check if logLevel is provided and not empty
-	if logLevel != "" {
+	if query.LogLevel != "" {
 		// Add a filter for the log level
-		filter = append(filter, bson.E{Key: "level", Value: logLevel})
+		filter = append(filter, bson.E{Key: "level", Value: query.LogLevel})
+	}
+
+	if query.Service != "" {
+		filter = append(filter, bson.E{Key: "service", Value: query.Service})
+	}
+	if query.Source != "" {
+		filter = append(filter, bson.E{Key: "source", Value: query.Source})
+	}
+
+	// Quoting every word makes the text search require all of them instead of any
+	if terms := utils.Tokenize(query.Text); len(terms) > 0 {
+		search := `"` + strings.Join(terms, `" "`) + `"`
+		filter = append(filter, bson.E{Key: "$text", Value: bson.D{{Key: "$search", Value: search}}})
+	}
+	if query.Regex != "" {
+		filter = append(filter, bson.E{Key: "message", Value: primitive.Regex{Pattern: query.Regex}})
+	}
+
+	// Field values arrive as strings, so also match the numbers and booleans they may have been stored as
+	for name, value := range query.Fields {
+		if !utils.ValidFieldName(name) {
+			return nil, fmt.Errorf("%w: invalid field name %q", ErrInvalidQuery, name)
+		}
+		filter = append(filter, bson.E{Key: "fields." + name, Value: bson.D{{Key: "$in", Value: fieldValueCandidates(value)}}})
+	}
+
+	// The query language expression is combined with the other filters
+	if query.Expr != nil {
+		expr, err := compileQuery(query.Expr)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, bson.E{Key: "$and", Value: bson.A{expr}})
+	}
+
+	// Continue after the cursor of the previous page
+	if query.After != nil && query.Order != utils.OrderRelevance {
+		id, err := primitive.ObjectIDFromHex(query.After.ID)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid cursor id: %v", ErrInvalidQuery, err)
+		}
+		op := "$gt"
+		if query.Order == utils.OrderDesc {
+			op = "$lt"
+		}
+		after := primitive.NewDateTimeFromTime(query.After.Time)
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "time", Value: bson.D{{Key: op, Value: after}}}},
+			bson.D{{Key: "time", Value: after}, {Key: "_id", Value: bson.D{{Key: op, Value: id}}}},
+		}})
 	}
 
 	// If no filters are applied, retrieve all logs
@@ -102,3 +311,18 @@ func (s *Storage) buildFilter(startTime, endTime time.Time, logLevel string) (bs
 
 	return filter, nil
 }
+
+// fieldValueCandidates returns the typed values a string from the query string may have been stored as
+func fieldValueCandidates(value string) bson.A {
+	candidates := bson.A{value}
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		candidates = append(candidates, i)
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		candidates = append(candidates, f)
+	}
+	if b, err := strconv.ParseBool(value); err == nil {
+		candidates = append(candidates, b)
+	}
+	return candidates
+}
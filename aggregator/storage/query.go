@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"fmt"
+	"log-aggregator/aggregator/utils"
+	"regexp"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// compileQuery translates a query language expression into a MongoDB filter
+func compileQuery(node utils.QueryNode) (bson.D, error) {
+	switch n := node.(type) {
+	case *utils.QueryAnd:
+		children, err := compileChildren(n.Children)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "$and", Value: children}}, nil
+
+	case *utils.QueryOr:
+		children, err := compileChildren(n.Children)
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "$or", Value: children}}, nil
+
+	case *utils.QueryNot:
+		child, err := compileQuery(n.Child)
+		if err != nil {
+			return nil, err
+		}
+		// $nor with a single clause negates a whole sub-expression, unlike $not
+		return bson.D{{Key: "$nor", Value: bson.A{child}}}, nil
+
+	case *utils.QueryTerm:
+		return compileTerm(n), nil
+	}
+	return nil, fmt.Errorf("unsupported query node %T", node)
+}
+
+func compileChildren(nodes []utils.QueryNode) (bson.A, error) {
+	children := make(bson.A, 0, len(nodes))
+	for _, node := range nodes {
+		child, err := compileQuery(node)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+// compileTerm matches the same values as QueryTerm.MatchValue
+func compileTerm(term *utils.QueryTerm) bson.D {
+	key := term.Field
+	switch {
+	case term.IsPattern():
+		return bson.D{{Key: key, Value: primitive.Regex{Pattern: term.Pattern()}}}
+	case term.Field == utils.QueryFieldMessage:
+		return bson.D{{Key: key, Value: primitive.Regex{Pattern: regexp.QuoteMeta(term.Value), Options: "i"}}}
+	case term.StructuredField() != "":
+		return bson.D{{Key: key, Value: bson.D{{Key: "$in", Value: fieldValueCandidates(term.Value)}}}}
+	default:
+		return bson.D{{Key: key, Value: term.Value}}
+	}
+}
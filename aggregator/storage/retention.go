@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"fmt"
+	"log-aggregator/aggregator/utils"
+	"time"
+)
+
+// RetentionPolicy decides how long logs are kept, the zero value keeps everything forever
+type RetentionPolicy struct {
+	MaxAge      time.Duration            `yaml:"max_age"`       // Logs older than this are deleted, 0 keeps them forever
+	LevelMaxAge map[string]time.Duration `yaml:"level_max_age"` // Overrides MaxAge for a level, 0 keeps that level forever
+	MaxSize     int64                    `yaml:"max_size"`      // The oldest logs are deleted beyond this many bytes, 0 for no limit
+}
+
+// Enabled reports whether the policy ever deletes logs
+func (p RetentionPolicy) Enabled() bool {
+	if p.MaxAge > 0 || p.MaxSize > 0 {
+		return true
+	}
+	for _, age := range p.LevelMaxAge {
+		if age > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Cutoffs returns the time before which logs of each level expire at now
+func (p RetentionPolicy) Cutoffs(now time.Time) RetentionCutoffs {
+	cutoffs := RetentionCutoffs{Levels: make(map[string]time.Time, len(p.LevelMaxAge))}
+	if p.MaxAge > 0 {
+		cutoffs.Default = now.Add(-p.MaxAge)
+	}
+	for level, age := range p.LevelMaxAge {
+		var cutoff time.Time
+		if age > 0 {
+			cutoff = now.Add(-age)
+		}
+		cutoffs.Levels[level] = cutoff
+	}
+	return cutoffs
+}
+
+// RetentionCutoffs holds the expiry times of a RetentionPolicy, a zero time never expires
+type RetentionCutoffs struct {
+	Default time.Time            // Applies to the levels without their own cutoff
+	Levels  map[string]time.Time // Overrides Default per level
+}
+
+// For returns the cutoff of the level
+func (c RetentionCutoffs) For(level string) time.Time {
+	if cutoff, ok := c.Levels[level]; ok {
+		return cutoff
+	}
+	return c.Default
+}
+
+// Expired reports whether a log of the level written at ts is past its cutoff
+func (c RetentionCutoffs) Expired(ts time.Time, level string) bool {
+	cutoff := c.For(level)
+	return !cutoff.IsZero() && ts.Before(cutoff)
+}
+
+// LogSize estimates the bytes a log takes up, for backends without an exact figure
+func LogSize(log utils.LogMessage) int64 {
+	size := len(log.ID) + len(log.Level) + len(log.Message) + len(log.Service) + len(log.Source) + 8
+	for name, value := range log.Fields {
+		size += len(name) + len(fmt.Sprint(value))
+	}
+	return int64(size)
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"log-aggregator/aggregator/utils"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bucketStart aligns a timestamp to the start of its bucket, counting buckets from the Unix epoch like the
+// MongoDB pipeline does
+func bucketStart(ts time.Time, interval time.Duration) time.Time {
+	ms, step := ts.UnixMilli(), interval.Milliseconds()
+	return time.UnixMilli(ms - ms%step).UTC()
+}
+
+// countStats counts the logs per time bucket and group, for backends aggregating in-process
+func countStats(logs []utils.LogMessage, query utils.StatsQuery) []utils.StatsBucket {
+	buckets := make(map[string]*utils.StatsBucket)
+	for _, log := range logs {
+		bucket := utils.StatsBucket{Time: bucketStart(log.Timestamp, query.Interval)}
+		key := []string{bucket.Time.String()}
+		if len(query.GroupBy) > 0 {
+			bucket.Group = make(map[string]string, len(query.GroupBy))
+			for _, field := range query.GroupBy {
+				value, _ := termValue(&utils.QueryTerm{Field: field}, log)
+				bucket.Group[field] = value
+				key = append(key, value)
+			}
+		}
+
+		id := strings.Join(key, "\x00")
+		if existing, ok := buckets[id]; ok {
+			existing.Count++
+			continue
+		}
+		bucket.Count = 1
+		buckets[id] = &bucket
+	}
+
+	result := make([]utils.StatsBucket, 0, len(buckets))
+	for _, bucket := range buckets {
+		result = append(result, *bucket)
+	}
+	sortStatsBuckets(result, query.GroupBy)
+	return result
+}
+
+// sortStatsBuckets orders buckets by time, then by their group values
+func sortStatsBuckets(buckets []utils.StatsBucket, groupBy []string) {
+	sort.Slice(buckets, func(i, j int) bool {
+		if c := buckets[i].Time.Compare(buckets[j].Time); c != 0 {
+			return c < 0
+		}
+		for _, field := range groupBy {
+			if c := strings.Compare(buckets[i].Group[field], buckets[j].Group[field]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+}
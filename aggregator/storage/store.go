@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log-aggregator/aggregator/utils"
+)
+
+// Supported storage backends, selected through api.Config.Backend
+const (
+	BackendMongo  = "mongo"
+	BackendMemory = "memory"
+	BackendDisk   = "disk"
+)
+
+// ErrInvalidQuery is wrapped by the errors of queries a backend can't run as given, as opposed to the backend failing
+var ErrInvalidQuery = errors.New("invalid query")
+
+// LogStore is implemented by every storage backend the workers can write to and read from.
+// Every method but Close gives up once ctx is done, returning the context's error.
+type LogStore interface {
+	// InsertLogMessages persists a batch of log messages
+	InsertLogMessages(ctx context.Context, logs []utils.LogMessage) error
+	// GetLogMessages retrieves up to query.Limit log messages matching the query, sorted by (time, id)
+	// in query.Order and starting after query.After
+	GetLogMessages(ctx context.Context, query utils.LogQuery) ([]utils.LogMessage, error)
+	// GetLogStats counts the log messages matching query.Filter per time bucket and group, sorted by time
+	GetLogStats(ctx context.Context, query utils.StatsQuery) ([]utils.StatsBucket, error)
+	// DeleteExpired deletes the log messages past the cutoff of their level, returning how many were deleted
+	DeleteExpired(ctx context.Context, cutoffs RetentionCutoffs) (int64, error)
+	// Size returns the number of bytes used by the stored log messages
+	Size(ctx context.Context) (int64, error)
+	// TrimToSize deletes the oldest log messages until at most maxSize bytes are used, returning how many were deleted
+	TrimToSize(ctx context.Context, maxSize int64) (int64, error)
+	// Ping checks that the backend is reachable and usable
+	Ping(ctx context.Context) error
+	// Close releases any resources held by the backend
+	Close() error
+}
+
+// Make sure the backends satisfy the interface
+var (
+	_ LogStore = (*Storage)(nil)
+	_ LogStore = (*MemoryStorage)(nil)
+	_ LogStore = (*DiskStorage)(nil)
+)
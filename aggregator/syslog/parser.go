@@ -0,0 +1,225 @@
+package syslog
+
+import (
+	"errors"
+	"fmt"
+	"log-aggregator/aggregator/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rfc3164Layout is the BSD syslog timestamp, which carries no year
+const rfc3164Layout = time.Stamp
+
+const nilValue = "-"
+
+// severityLevels maps syslog severities to the levels used throughout the aggregator
+var severityLevels = [8]string{
+	"ERROR", // 0 emergency
+	"ERROR", // 1 alert
+	"ERROR", // 2 critical
+	"ERROR", // 3 error
+	"WARN",  // 4 warning
+	"INFO",  // 5 notice
+	"INFO",  // 6 informational
+	"DEBUG", // 7 debug
+}
+
+// Parse parses an RFC 5424 or RFC 3164 message into a LogMessage, using received for missing timestamps
+func Parse(raw []byte, received time.Time) (utils.LogMessage, error) {
+	msg := strings.TrimRight(string(raw), "\r\n\x00")
+
+	pri, rest, err := parsePriority(msg)
+	if err != nil {
+		return utils.LogMessage{}, err
+	}
+	facility, severity := pri/8, pri%8
+
+	var log utils.LogMessage
+	// RFC 5424 messages carry a version right after the priority
+	if strings.HasPrefix(rest, "1 ") {
+		log, err = parseRFC5424(rest[2:], received)
+	} else {
+		log = parseRFC3164(rest, received)
+	}
+	if err != nil {
+		return utils.LogMessage{}, err
+	}
+
+	log.Level = severityLevels[severity]
+	// The hostname and app name also identify where the log came from
+	log.Source, _ = log.Fields["hostname"].(string)
+	log.Service, _ = log.Fields["app_name"].(string)
+	log.Fields["facility"] = facility
+	log.Fields["severity"] = severity
+	return log, nil
+}
+
+// parsePriority extracts the <PRI> prefix
+func parsePriority(msg string) (int, string, error) {
+	if !strings.HasPrefix(msg, "<") {
+		return 0, "", errors.New("missing priority")
+	}
+	end := strings.IndexByte(msg, '>')
+	if end < 2 || end > 4 {
+		return 0, "", errors.New("invalid priority")
+	}
+	pri, err := strconv.Atoi(msg[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return 0, "", fmt.Errorf("invalid priority %q", msg[1:end])
+	}
+	return pri, msg[end+1:], nil
+}
+
+// parseRFC5424 parses everything following "<PRI>1 "
+func parseRFC5424(rest string, received time.Time) (utils.LogMessage, error) {
+	header := make([]string, 5) // TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+	for i := range header {
+		field, remaining, found := strings.Cut(rest, " ")
+		if !found && i < len(header)-1 {
+			return utils.LogMessage{}, errors.New("truncated RFC 5424 header")
+		}
+		header[i], rest = field, remaining
+	}
+
+	log := utils.LogMessage{Timestamp: received.UTC(), Fields: make(map[string]interface{})}
+	if header[0] != nilValue {
+		ts, err := time.Parse(time.RFC3339Nano, header[0])
+		if err != nil {
+			return utils.LogMessage{}, fmt.Errorf("invalid timestamp %q", header[0])
+		}
+		log.Timestamp = ts.UTC()
+	}
+	setField(log.Fields, "hostname", header[1])
+	setField(log.Fields, "app_name", header[2])
+	setField(log.Fields, "procid", header[3])
+	setField(log.Fields, "msgid", header[4])
+
+	structured, rest, err := parseStructuredData(rest)
+	if err != nil {
+		return utils.LogMessage{}, err
+	}
+	if len(structured) > 0 {
+		log.Fields["structured_data"] = structured
+	}
+
+	log.Message = strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\ufeff") // Drop the optional UTF-8 BOM
+	return log, nil
+}
+
+// parseStructuredData parses the STRUCTURED-DATA part, returning the remaining message
+func parseStructuredData(rest string) (map[string]map[string]string, string, error) {
+	if rest == "" {
+		return nil, "", nil
+	}
+	if rest == nilValue || strings.HasPrefix(rest, nilValue+" ") {
+		return nil, strings.TrimPrefix(rest, nilValue), nil
+	}
+
+	elements := make(map[string]map[string]string)
+	for strings.HasPrefix(rest, "[") {
+		end, params, err := parseSDElement(rest)
+		if err != nil {
+			return nil, "", err
+		}
+		for id, values := range params {
+			elements[id] = values
+		}
+		rest = rest[end:]
+	}
+	if len(elements) == 0 {
+		return nil, "", errors.New("invalid structured data")
+	}
+	return elements, rest, nil
+}
+
+// parseSDElement parses a single [id key="value" ...] element, returning the index just after it
+func parseSDElement(s string) (int, map[string]map[string]string, error) {
+	i := 1
+	idEnd := strings.IndexAny(s[i:], " ]")
+	if idEnd <= 0 {
+		return 0, nil, errors.New("invalid structured data element")
+	}
+	id := s[i : i+idEnd]
+	i += idEnd
+	params := make(map[string]string)
+
+	for i < len(s) && s[i] == ' ' {
+		i++
+		eq := strings.IndexByte(s[i:], '=')
+		if eq <= 0 || i+eq+1 >= len(s) || s[i+eq+1] != '"' {
+			return 0, nil, fmt.Errorf("invalid parameter in structured data element %q", id)
+		}
+		name := s[i : i+eq]
+		i += eq + 2
+
+		// Values may escape '"', '\' and ']' with a backslash
+		var value strings.Builder
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+				i++
+			}
+			value.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return 0, nil, fmt.Errorf("unterminated parameter %q in structured data element %q", name, id)
+		}
+		params[name] = value.String()
+		i++ // Closing quote
+	}
+
+	if i >= len(s) || s[i] != ']' {
+		return 0, nil, fmt.Errorf("unterminated structured data element %q", id)
+	}
+	return i + 1, map[string]map[string]string{id: params}, nil
+}
+
+// parseRFC3164 parses a BSD syslog message, which is best effort by nature
+func parseRFC3164(rest string, received time.Time) utils.LogMessage {
+	log := utils.LogMessage{Timestamp: received.UTC(), Fields: make(map[string]interface{})}
+
+	if len(rest) >= len(rfc3164Layout) {
+		if ts, err := time.ParseInLocation(rfc3164Layout, rest[:len(rfc3164Layout)], time.Local); err == nil {
+			log.Timestamp = inferYear(ts, received).UTC()
+			rest = strings.TrimPrefix(rest[len(rfc3164Layout):], " ")
+
+			// The hostname follows the timestamp
+			if host, remaining, found := strings.Cut(rest, " "); found && !strings.HasSuffix(host, ":") {
+				setField(log.Fields, "hostname", host)
+				rest = remaining
+			}
+		}
+	}
+
+	// TAG[PID]: MSG
+	if colon := strings.Index(rest, ": "); colon > 0 && !strings.ContainsAny(rest[:colon], " ") {
+		tag := rest[:colon]
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			setField(log.Fields, "procid", tag[open+1:len(tag)-1])
+			tag = tag[:open]
+		}
+		setField(log.Fields, "app_name", tag)
+		rest = rest[colon+2:]
+	}
+
+	log.Message = rest
+	return log
+}
+
+// inferYear places a year-less timestamp in the year closest to when it was received
+func inferYear(ts, received time.Time) time.Time {
+	ts = ts.AddDate(received.Year(), 0, 0)
+	// A message from late December received in early January belongs to last year
+	if ts.After(received.Add(24 * time.Hour)) {
+		ts = ts.AddDate(-1, 0, 0)
+	}
+	return ts
+}
+
+// setField stores value under key unless it is the NILVALUE
+func setField(fields map[string]interface{}, key, value string) {
+	if value != "" && value != nilValue {
+		fields[key] = value
+	}
+}
@@ -0,0 +1,139 @@
+package syslog_test
+
+import (
+	"errors"
+	"log-aggregator/aggregator/syslog"
+	"log-aggregator/aggregator/utils"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestParse_RFC5424 tests parsing a full RFC 5424 message with structured data.
+func TestParse_RFC5424(t *testing.T) {
+	raw := `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog 1234 ID47 [exampleSDID@32473 iut="3" eventSource="Appli\"cation"] An application event log entry...`
+
+	log, err := syslog.Parse([]byte(raw), time.Now())
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+
+	if log.Level != "INFO" {
+		t.Errorf("Expected level INFO for severity 5, got %s", log.Level)
+	}
+	if !log.Timestamp.Equal(time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC)) {
+		t.Errorf("Unexpected timestamp: %v", log.Timestamp)
+	}
+	if log.Source != "mymachine.example.com" || log.Service != "evntslog" {
+		t.Errorf("Expected source and service from the header, got %q and %q", log.Source, log.Service)
+	}
+	if log.Message != "An application event log entry..." {
+		t.Errorf("Unexpected message: %q", log.Message)
+	}
+	if log.Fields["facility"] != 20 || log.Fields["hostname"] != "mymachine.example.com" || log.Fields["app_name"] != "evntslog" || log.Fields["procid"] != "1234" {
+		t.Errorf("Unexpected fields: %v", log.Fields)
+	}
+	sd, ok := log.Fields["structured_data"].(map[string]map[string]string)
+	if !ok || sd["exampleSDID@32473"]["eventSource"] != `Appli"cation` {
+		t.Errorf("Unexpected structured data: %v", log.Fields["structured_data"])
+	}
+}
+
+// TestParse_RFC5424NilValues tests that NILVALUE header fields are left out.
+func TestParse_RFC5424NilValues(t *testing.T) {
+	received := time.Date(2024, 10, 8, 0, 0, 0, 0, time.UTC)
+	log, err := syslog.Parse([]byte("<11>1 - - - - - - disk failure\n"), received)
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	if log.Level != "ERROR" || log.Message != "disk failure" || !log.Timestamp.Equal(received) {
+		t.Errorf("Unexpected log: %+v", log)
+	}
+	if _, ok := log.Fields["hostname"]; ok {
+		t.Errorf("Expected no hostname, got %v", log.Fields["hostname"])
+	}
+}
+
+// TestParse_RFC3164 tests parsing a BSD syslog message.
+func TestParse_RFC3164(t *testing.T) {
+	received := time.Date(2024, 10, 8, 12, 0, 0, 0, time.Local)
+	log, err := syslog.Parse([]byte("<34>Oct  8 11:59:00 mymachine su[231]: 'su root' failed for lonvick on /dev/pts/8"), received)
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+
+	if log.Level != "ERROR" {
+		t.Errorf("Expected level ERROR for severity 2, got %s", log.Level)
+	}
+	if !log.Timestamp.Equal(time.Date(2024, 10, 8, 11, 59, 0, 0, time.Local)) {
+		t.Errorf("Unexpected timestamp: %v", log.Timestamp)
+	}
+	if log.Fields["hostname"] != "mymachine" || log.Fields["app_name"] != "su" || log.Fields["procid"] != "231" {
+		t.Errorf("Unexpected fields: %v", log.Fields)
+	}
+	if log.Message != "'su root' failed for lonvick on /dev/pts/8" {
+		t.Errorf("Unexpected message: %q", log.Message)
+	}
+}
+
+// TestParse_Invalid tests that messages without a priority are rejected.
+func TestParse_Invalid(t *testing.T) {
+	if _, err := syslog.Parse([]byte("no priority here"), time.Now()); err == nil {
+		t.Error("Expected an error, got none")
+	}
+}
+
+// TestServer_TCPFraming tests receiving octet-counted and newline-framed messages over TCP.
+func TestServer_TCPFraming(t *testing.T) {
+	var mu sync.Mutex
+	var received []utils.LogMessage
+	server := syslog.NewServer("", "127.0.0.1:0", func(logs []utils.LogMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, logs...)
+		return nil
+	})
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start syslog server: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", server.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	conn.Write([]byte("26 <14>1 - host app - - - one<13>1 - host app - - - two\n"))
+	conn.Close()
+
+	// Give the connection time to be read before stopping flushes the batch
+	time.Sleep(100 * time.Millisecond)
+	server.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0].Message != "one" || received[1].Message != "two" {
+		t.Errorf("Expected messages one and two, got %+v", received)
+	}
+}
+
+// TestServer_TCPFrameLength tests that a length prefix of too many digits closes the connection instead of being buffered.
+func TestServer_TCPFrameLength(t *testing.T) {
+	server := syslog.NewServer("", "127.0.0.1:0", func(logs []utils.LogMessage) error { return nil })
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start syslog server: %v", err)
+	}
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("12345678901234567890"))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,286 @@
+package syslog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log-aggregator/aggregator/metrics"
+	"log-aggregator/aggregator/utils"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxMessageSize bounds a single syslog message on either transport
+	maxMessageSize = 64 * 1024
+	// maxLengthDigits bounds the MSG-LEN prefix of octet-counted frames, plenty for maxMessageSize
+	maxLengthDigits = 9
+	// batchSize and flushInterval control how parsed messages are grouped into store jobs
+	batchSize     = 100
+	flushInterval = time.Second
+)
+
+// Server receives syslog messages over UDP and TCP and submits them in batches
+type Server struct {
+	udpAddr string
+	tcpAddr string
+	submit  func([]utils.LogMessage) error
+
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+
+	mu      sync.Mutex
+	batch   []utils.LogMessage
+	conns   map[net.Conn]struct{}
+	closing bool
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewServer creates a syslog server listening on the given addresses, an empty address disables that transport.
+// Parsed messages are handed to submit in batches.
+func NewServer(udpAddr, tcpAddr string, submit func([]utils.LogMessage) error) *Server {
+	return &Server{
+		udpAddr: udpAddr,
+		tcpAddr: tcpAddr,
+		submit:  submit,
+		conns:   make(map[net.Conn]struct{}),
+		quit:    make(chan struct{}),
+	}
+}
+
+// Start binds the listeners and starts receiving messages in the background
+func (s *Server) Start() error {
+	if s.udpAddr != "" {
+		conn, err := net.ListenPacket("udp", s.udpAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen for syslog on udp %s: %v", s.udpAddr, err)
+		}
+		s.udpConn = conn
+		s.wg.Add(1)
+		go s.serveUDP()
+		fmt.Printf("Receiving syslog on udp %s\n", conn.LocalAddr())
+	}
+
+	if s.tcpAddr != "" {
+		listener, err := net.Listen("tcp", s.tcpAddr)
+		if err != nil {
+			s.Stop()
+			return fmt.Errorf("failed to listen for syslog on tcp %s: %v", s.tcpAddr, err)
+		}
+		s.tcpListener = listener
+		s.wg.Add(1)
+		go s.serveTCP()
+		fmt.Printf("Receiving syslog on tcp %s\n", listener.Addr())
+	}
+
+	s.wg.Add(1)
+	go s.flushLoop()
+	return nil
+}
+
+// UDPAddr returns the address the UDP listener is bound to, or nil
+func (s *Server) UDPAddr() net.Addr {
+	if s.udpConn == nil {
+		return nil
+	}
+	return s.udpConn.LocalAddr()
+}
+
+// TCPAddr returns the address the TCP listener is bound to, or nil
+func (s *Server) TCPAddr() net.Addr {
+	if s.tcpListener == nil {
+		return nil
+	}
+	return s.tcpListener.Addr()
+}
+
+// Stop closes the listeners and open connections, then submits the remaining messages
+func (s *Server) Stop() {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return
+	}
+	s.closing = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	close(s.quit)
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+	s.wg.Wait()
+	s.flush()
+}
+
+// serveUDP handles one message per datagram
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, _, err := s.udpConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Printf("Failed to read syslog datagram: %v\n", err)
+			continue
+		}
+		s.handle(buf[:n])
+	}
+}
+
+// serveTCP accepts connections until the listener is closed
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcpListener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Printf("Failed to accept syslog connection: %v\n", err)
+			continue
+		}
+
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn reads octet-counted (RFC 6587) or newline-framed messages from a connection
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReaderSize(conn, maxMessageSize)
+	for {
+		frame, err := readFrame(reader)
+		if len(frame) > 0 {
+			s.handle(frame)
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("Closing syslog connection from %s: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// readFrame reads a single message, detecting the framing from its first byte
+func readFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Octet counting: MSG-LEN SP SYSLOG-MSG
+	if first[0] >= '0' && first[0] <= '9' {
+		// Read the length a byte at a time so an endless run of digits can't grow a buffer
+		var digits []byte
+		for {
+			c, err := reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if c == ' ' {
+				break
+			}
+			if c < '0' || c > '9' || len(digits) == maxLengthDigits {
+				return nil, fmt.Errorf("invalid frame length %q", append(digits, c))
+			}
+			digits = append(digits, c)
+		}
+		length, err := strconv.Atoi(string(digits))
+		if err != nil || length <= 0 || length > maxMessageSize {
+			return nil, fmt.Errorf("invalid frame length %q", digits)
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+
+	// Non-transparent framing: messages are terminated by a newline
+	frame, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("message exceeds %d bytes", maxMessageSize)
+	}
+	// Copy since the slice is only valid until the next read
+	return append([]byte(nil), frame...), err
+}
+
+// handle parses a message and adds it to the pending batch
+func (s *Server) handle(raw []byte) {
+	metrics.IngestedBytes.Add(float64(len(raw)), "syslog")
+	log, err := Parse(raw, time.Now())
+	if err != nil {
+		fmt.Printf("Dropping invalid syslog message: %v\n", err)
+		return
+	}
+
+	s.mu.Lock()
+	s.batch = append(s.batch, log)
+	full := len(s.batch) >= batchSize
+	s.mu.Unlock()
+
+	if full {
+		s.flush()
+	}
+}
+
+// flushLoop submits partial batches so messages don't wait for a full batch
+func (s *Server) flushLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// flush submits the pending batch as a store job
+func (s *Server) flush() {
+	s.mu.Lock()
+	batch := s.batch
+	s.batch = nil
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+	if err := s.submit(batch); err != nil {
+		fmt.Printf("Failed to submit %d syslog messages: %v\n", len(batch), err)
+	}
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// EncodeCursor returns the opaque token for the position just after log
+func EncodeCursor(log LogMessage) string {
+	return encodeCursor(Cursor{Time: log.Timestamp, ID: log.ID})
+}
+
+// EncodeOffsetCursor returns the opaque token for the results ranked after offset
+func EncodeOffsetCursor(offset int) string {
+	return encodeCursor(Cursor{Offset: offset})
+}
+
+func encodeCursor(cursor Cursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor parses a token returned by EncodeCursor
+func DecodeCursor(token string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var cursor Cursor
+	if err := json.Unmarshal(data, &cursor); err != nil || (cursor.ID == "" && cursor.Offset <= 0) {
+		return nil, errors.New("invalid cursor")
+	}
+	return &cursor, nil
+}
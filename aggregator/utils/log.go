@@ -6,7 +6,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
 // ValidateRequest checks if the request method is valid.
@@ -34,31 +38,154 @@ func RespondWithJSON(w http.ResponseWriter, statusCode int, response interface{}
 	}
 }
 
-// ParseLogQueryParams extracts and validates the startTime, endTime, and logLevel from the query parameters.
-func ParseLogQueryParams(r *http.Request) (time.Time, time.Time, string, error) {
+// Page sizes of /logs/retrieve, larger limits are capped to MaxPageSize
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// fieldParamPrefix prefixes query parameters filtering on a structured field, e.g. field.env=prod
+const fieldParamPrefix = "field."
+
+// ParseLogQueryParams extracts and validates the startTime, endTime, logLevel, service, source, text, regex, q and field filters
+// as well as the limit, order and cursor paging parameters from the query parameters.
+func ParseLogQueryParams(r *http.Request) (LogQuery, error) {
 	queryParams := r.URL.Query()
+	var query LogQuery
 
 	// Get and validate the startTime parameter
 	startTimeStr := queryParams.Get("startTime")
-	var startTime time.Time
 	var err error
 	if startTimeStr != "" {
-		startTime, err = time.Parse(time.RFC3339, startTimeStr)
+		query.StartTime, err = time.Parse(time.RFC3339, startTimeStr)
 		if err != nil {
-			return time.Time{}, time.Time{}, "", errors.New("invalid startTime. Expected format: RFC3339")
+			return LogQuery{}, errors.New("invalid startTime. Expected format: RFC3339")
 		}
 	}
 
 	// Get and validate the endTime parameter if found
 	endTimeStr := queryParams.Get("endTime")
-	var endTime time.Time
 	if endTimeStr != "" {
-		endTime, err = time.Parse(time.RFC3339, endTimeStr)
+		query.EndTime, err = time.Parse(time.RFC3339, endTimeStr)
 		if err != nil {
-			return time.Time{}, time.Time{}, "", errors.New("invalid endTime. Expected format: RFC3339")
+			return LogQuery{}, errors.New("invalid endTime. Expected format: RFC3339")
+		}
+	}
+	query.LogLevel = queryParams.Get("logLevel")
+	query.Service = queryParams.Get("service")
+	query.Source = queryParams.Get("source")
+	query.Text = queryParams.Get("text")
+	if query.Regex = queryParams.Get("regex"); query.Regex != "" {
+		if query.MessageRegex, err = regexp.Compile(query.Regex); err != nil {
+			return LogQuery{}, fmt.Errorf("invalid regex: %v", err)
+		}
+	}
+
+	// The query language expression, parse errors carry the position of the problem
+	if query.Q = queryParams.Get("q"); query.Q != "" {
+		if query.Expr, err = ParseQuery(query.Q); err != nil {
+			return LogQuery{}, err
+		}
+	}
+
+	// Every field.<name>=<value> parameter adds an equality filter
+	for param, values := range queryParams {
+		if !strings.HasPrefix(param, fieldParamPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(param, fieldParamPrefix)
+		if !ValidFieldName(name) {
+			return LogQuery{}, fmt.Errorf("invalid field name %q. Expected letters, digits, '_' or '-'", name)
+		}
+		if query.Fields == nil {
+			query.Fields = make(map[string]string)
+		}
+		query.Fields[name] = values[0]
+	}
+
+	// Paging defaults to the oldest DefaultPageSize logs
+	query.Limit = DefaultPageSize
+	if limitStr := queryParams.Get("limit"); limitStr != "" {
+		query.Limit, err = strconv.Atoi(limitStr)
+		if err != nil || query.Limit <= 0 {
+			return LogQuery{}, errors.New("invalid limit. Expected a positive integer")
+		}
+		if query.Limit > MaxPageSize {
+			query.Limit = MaxPageSize
+		}
+	}
+
+	query.Order = OrderAsc
+	if order := queryParams.Get("order"); order != "" {
+		if order != OrderAsc && order != OrderDesc && order != OrderRelevance {
+			return LogQuery{}, errors.New("invalid order. Expected asc, desc or relevance")
+		}
+		if order == OrderRelevance && len(Tokenize(query.Text)) == 0 {
+			return LogQuery{}, errors.New("invalid order. Ranking by relevance requires text")
 		}
+		query.Order = order
 	}
-	logLevel := queryParams.Get("logLevel")
 
-	return startTime, endTime, logLevel, nil
+	if cursor := queryParams.Get("cursor"); cursor != "" {
+		if query.After, err = DecodeCursor(cursor); err != nil {
+			return LogQuery{}, err
+		}
+		// Ranked results are paged by offset, everything else by position
+		if (query.Order == OrderRelevance) != (query.After.Offset > 0) {
+			return LogQuery{}, errors.New("invalid cursor for this order")
+		}
+	}
+
+	return query, nil
+}
+
+// Stats bucket widths, DefaultStatsInterval is used when no interval is given
+const (
+	DefaultStatsInterval = time.Hour
+	MinStatsInterval     = time.Second
+)
+
+// ParseStatsQueryParams extracts the log filters like ParseLogQueryParams, as well as the interval
+// and the comma separated groupBy fields of /logs/stats
+func ParseStatsQueryParams(r *http.Request) (StatsQuery, error) {
+	filter, err := ParseLogQueryParams(r)
+	if err != nil {
+		return StatsQuery{}, err
+	}
+	// Every matching log is counted, so paging doesn't apply
+	filter.Limit, filter.Order, filter.After = 0, OrderAsc, nil
+	query := StatsQuery{Filter: filter, Interval: DefaultStatsInterval}
+
+	queryParams := r.URL.Query()
+	if intervalStr := queryParams.Get("interval"); intervalStr != "" {
+		query.Interval, err = time.ParseDuration(intervalStr)
+		if err != nil || query.Interval < MinStatsInterval {
+			return StatsQuery{}, fmt.Errorf("invalid interval. Expected a duration of at least %s, e.g. 5m", MinStatsInterval)
+		}
+	}
+
+	// Group by the same field names the query language accepts, except the message
+	if groupBy := queryParams.Get("groupBy"); groupBy != "" {
+		for _, name := range strings.Split(groupBy, ",") {
+			field, err := canonicalQueryField(strings.TrimSpace(name))
+			if err != nil || field == QueryFieldMessage {
+				return StatsQuery{}, fmt.Errorf("invalid groupBy field %q", name)
+			}
+			query.GroupBy = append(query.GroupBy, field)
+		}
+	}
+	return query, nil
+}
+
+// ValidFieldName reports whether name can be used to filter on a structured field
+func ValidFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c == '_' || c == '-' || unicode.IsLetter(c) || unicode.IsDigit(c)) {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// NDJSONContentType is the Content-Type selecting newline-delimited JSON ingestion
+const NDJSONContentType = "application/x-ndjson"
+
+// MaxNDJSONLineSize is the longest line DecodeNDJSON accepts
+const MaxNDJSONLineSize = 1 << 20
+
+// MaxReportedLineErrors caps the LineErrors DecodeNDJSON returns, further invalid lines are only counted
+const MaxReportedLineErrors = 100
+
+// LineError reports why a single NDJSON line was rejected
+type LineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// DecodeNDJSON streams log messages from body line by line, calling flush with chunks of at most chunkSize messages.
+// It returns the number of accepted and rejected lines, the first MaxReportedLineErrors invalid lines being reported
+// in the returned LineErrors. A flush error aborts decoding.
+func DecodeNDJSON(body io.Reader, chunkSize int, flush func([]LogMessage) error) (int, int, []LineError, error) {
+	reader := bufio.NewReaderSize(body, MaxNDJSONLineSize)
+	chunk := make([]LogMessage, 0, chunkSize)
+	var lineErrors []LineError
+	accepted, rejected := 0, 0
+	reject := func(lineNumber int, reason string) {
+		rejected++
+		if len(lineErrors) < MaxReportedLineErrors {
+			lineErrors = append(lineErrors, LineError{Line: lineNumber, Error: reason})
+		}
+	}
+
+	for lineNumber := 1; ; lineNumber++ {
+		line, tooLong, err := readLine(reader)
+		if err != nil && err != io.EOF {
+			return accepted, rejected, lineErrors, fmt.Errorf("failed to read line %d: %v", lineNumber, err)
+		}
+
+		line = bytes.TrimSpace(line)
+		switch {
+		case tooLong:
+			reject(lineNumber, fmt.Sprintf("line exceeds %d bytes", MaxNDJSONLineSize))
+		case len(line) > 0:
+			var msg LogMessage
+			if decodeErr := json.Unmarshal(line, &msg); decodeErr != nil {
+				reject(lineNumber, decodeErr.Error())
+			} else {
+				chunk = append(chunk, msg)
+			}
+		}
+
+		// Hand full chunks to the caller so memory stays bounded
+		if len(chunk) == chunkSize || (err == io.EOF && len(chunk) > 0) {
+			if flushErr := flush(chunk); flushErr != nil {
+				return accepted, rejected, lineErrors, flushErr
+			}
+			accepted += len(chunk)
+			chunk = make([]LogMessage, 0, chunkSize)
+		}
+
+		if err == io.EOF {
+			return accepted, rejected, lineErrors, nil
+		}
+	}
+}
+
+// readLine reads a single line, discarding the remainder of lines longer than the reader's buffer
+func readLine(reader *bufio.Reader) ([]byte, bool, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != bufio.ErrBufferFull {
+		return line, false, err
+	}
+	for err == bufio.ErrBufferFull {
+		_, err = reader.ReadSlice('\n')
+	}
+	return nil, true, err
+}
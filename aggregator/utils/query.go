@@ -0,0 +1,379 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// QueryNode is a node of a parsed query expression, one of *QueryAnd, *QueryOr, *QueryNot or *QueryTerm
+type QueryNode interface {
+	String() string
+}
+
+// QueryAnd matches when every child matches
+type QueryAnd struct {
+	Children []QueryNode
+}
+
+// QueryOr matches when any child matches
+type QueryOr struct {
+	Children []QueryNode
+}
+
+// QueryNot matches when its child doesn't
+type QueryNot struct {
+	Child QueryNode
+}
+
+// QueryTerm compares a single field against a value, which may contain * wildcards when unquoted.
+// Field is "level", "service", "source", "message" or "fields.<name>".
+type QueryTerm struct {
+	Field   string
+	Value   string
+	pattern *regexp.Regexp // Set when the value contains wildcards
+}
+
+// Query fields with a dedicated attribute on LogMessage, anything else is a structured field
+const (
+	QueryFieldLevel   = "level"
+	QueryFieldService = "service"
+	QueryFieldSource  = "source"
+	QueryFieldMessage = "message"
+	queryFieldsPrefix = "fields."
+)
+
+// queryFieldAliases maps alternative names to their canonical field
+var queryFieldAliases = map[string]string{
+	"host": QueryFieldSource,
+	"msg":  QueryFieldMessage,
+}
+
+// QueryParseError reports where a query failed to parse, Position is the 1-based character offset
+type QueryParseError struct {
+	Position int    `json:"position"`
+	Message  string `json:"message"`
+}
+
+func (e *QueryParseError) Error() string {
+	return fmt.Sprintf("invalid query at position %d: %s", e.Position, e.Message)
+}
+
+// IsPattern reports whether the term's value contains wildcards
+func (t *QueryTerm) IsPattern() bool {
+	return t.pattern != nil
+}
+
+// Pattern returns the regular expression for a wildcard value, anchored unless matching the message
+func (t *QueryTerm) Pattern() string {
+	if t.pattern == nil {
+		return ""
+	}
+	return t.pattern.String()
+}
+
+// MatchValue reports whether value satisfies the term. Messages match on a case-insensitive substring,
+// other fields on the whole value.
+func (t *QueryTerm) MatchValue(value string) bool {
+	if t.pattern != nil {
+		return t.pattern.MatchString(value)
+	}
+	if t.Field == QueryFieldMessage {
+		return strings.Contains(strings.ToLower(value), strings.ToLower(t.Value))
+	}
+	return value == t.Value
+}
+
+func (t *QueryTerm) String() string {
+	return fmt.Sprintf("%s:%q", t.Field, t.Value)
+}
+
+func (n *QueryAnd) String() string { return joinNodes(n.Children, " AND ") }
+func (n *QueryOr) String() string  { return joinNodes(n.Children, " OR ") }
+func (n *QueryNot) String() string { return "NOT " + n.Child.String() }
+
+func joinNodes(nodes []QueryNode, sep string) string {
+	parts := make([]string, len(nodes))
+	for i, node := range nodes {
+		parts[i] = node.String()
+	}
+	return "(" + strings.Join(parts, sep) + ")"
+}
+
+// ParseQuery parses a query such as `level:(ERROR OR WARN) AND service:billing AND NOT host:canary-*`.
+// Terms are combined with AND, OR and NOT (AND is implied between adjacent terms), values without a
+// field match the message, and field:(...) applies the field to every value in the group.
+func ParseQuery(input string) (QueryNode, error) {
+	tokens, err := lexQuery(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	node, err := p.parseOr("")
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.errorf(tok, "unexpected %s", tok)
+	}
+	return node, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenLParen
+	tokenRParen
+	tokenColon
+	tokenAnd
+	tokenOr
+	tokenNot
+)
+
+type queryToken struct {
+	kind  tokenKind
+	value string
+	pos   int // 1-based offset of the token in the input
+}
+
+func (t queryToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenString:
+		return fmt.Sprintf("%q", t.value)
+	default:
+		return fmt.Sprintf("'%s'", t.value)
+	}
+}
+
+// lexQuery splits the input into tokens
+func lexQuery(input string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := i + 1
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: tokenLParen, value: "(", pos: pos})
+			i++
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: tokenRParen, value: ")", pos: pos})
+			i++
+		case r == ':':
+			tokens = append(tokens, queryToken{kind: tokenColon, value: ":", pos: pos})
+			i++
+		case r == '"':
+			var value strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, &QueryParseError{Position: pos, Message: "unterminated quoted string"}
+			}
+			i++ // Closing quote
+			tokens = append(tokens, queryToken{kind: tokenString, value: value.String(), pos: pos})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && strings.IndexRune(`():"`, runes[i]) < 0 {
+				i++
+			}
+			word := string(runes[start:i])
+			kind := tokenWord
+			switch word {
+			case "AND":
+				kind = tokenAnd
+			case "OR":
+				kind = tokenOr
+			case "NOT":
+				kind = tokenNot
+			}
+			tokens = append(tokens, queryToken{kind: kind, value: word, pos: pos})
+		}
+	}
+	return append(tokens, queryToken{kind: tokenEOF, pos: len(runes) + 1}), nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *queryParser) errorf(tok queryToken, format string, args ...interface{}) error {
+	return &QueryParseError{Position: tok.pos, Message: fmt.Sprintf(format, args...)}
+}
+
+// parseOr parses `and (OR and)*`, field is the field applied to bare values inside a field group
+func (p *queryParser) parseOr(field string) (QueryNode, error) {
+	node, err := p.parseAnd(field)
+	if err != nil {
+		return nil, err
+	}
+	children := []QueryNode{node}
+	for p.peek().kind == tokenOr {
+		p.next()
+		node, err := p.parseAnd(field)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &QueryOr{Children: children}, nil
+}
+
+// parseAnd parses `not ([AND] not)*`
+func (p *queryParser) parseAnd(field string) (QueryNode, error) {
+	node, err := p.parseNot(field)
+	if err != nil {
+		return nil, err
+	}
+	children := []QueryNode{node}
+	for {
+		switch p.peek().kind {
+		case tokenAnd:
+			p.next()
+		case tokenWord, tokenString, tokenLParen, tokenNot:
+			// Adjacent terms are implicitly combined with AND
+		default:
+			if len(children) == 1 {
+				return children[0], nil
+			}
+			return &QueryAnd{Children: children}, nil
+		}
+		node, err := p.parseNot(field)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, node)
+	}
+}
+
+// parseNot parses `NOT* primary`
+func (p *queryParser) parseNot(field string) (QueryNode, error) {
+	if p.peek().kind == tokenNot {
+		p.next()
+		child, err := p.parseNot(field)
+		if err != nil {
+			return nil, err
+		}
+		return &QueryNot{Child: child}, nil
+	}
+	return p.parsePrimary(field)
+}
+
+// parsePrimary parses a parenthesized expression, a field:value term, a field:(group) or a bare value
+func (p *queryParser) parsePrimary(field string) (QueryNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenLParen:
+		node, err := p.parseOr(field)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, p.errorf(closing, "expected ')' to close '(' at position %d, got %s", tok.pos, closing)
+		}
+		return node, nil
+
+	case tokenWord:
+		if p.peek().kind == tokenColon {
+			if field != "" {
+				return nil, p.errorf(tok, "field %q is not allowed inside the group of field %q", tok.value, field)
+			}
+			name, err := canonicalQueryField(tok.value)
+			if err != nil {
+				return nil, p.errorf(tok, "%v", err)
+			}
+			p.next() // Colon
+
+			switch value := p.peek(); value.kind {
+			case tokenLParen:
+				return p.parsePrimary(name)
+			case tokenWord, tokenString:
+				p.next()
+				return newQueryTerm(name, value), nil
+			default:
+				return nil, p.errorf(value, "expected a value after '%s:', got %s", tok.value, value)
+			}
+		}
+		fallthrough
+
+	case tokenString:
+		if field == "" {
+			field = QueryFieldMessage
+		}
+		return newQueryTerm(field, tok), nil
+
+	default:
+		return nil, p.errorf(tok, "unexpected %s", tok)
+	}
+}
+
+// canonicalQueryField resolves aliases and checks structured field names
+func canonicalQueryField(name string) (string, error) {
+	if alias, ok := queryFieldAliases[name]; ok {
+		return alias, nil
+	}
+	switch name {
+	case QueryFieldLevel, QueryFieldService, QueryFieldSource, QueryFieldMessage:
+		return name, nil
+	}
+	name = strings.TrimPrefix(name, queryFieldsPrefix)
+	if !ValidFieldName(name) {
+		return "", fmt.Errorf("invalid field name %q", name)
+	}
+	return queryFieldsPrefix + name, nil
+}
+
+// newQueryTerm creates a term, compiling unquoted values with wildcards into a pattern
+func newQueryTerm(field string, tok queryToken) *QueryTerm {
+	term := &QueryTerm{Field: field, Value: tok.value}
+	if tok.kind == tokenWord && strings.Contains(tok.value, "*") {
+		parts := strings.Split(tok.value, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		pattern := strings.Join(parts, ".*")
+		if field == QueryFieldMessage {
+			pattern = "(?i)" + pattern
+		} else {
+			pattern = "^" + pattern + "$"
+		}
+		term.pattern = regexp.MustCompile(pattern)
+	}
+	return term
+}
+
+// StructuredField returns the name of the structured field a term compares, or "" for a top-level field
+func (t *QueryTerm) StructuredField() string {
+	if strings.HasPrefix(t.Field, queryFieldsPrefix) {
+		return strings.TrimPrefix(t.Field, queryFieldsPrefix)
+	}
+	return ""
+}
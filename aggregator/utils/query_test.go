@@ -0,0 +1,76 @@
+package utils_test
+
+import (
+	"errors"
+	"log-aggregator/aggregator/utils"
+	"testing"
+)
+
+// TestParseQuery tests the structure of parsed expressions.
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`level:ERROR`, `level:"ERROR"`},
+		{`level:(ERROR OR WARN) AND service:billing`, `((level:"ERROR" OR level:"WARN") AND service:"billing")`},
+		{`message:"timeout" NOT host:canary-*`, `(message:"timeout" AND NOT source:"canary-*")`},
+		{`a OR b c`, `(message:"a" OR (message:"b" AND message:"c"))`},
+		{`env:prod`, `fields.env:"prod"`},
+		{`NOT (level:INFO OR level:DEBUG)`, `NOT (level:"INFO" OR level:"DEBUG")`},
+	}
+
+	for _, tt := range tests {
+		node, err := utils.ParseQuery(tt.input)
+		if err != nil {
+			t.Errorf("ParseQuery(%q) failed: %v", tt.input, err)
+			continue
+		}
+		if got := node.String(); got != tt.want {
+			t.Errorf("ParseQuery(%q) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
+
+// TestParseQuery_Errors tests that parse errors point at the offending position.
+func TestParseQuery_Errors(t *testing.T) {
+	tests := []struct {
+		input    string
+		position int
+	}{
+		{`level:(ERROR OR WARN`, 21},
+		{`level:`, 7},
+		{`service:billing AND`, 20},
+		{`message:"unterminated`, 9},
+		{`level:(service:x)`, 8},
+		{`bad$name:x`, 1},
+		{`)`, 1},
+	}
+
+	for _, tt := range tests {
+		_, err := utils.ParseQuery(tt.input)
+		var parseErr *utils.QueryParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("ParseQuery(%q) expected a parse error, got %v", tt.input, err)
+			continue
+		}
+		if parseErr.Position != tt.position {
+			t.Errorf("ParseQuery(%q) error at position %d, want %d (%v)", tt.input, parseErr.Position, tt.position, err)
+		}
+	}
+}
+
+// TestQueryTerm_MatchValue tests exact, substring and wildcard matching.
+func TestQueryTerm_MatchValue(t *testing.T) {
+	node, _ := utils.ParseQuery(`host:canary-*`)
+	term := node.(*utils.QueryTerm)
+	if !term.MatchValue("canary-1") || term.MatchValue("prod-canary-1") {
+		t.Error("Expected the wildcard to match whole values starting with canary-")
+	}
+
+	node, _ = utils.ParseQuery(`message:Timeout`)
+	term = node.(*utils.QueryTerm)
+	if !term.MatchValue("upstream timeout after 10s") {
+		t.Error("Expected messages to match on a case-insensitive substring")
+	}
+}
@@ -1,25 +1,162 @@
 package utils
 
-import "time"
+import (
+	"context"
+	"regexp"
+	"time"
+)
 
 type JobType int
 
 const (
 	FetchJob JobType = iota
 	StoreJob
+	StatsJob
 )
 
+// JobTypes lists every job type
+var JobTypes = []JobType{FetchJob, StoreJob, StatsJob}
+
+// ParseJobType returns the job type with the name String returns
+func ParseJobType(name string) (JobType, bool) {
+	for _, t := range JobTypes {
+		if t.String() == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+func (t JobType) String() string {
+	switch t {
+	case FetchJob:
+		return "fetch"
+	case StoreJob:
+		return "store"
+	case StatsJob:
+		return "stats"
+	}
+	return "unknown"
+}
+
 type Job struct {
-	Type      JobType           `json:"type"`
-	Logs      []LogMessage      `json:"logs"`
-	Result    chan []LogMessage `json:"-"`
-	StartTime time.Time         `json:"start_time"`
-	EndTime   time.Time         `json:"end_time"`
-	LogLevel  string            `json:"log_level"`
+	Ctx    context.Context `json:"-"` // Cancels the job once done, nil for jobs nobody waits on
+	Type   JobType         `json:"type"`
+	Logs   []LogMessage    `json:"logs"`
+	Query  LogQuery        `json:"query"`
+	Stats  StatsQuery      `json:"stats"`
+	WALSeq uint64          `json:"wal_seq"` // Sequence number of the batch in the WAL, 0 when not logged
+	Queued time.Time       `json:"-"`       // When the job was added to the worker pool
+	Tries  int             `json:"-"`       // Failed attempts at a store job, which is retried until stored
+
+	Done   chan JobResult  `json:"-"` // Receives the result once the job is processed, unless Ctx is done first
+	OnDone func(JobResult) `json:"-"` // Called by the worker with the result once the job is processed, or given up on
+}
+
+// ErrorKind tells why a job failed
+type ErrorKind int
+
+const (
+	ErrorNone        ErrorKind = iota
+	ErrorCanceled              // The job's context was done, the client went away or the deadline passed
+	ErrorInvalid               // The storage backend can't run the query as given
+	ErrorStorage               // The storage backend failed
+	ErrorUnavailable           // A circuit breaker rejected the job without trying the storage backend
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorNone:
+		return "none"
+	case ErrorCanceled:
+		return "canceled"
+	case ErrorInvalid:
+		return "invalid"
+	case ErrorStorage:
+		return "storage"
+	case ErrorUnavailable:
+		return "unavailable"
+	}
+	return "unknown"
+}
+
+// JobResult is what a worker reports once it processed a job
+type JobResult struct {
+	Type     JobType
+	Logs     []LogMessage  // Logs fetched by a fetch job
+	Buckets  []StatsBucket // Buckets counted by a stats job
+	Stored   int           // Logs stored by a store job
+	Err      error         // Why the job failed, nil on success
+	Kind     ErrorKind
+	Wait     time.Duration // How long the job waited for a worker
+	Duration time.Duration // How long the worker took to process it
 }
 
 type LogMessage struct {
-	Timestamp time.Time `json:"timestamp"`
-	Level     string    `json:"level"`
-	Message   string    `json:"message"`
+	ID        string                 `json:"id,omitempty"` // Assigned by the storage backend, ignored on ingestion
+	Timestamp time.Time              `json:"timestamp"`
+	Level     string                 `json:"level"`
+	Message   string                 `json:"message"`
+	Service   string                 `json:"service,omitempty"` // Name of the service that emitted the log
+	Source    string                 `json:"source,omitempty"`  // Host or instance the log came from
+	Fields    map[string]interface{} `json:"fields,omitempty"`  // Arbitrary key/values attached to the log
+	Score     float64                `json:"score,omitempty"`   // Relevance to the text search when ranked
+}
+
+// LogQuery holds the filters of a log retrieval, zero values match everything
+type LogQuery struct {
+	StartTime    time.Time         `json:"start_time"`
+	EndTime      time.Time         `json:"end_time"`
+	LogLevel     string            `json:"log_level"`
+	Service      string            `json:"service"`
+	Source       string            `json:"source"`
+	Fields       map[string]string `json:"fields"` // Field values that must match exactly
+	Text         string            `json:"text"`   // Words the message must all contain, case-insensitive
+	Regex        string            `json:"regex"`  // Regular expression the message must match, compiled into MessageRegex
+	MessageRegex *regexp.Regexp    `json:"-"`
+	Q            string            `json:"q"` // Query language expression, parsed into Expr
+	Expr         QueryNode         `json:"-"`
+	Order        string            `json:"order"` // OrderAsc (default) or OrderDesc by time, or OrderRelevance to the text
+	Limit        int               `json:"limit"` // Maximum number of logs to return, 0 for no limit
+	After        *Cursor           `json:"after"` // Only return logs sorted after this position
+}
+
+// Sort orders of a LogQuery
+const (
+	OrderAsc       = "asc"
+	OrderDesc      = "desc"
+	OrderRelevance = "relevance"
+)
+
+// Cursor is a position in the (time, id) ordering of logs, or an offset into results ranked by relevance
+type Cursor struct {
+	Time   time.Time `json:"t"`
+	ID     string    `json:"id,omitempty"`
+	Offset int       `json:"offset,omitempty"`
+}
+
+// LogPage is a page of retrieved logs, NextCursor is empty on the last page
+type LogPage struct {
+	Logs       []LogMessage `json:"logs"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// StatsQuery counts the logs matching Filter per time bucket of Interval and per value of the GroupBy fields
+type StatsQuery struct {
+	Filter   LogQuery      `json:"filter"`
+	Interval time.Duration `json:"interval"`
+	GroupBy  []string      `json:"group_by"` // Query language fields, e.g. "level" or "fields.env"
+}
+
+// StatsBucket is the number of logs in the time bucket starting at Time having the Group values
+type StatsBucket struct {
+	Time  time.Time         `json:"time"`
+	Group map[string]string `json:"group,omitempty"` // Keyed by GroupBy field, "" when the log lacks it
+	Count int64             `json:"count"`
+}
+
+// LogStats is the response of /logs/stats
+type LogStats struct {
+	Interval string        `json:"interval"`
+	Buckets  []StatsBucket `json:"buckets"`
 }
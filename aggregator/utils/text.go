@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Tokenize splits text into the lowercase words full-text search matches on
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// TextScore ranks how relevant a message is to the search terms, 0 when a term is missing.
+// Every occurrence of a term counts, weighted down in long messages.
+func TextScore(message string, terms []string) float64 {
+	if len(terms) == 0 {
+		return 0
+	}
+	tokens := Tokenize(message)
+	counts := make(map[string]int, len(tokens))
+	for _, token := range tokens {
+		counts[token]++
+	}
+
+	occurrences := 0
+	for _, term := range terms {
+		if counts[term] == 0 {
+			return 0
+		}
+		occurrences += counts[term]
+	}
+	return float64(occurrences) / float64(len(tokens))
+}
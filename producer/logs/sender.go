@@ -3,9 +3,12 @@ package logs
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -17,9 +20,49 @@ const LogAggregatorURL = "http://localhost:8005/logs/batch"
 
 // LogMessage represents the structure of the log message
 type LogMessage struct {
-	Timestamp time.Time `json:"timestamp"`
-	Level     string    `json:"level"`
-	Message   string    `json:"message"`
+	Timestamp time.Time              `json:"timestamp"`
+	Level     string                 `json:"level"`
+	Message   string                 `json:"message"`
+	Service   string                 `json:"service,omitempty"`
+	Source    string                 `json:"source,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// RetryAfterError is returned by SendLog when the aggregator turned the batch away, asking to retry after a while
+type RetryAfterError struct {
+	Status string
+	After  time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("Failed to send log, status code: %s, retry after %v", e.Status, e.After)
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(0, time.Until(at)), true
+	}
+	return 0, false
+}
+
+// retryAfterBackOff waits at least as long before the next attempt as the aggregator asked for
+type retryAfterBackOff struct {
+	backoff.BackOff
+	after time.Duration // Asked for by the last failed attempt
+}
+
+func (b *retryAfterBackOff) NextBackOff() time.Duration {
+	next := b.BackOff.NextBackOff()
+	if next == backoff.Stop {
+		return next
+	}
+	after := b.after
+	b.after = 0
+	return max(next, after)
 }
 
 // SendLog sends a batch of log messages to the log aggregator service
@@ -42,6 +85,12 @@ func SendLog(logs []LogMessage) error {
 	}
 	defer resp.Body.Close()
 
+	// The aggregator is overloaded or its storage is down, and tells when to try again
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return &RetryAfterError{Status: resp.Status, After: after}
+		}
+	}
 	// Check if the response status is not OK (200)
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("Failed to send log, status code: " + resp.Status)
@@ -59,6 +108,12 @@ func LogProducer() {
 	// Define log levels
 	logLevels := []string{"INFO", "WARN", "ERROR"}
 
+	// Identify where the logs come from
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
 	// Prepare a batch of log messages
 	var logs []LogMessage
 	for i := 0; i < 10; i++ { // Simulate creating 10 log messages
@@ -70,19 +125,31 @@ func LogProducer() {
 			Timestamp: timestamp,
 			Level:     level,
 			Message:   message,
+			Service:   "producer",
+			Source:    hostname,
+			Fields: map[string]interface{}{
+				"request_id": fmt.Sprintf("%08x", r.Uint32()),
+				"user_id":    r.Intn(1000),
+			},
 		})
 	}
 
+	// Create an exponential backoff with custom settings if needed
+	exponential := backoff.NewExponentialBackOff()
+	exponential.MaxElapsedTime = 1 * time.Minute // Maximum time to retry
+	backoffStrategy := &retryAfterBackOff{BackOff: exponential}
+
 	operation := func() error {
-		return SendLog(logs) // Send the batch of log messages
+		err := SendLog(logs) // Send the batch of log messages
+		var retryErr *RetryAfterError
+		if errors.As(err, &retryErr) {
+			backoffStrategy.after = retryErr.After
+		}
+		return err
 	}
 
-	// Create an exponential backoff with custom settings if needed
-	backoffStrategy := backoff.NewExponentialBackOff()
-	backoffStrategy.MaxElapsedTime = 1 * time.Minute // Maximum time to retry
-
 	// Use exponential backoff for retrying
-	err := backoff.Retry(operation, backoffStrategy)
+	err = backoff.Retry(operation, backoffStrategy)
 	if err != nil {
 		log.Printf("Failed to send logs after retries: %v", err)
 	}